@@ -53,6 +53,11 @@ var (
 	startTime    = time.Now()
 )
 
+// redactedPassword stands in for the folder encryption passwords in the
+// configuration handed out by the REST interface. Posting it back keeps the
+// password as it was.
+const redactedPassword = "********"
+
 type apiSvc struct {
 	id              protocol.DeviceID
 	cfg             *config.Wrapper
@@ -143,12 +148,17 @@ func (s *apiSvc) Serve() {
 	// The GET handlers
 	getRestMux := http.NewServeMux()
 	getRestMux.HandleFunc("/rest/db/completion", s.getDBCompletion)              // device folder
+	getRestMux.HandleFunc("/rest/db/conflicts", s.getDBConflicts)                // folder
+	getRestMux.HandleFunc("/rest/db/deletions", s.getDBDeletions)                // folder
 	getRestMux.HandleFunc("/rest/db/file", s.getDBFile)                          // folder file
 	getRestMux.HandleFunc("/rest/db/ignores", s.getDBIgnores)                    // folder
 	getRestMux.HandleFunc("/rest/db/need", s.getDBNeed)                          // folder [perpage] [page]
+	getRestMux.HandleFunc("/rest/db/plan", s.getDBPlan)                          // folder
 	getRestMux.HandleFunc("/rest/db/status", s.getDBStatus)                      // folder
 	getRestMux.HandleFunc("/rest/db/browse", s.getDBBrowse)                      // folder [prefix] [dirsonly] [levels]
 	getRestMux.HandleFunc("/rest/events", s.getEvents)                           // since [limit]
+	getRestMux.HandleFunc("/rest/folder/errors", s.getFolderErrors)              // folder
+	getRestMux.HandleFunc("/rest/folder/versions", s.getFolderVersions)          // folder [prefix]
 	getRestMux.HandleFunc("/rest/stats/device", s.getDeviceStats)                // -
 	getRestMux.HandleFunc("/rest/stats/folder", s.getFolderStats)                // -
 	getRestMux.HandleFunc("/rest/svc/deviceid", s.getDeviceID)                   // id
@@ -167,10 +177,16 @@ func (s *apiSvc) Serve() {
 
 	// The POST handlers
 	postRestMux := http.NewServeMux()
+	postRestMux.HandleFunc("/rest/db/conflicts", s.postDBConflicts)            // folder conflict keep
+	postRestMux.HandleFunc("/rest/db/deletions", s.postDBDeletions)            // folder approve
 	postRestMux.HandleFunc("/rest/db/prio", s.postDBPrio)                      // folder file [perpage] [page]
 	postRestMux.HandleFunc("/rest/db/ignores", s.postDBIgnores)                // folder
 	postRestMux.HandleFunc("/rest/db/override", s.postDBOverride)              // folder
+	postRestMux.HandleFunc("/rest/db/pause", s.postDBPause)                    // folder
+	postRestMux.HandleFunc("/rest/db/resume", s.postDBResume)                  // folder
+	postRestMux.HandleFunc("/rest/db/revert", s.postDBRevert)                  // folder
 	postRestMux.HandleFunc("/rest/db/scan", s.postDBScan)                      // folder [sub...] [delay]
+	postRestMux.HandleFunc("/rest/folder/versions", s.postFolderVersions)      // folder <body>
 	postRestMux.HandleFunc("/rest/system/config", s.postSystemConfig)          // <body>
 	postRestMux.HandleFunc("/rest/system/error", s.postSystemError)            // <body>
 	postRestMux.HandleFunc("/rest/system/error/clear", s.postSystemErrorClear) // -
@@ -469,6 +485,136 @@ func (s *apiSvc) postDBOverride(w http.ResponseWriter, r *http.Request) {
 	go s.model.Override(folder)
 }
 
+func (s *apiSvc) postDBRevert(w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var folder = qs.Get("folder")
+	if err := s.model.Revert(folder); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func (s *apiSvc) postDBPause(w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var folder = qs.Get("folder")
+	if err := s.model.PauseFolder(folder); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func (s *apiSvc) postDBResume(w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var folder = qs.Get("folder")
+	if err := s.model.ResumeFolder(folder); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func (s *apiSvc) getDBConflicts(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	conflicts, err := s.model.Conflicts(qs.Get("folder"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	json.NewEncoder(w).Encode(conflicts)
+}
+
+func (s *apiSvc) postDBConflicts(w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var folder = qs.Get("folder")
+	var conflict = qs.Get("conflict")
+	var keep = qs.Get("keep")
+	if err := s.model.ResolveConflict(folder, conflict, keep); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func (s *apiSvc) getDBDeletions(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	local, remote, err := s.model.HeldDeletions(qs.Get("folder"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string][]string{
+		"local":  local,
+		"remote": remote,
+	})
+}
+
+func (s *apiSvc) postDBDeletions(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	folder := qs.Get("folder")
+	approve, err := strconv.ParseBool(qs.Get("approve"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if approve {
+		err = s.model.ApproveDeletions(folder)
+	} else {
+		err = s.model.RejectDeletions(folder)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func (s *apiSvc) getFolderErrors(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	fileErrors, err := s.model.FolderErrors(qs.Get("folder"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	json.NewEncoder(w).Encode(fileErrors)
+}
+
+func (s *apiSvc) getFolderVersions(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	versions, err := s.model.GetFolderVersions(qs.Get("folder"), qs.Get("prefix"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	json.NewEncoder(w).Encode(versions)
+}
+
+func (s *apiSvc) postFolderVersions(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	// The body maps file names to the version time to restore.
+	var versions map[string]time.Time
+	err := json.NewDecoder(r.Body).Decode(&versions)
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	errs, err := s.model.RestoreFolderVersions(qs.Get("folder"), versions)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(errs)
+}
+
 func (s *apiSvc) getDBNeed(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
 
@@ -499,6 +645,19 @@ func (s *apiSvc) getDBNeed(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(output)
 }
 
+func (s *apiSvc) getDBPlan(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	actions, err := s.model.Plan(qs.Get("folder"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	json.NewEncoder(w).Encode(actions)
+}
+
 func (s *apiSvc) getSystemConnections(w http.ResponseWriter, r *http.Request) {
 	var res = s.model.ConnectionStats()
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -534,7 +693,7 @@ func (s *apiSvc) getDBFile(w http.ResponseWriter, r *http.Request) {
 
 func (s *apiSvc) getSystemConfig(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	json.NewEncoder(w).Encode(s.cfg.Raw())
+	json.NewEncoder(w).Encode(redactPasswords(s.cfg.Raw()))
 }
 
 func (s *apiSvc) postSystemConfig(w http.ResponseWriter, r *http.Request) {
@@ -549,6 +708,8 @@ func (s *apiSvc) postSystemConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	restorePasswords(&to, s.cfg.Folders())
+
 	if to.GUI.Password != s.cfg.GUI().Password {
 		if to.GUI.Password != "" {
 			hash, err := bcrypt.GenerateFromPassword([]byte(to.GUI.Password), 0)
@@ -581,6 +742,28 @@ func (s *apiSvc) postSystemConfig(w http.ResponseWriter, r *http.Request) {
 	s.cfg.Save()
 }
 
+// redactPasswords returns a copy of the configuration with the folder
+// encryption passwords replaced by redactedPassword.
+func redactPasswords(cfg config.Configuration) config.Configuration {
+	cfg = cfg.Copy()
+	for i := range cfg.Folders {
+		if cfg.Folders[i].EncryptionPassword != "" {
+			cfg.Folders[i].EncryptionPassword = redactedPassword
+		}
+	}
+	return cfg
+}
+
+// restorePasswords puts back the encryption passwords of the folders that
+// were posted with the redacted one.
+func restorePasswords(cfg *config.Configuration, folders map[string]config.FolderConfiguration) {
+	for i, folder := range cfg.Folders {
+		if cur, ok := folders[folder.ID]; ok && folder.EncryptionPassword == redactedPassword {
+			cfg.Folders[i].EncryptionPassword = cur.EncryptionPassword
+		}
+	}
+}
+
 func (s *apiSvc) getSystemConfigInsync(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(map[string]bool{"configInSync": configInSync})
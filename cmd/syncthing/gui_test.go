@@ -0,0 +1,46 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/syncthing/syncthing/lib/config"
+)
+
+func TestRedactPasswords(t *testing.T) {
+	cfg := config.Configuration{
+		Folders: []config.FolderConfiguration{
+			{ID: "secret", EncryptionPassword: "hunter2"},
+			{ID: "plain"},
+		},
+	}
+
+	red := redactPasswords(cfg)
+	if pw := red.Folders[0].EncryptionPassword; pw != redactedPassword {
+		t.Errorf("password returned as %q", pw)
+	}
+	if pw := red.Folders[1].EncryptionPassword; pw != "" {
+		t.Errorf("folder without password returned with %q", pw)
+	}
+	if pw := cfg.Folders[0].EncryptionPassword; pw != "hunter2" {
+		t.Errorf("original configuration changed to %q", pw)
+	}
+
+	// Posting the redacted configuration back keeps the password, and a new
+	// one replaces it.
+	folders := map[string]config.FolderConfiguration{"secret": cfg.Folders[0]}
+	restorePasswords(&red, folders)
+	if pw := red.Folders[0].EncryptionPassword; pw != "hunter2" {
+		t.Errorf("password restored as %q", pw)
+	}
+	red.Folders[0].EncryptionPassword = "correct horse"
+	restorePasswords(&red, folders)
+	if pw := red.Folders[0].EncryptionPassword; pw != "correct horse" {
+		t.Errorf("new password replaced by %q", pw)
+	}
+}
@@ -165,6 +165,7 @@ are mostly useful for developers. Use with care.
                  - "stats"    (the stats package)
                  - "suture"   (the suture package; service management)
                  - "upnp"     (the upnp package)
+                 - "watcher"  (the watcher package; file system notifications)
                  - "xdr"      (the xdr package)
                  - "all"      (all of the above)
 
@@ -645,6 +646,10 @@ func syncthingMain() {
 			}
 			m.Index(device, folderCfg.ID, nil, 0, nil)
 		}
+		if folderCfg.Paused {
+			l.Infof("Folder %q is paused", folderCfg.ID)
+			continue
+		}
 		// Routine to pull blocks from other devices to synchronize the local
 		// folder. Does not run when we are in read only (publish only) mode.
 		if folderCfg.ReadOnly {
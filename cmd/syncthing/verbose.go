@@ -141,6 +141,26 @@ func (s *verboseSvc) formatEvent(ev events.Event) string {
 		device := data["device"]
 		return fmt.Sprintf("Device %v was resumed", device)
 
+	case events.FolderPaused:
+		data := ev.Data.(map[string]string)
+		folder := data["folder"]
+		return fmt.Sprintf("Folder %q was paused", folder)
+	case events.FolderResumed:
+		data := ev.Data.(map[string]string)
+		folder := data["folder"]
+		return fmt.Sprintf("Folder %q was resumed", folder)
+
+	case events.ConflictCreated:
+		data := ev.Data.(map[string]string)
+		return fmt.Sprintf("Conflict in folder %q: %q was moved to %q", data["folder"], data["name"], data["conflictName"])
+	case events.ConflictResolved:
+		data := ev.Data.(map[string]string)
+		return fmt.Sprintf("Conflict in folder %q for %q resolved: keep %s", data["folder"], data["name"], data["keep"])
+
+	case events.DeletionsHeld:
+		data := ev.Data.(map[string]interface{})
+		return fmt.Sprintf("Deletions in folder %q held for confirmation: %v local, %v remote", data["folder"], data["local"], data["remote"])
+
 	case events.ExternalPortMappingChanged:
 		data := ev.Data.(map[string]int)
 		port := data["port"]
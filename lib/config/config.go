@@ -98,6 +98,7 @@ type FolderConfiguration struct {
 	RawPath               string                      `xml:"path,attr" json:"path"`
 	Devices               []FolderDeviceConfiguration `xml:"device" json:"devices"`
 	ReadOnly              bool                        `xml:"ro,attr" json:"readOnly"`
+	ReceiveOnly           bool                        `xml:"receiveOnly,attr" json:"receiveOnly"`
 	RescanIntervalS       int                         `xml:"rescanIntervalS,attr" json:"rescanIntervalS"`
 	IgnorePerms           bool                        `xml:"ignorePerms,attr" json:"ignorePerms"`
 	AutoNormalize         bool                        `xml:"autoNormalize,attr" json:"autoNormalize"`
@@ -106,9 +107,30 @@ type FolderConfiguration struct {
 	Copiers               int                         `xml:"copiers" json:"copiers"` // This defines how many files are handled concurrently.
 	Pullers               int                         `xml:"pullers" json:"pullers"` // Defines how many blocks are fetched at the same time, possibly between separate copier routines.
 	Hashers               int                         `xml:"hashers" json:"hashers"` // Less than one sets the value to the number of cores. These are CPU bound due to hashing.
+	Walkers               int                         `xml:"walkers" json:"walkers"` // Defines how many directories are read at the same time when scanning. By default, or with one, the tree is walked serially.
 	Order                 PullOrder                   `xml:"order" json:"order"`
 	IgnoreDelete          bool                        `xml:"ignoreDelete" json:"ignoreDelete"`
 	ScanProgressIntervalS int                         `xml:"scanProgressInterval" json:"scanProgressInterval"` // Set to a negative value to disable. Value of 0 will get replaced with value of 2 (default value)
+	Paused                bool                        `xml:"paused" json:"paused"`
+	LargeBlocks           bool                        `xml:"largeBlocks" json:"largeBlocks"`     // Use block sizes larger than 128 KiB for large files.
+	WatchChanges          bool                        `xml:"watchChanges" json:"watchChanges"`   // Scan changed paths as reported by file system notifications. Periodic rescans are then done at most hourly.
+	WatchDelayS           int                         `xml:"watchDelayS" json:"watchDelayS"`     // How long changes must settle before being scanned. Values below one are replaced with 10 when the watcher starts.
+	StableWindowS         int                         `xml:"stableWindowS" json:"stableWindowS"` // Changed files are only scanned once they have not been modified for this long. Zero means no wait.
+	ConflictPolicy        ConflictPolicy              `xml:"conflictPolicy" json:"conflictPolicy"`
+	ConflictPreferDevice  string                      `xml:"conflictPreferDevice,omitempty" json:"conflictPreferDevice"` // The device whose changes win conflicts, with the preferDevice policy.
+	MaxConflictCopies     int                         `xml:"maxConflictCopies" json:"maxConflictCopies"`                 // The number of conflict copies kept per file, oldest removed first. Zero means no limit.
+	EncryptionPassword    string                      `xml:"encryptionPassword,omitempty" json:"encryptionPassword"`     // The key for the data sent to untrusted devices is derived from this. Stored in plain text in config.xml, and not returned by the REST interface.
+	SyncOwnership         bool                        `xml:"syncOwnership" json:"syncOwnership"`                         // Record file owner and group, and apply them when privileged to.
+	SyncXattrs            bool                        `xml:"syncXattrs" json:"syncXattrs"`                               // Record and apply extended attributes in the user namespace.
+	SyncHardLinks         bool                        `xml:"syncHardLinks" json:"syncHardLinks"`                         // Hash hard linked files once, and recreate the links when pulling.
+	CaseSensitivity       CaseSensitivity             `xml:"caseSensitivity" json:"caseSensitivity"`                     // Whether the file system tells apart names differing only in case. Probed by default.
+	SafeNames             bool                        `xml:"safeNames" json:"safeNames"`                                 // Store characters not allowed on Windows encoded in file names on disk.
+	MaxDeletes            int                         `xml:"maxDeletes" json:"maxDeletes"`                               // Deleting more files than this at once must be confirmed. Zero means no limit.
+	MaxDeletesPct         int                         `xml:"maxDeletesPct" json:"maxDeletesPct"`                         // Likewise, as a percentage of the files in the folder.
+	VerifyIntervalS       int                         `xml:"verifyIntervalS" json:"verifyIntervalS"`                     // How often all files are read back and checked against their hashes. Zero disables verification.
+	VerifyRateKiBs        int                         `xml:"verifyRateKiBs" json:"verifyRateKiBs"`                       // How fast files are read for verification. Value of 0 gets replaced with 1024.
+	VerifyRepair          bool                        `xml:"verifyRepair" json:"verifyRepair"`                           // Fetch corrupt blocks again from devices with the same version of the file.
+	MaxScanKiBs           int                         `xml:"maxScanKiBs" json:"maxScanKiBs"`                             // How fast files are read for hashing when scanning. Zero means no limit.
 
 	Invalid string `xml:"-" json:"invalid"` // Set at runtime when there is an error, not saved
 }
@@ -148,6 +170,26 @@ func (f FolderConfiguration) Path() string {
 	return f.RawPath
 }
 
+// FilePath returns the path on disk of the named file in the folder.
+func (f FolderConfiguration) FilePath(name string) string {
+	if f.SafeNames {
+		name = osutil.EncodeFilename(name)
+	}
+	return filepath.Join(f.Path(), name)
+}
+
+// DeletesExceeded returns true if deleting the given number of files, out
+// of the number of files in the folder, must be confirmed first.
+func (f FolderConfiguration) DeletesExceeded(deletes, files int) bool {
+	if f.MaxDeletes > 0 && deletes > f.MaxDeletes {
+		return true
+	}
+	if f.MaxDeletesPct > 0 && files > 0 && deletes*100 > f.MaxDeletesPct*files {
+		return true
+	}
+	return false
+}
+
 func (f *FolderConfiguration) CreateMarker() error {
 	if !f.HasMarker() {
 		marker := filepath.Join(f.Path(), ".stfolder")
@@ -236,7 +278,9 @@ func (orig DeviceConfiguration) Copy() DeviceConfiguration {
 }
 
 type FolderDeviceConfiguration struct {
-	DeviceID protocol.DeviceID `xml:"id,attr" json:"deviceID"`
+	DeviceID  protocol.DeviceID `xml:"id,attr" json:"deviceID"`
+	Untrusted bool              `xml:"untrusted,attr,omitempty" json:"untrusted"` // The device only gets to store the folder contents encrypted.
+	ReadOnly  bool              `xml:"readOnly,attr,omitempty" json:"readOnly"`   // Changes made on the device are not accepted.
 }
 
 type OptionsConfiguration struct {
@@ -274,6 +318,8 @@ type OptionsConfiguration struct {
 	MinHomeDiskFreePct      float64  `xml:"minHomeDiskFreePct" json:"minHomeDiskFreePct" default:"1"`
 	ReleasesURL             string   `xml:"releasesURL" json:"releasesURL" default:"https://api.github.com/repos/syncthing/syncthing/releases?per_page=30"`
 	AlwaysLocalNets         []string `xml:"alwaysLocalNet" json:"alwaysLocalNets"`
+	MaxScanKiBs             int      `xml:"maxScanKiBs" json:"maxScanKiBs"`                           // How fast files are read for hashing when scanning, for all folders together. Zero means no limit.
+	ScanIdlePriority        bool     `xml:"scanIdlePriority" json:"scanIdlePriority" default:"false"` // Hash at idle I/O priority and the lowest CPU priority, where supported.
 }
 
 func (orig OptionsConfiguration) Copy() OptionsConfiguration {
@@ -372,6 +418,32 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 			folder.RescanIntervalS = 0
 		}
 
+		if folder.MaxConflictCopies < 0 {
+			folder.MaxConflictCopies = 0
+		}
+		if folder.ConflictPolicy == ConflictPreferDevice {
+			if _, err := protocol.DeviceIDFromString(folder.ConflictPreferDevice); err != nil {
+				l.Warnf("Folder %q prefers invalid device %q in conflicts; using the default conflict policy", folder.ID, folder.ConflictPreferDevice)
+				folder.ConflictPolicy = ConflictDefault
+			}
+		}
+
+		for i := range folder.Devices {
+			if folder.Devices[i].Untrusted && folder.Devices[i].DeviceID.Equals(myID) {
+				l.Warnf("Folder %q is marked untrusted for this device; ignoring", folder.ID)
+				folder.Devices[i].Untrusted = false
+			}
+			if folder.Devices[i].ReadOnly && folder.Devices[i].DeviceID.Equals(myID) {
+				l.Warnf("Folder %q is marked read only for this device; ignoring", folder.ID)
+				folder.Devices[i].ReadOnly = false
+			}
+		}
+
+		if folder.ReadOnly && folder.ReceiveOnly {
+			l.Warnf("Folder %q is both read only and receive only; treating it as read only", folder.ID)
+			folder.ReceiveOnly = false
+		}
+
 		if seen, ok := seenFolders[folder.ID]; ok {
 			l.Warnf("Multiple folders with ID %q; disabling", folder.ID)
 			seen.Invalid = "duplicate folder ID"
@@ -826,3 +898,79 @@ func (o *PullOrder) UnmarshalText(bs []byte) error {
 	}
 	return nil
 }
+
+type ConflictPolicy int
+
+const (
+	ConflictDefault      ConflictPolicy = iota // newest change wins, the other is kept as a conflict copy
+	ConflictPreferDevice                       // changes made by the preferred device win
+	ConflictNoCopies                           // newest change wins, the other is discarded
+)
+
+func (p ConflictPolicy) String() string {
+	switch p {
+	case ConflictDefault:
+		return "default"
+	case ConflictPreferDevice:
+		return "preferDevice"
+	case ConflictNoCopies:
+		return "noCopies"
+	default:
+		return "unknown"
+	}
+}
+
+func (p ConflictPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *ConflictPolicy) UnmarshalText(bs []byte) error {
+	switch string(bs) {
+	case "default":
+		*p = ConflictDefault
+	case "preferDevice":
+		*p = ConflictPreferDevice
+	case "noCopies":
+		*p = ConflictNoCopies
+	default:
+		*p = ConflictDefault
+	}
+	return nil
+}
+
+type CaseSensitivity int
+
+const (
+	CaseAuto        CaseSensitivity = iota // probed by creating a file in the folder
+	CaseSensitive                          // names differing in case are different files
+	CaseInsensitive                        // names differing in case are the same file
+)
+
+func (c CaseSensitivity) String() string {
+	switch c {
+	case CaseAuto:
+		return "auto"
+	case CaseSensitive:
+		return "sensitive"
+	case CaseInsensitive:
+		return "insensitive"
+	default:
+		return "unknown"
+	}
+}
+
+func (c CaseSensitivity) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *CaseSensitivity) UnmarshalText(bs []byte) error {
+	switch string(bs) {
+	case "sensitive":
+		*c = CaseSensitive
+	case "insensitive":
+		*c = CaseInsensitive
+	default:
+		*c = CaseAuto
+	}
+	return nil
+}
@@ -634,3 +634,79 @@ func TestLargeRescanInterval(t *testing.T) {
 		t.Error("negative rescan interval should become zero")
 	}
 }
+
+func TestConflictPolicy(t *testing.T) {
+	wrapper, err := Load("testdata/conflictpolicy.xml", device1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	folders := wrapper.Folders()
+
+	expected := []struct {
+		name      string
+		policy    ConflictPolicy
+		maxCopies int
+	}{
+		{"f1", ConflictDefault, 0},      // empty value, default
+		{"f2", ConflictPreferDevice, 3}, // explicit
+		{"f3", ConflictDefault, 0},      // invalid device, default
+		{"f4", ConflictNoCopies, 0},     // explicit, negative max copies
+	}
+
+	for _, tc := range expected {
+		f := folders[tc.name]
+		if f.ConflictPolicy != tc.policy || f.MaxConflictCopies != tc.maxCopies {
+			t.Errorf("Incorrect conflict policy for %q: %v, %d != %v, %d", tc.name, f.ConflictPolicy, f.MaxConflictCopies, tc.policy, tc.maxCopies)
+		}
+	}
+}
+
+func TestUntrustedDevices(t *testing.T) {
+	wrapper, err := Load("testdata/untrusted.xml", device1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := wrapper.Folders()["f1"]
+
+	if f.EncryptionPassword != "secret" {
+		t.Errorf("Incorrect encryption password %q", f.EncryptionPassword)
+	}
+	for _, dev := range f.Devices {
+		switch dev.DeviceID {
+		case device1:
+			// We can't be untrusted by ourselves.
+			if dev.Untrusted {
+				t.Error("Own device should not be untrusted")
+			}
+		case device4:
+			if !dev.Untrusted {
+				t.Error("Device 4 should be untrusted")
+			}
+		}
+	}
+}
+
+func TestDeletesExceeded(t *testing.T) {
+	cases := []struct {
+		maxDeletes    int
+		maxDeletesPct int
+		deletes       int
+		files         int
+		exceeded      bool
+	}{
+		{0, 0, 1000, 1000, false}, // no limit
+		{10, 0, 10, 1000, false},
+		{10, 0, 11, 1000, true},
+		{0, 50, 50, 100, false},
+		{0, 50, 51, 100, true},
+		{0, 50, 1, 0, false},
+		{100, 50, 60, 100, true}, // whichever is lower
+	}
+
+	for _, tc := range cases {
+		f := FolderConfiguration{MaxDeletes: tc.maxDeletes, MaxDeletesPct: tc.maxDeletesPct}
+		if res := f.DeletesExceeded(tc.deletes, tc.files); res != tc.exceeded {
+			t.Errorf("DeletesExceeded(%d, %d) with max %d, %d%%: %v != %v", tc.deletes, tc.files, tc.maxDeletes, tc.maxDeletesPct, res, tc.exceeded)
+		}
+	}
+}
@@ -41,15 +41,15 @@ func NewBlockMap(db *leveldb.DB, folder string) *BlockMap {
 // Add files to the block map, ignoring any deleted or invalid files.
 func (m *BlockMap) Add(files []protocol.FileInfo) error {
 	batch := new(leveldb.Batch)
-	buf := make([]byte, 4)
+	buf := make([]byte, 8)
 	for _, file := range files {
 		if file.IsDirectory() || file.IsDeleted() || file.IsInvalid() {
 			continue
 		}
 
+		blockSize := file.BlockSize()
 		for i, block := range file.Blocks {
-			binary.BigEndian.PutUint32(buf, uint32(i))
-			batch.Put(m.blockKey(block.Hash, file.Name), buf)
+			batch.Put(m.blockKey(block.Hash, file.Name), toBlockValue(buf, int32(i), blockSize))
 		}
 	}
 	return m.db.Write(batch, nil)
@@ -58,7 +58,7 @@ func (m *BlockMap) Add(files []protocol.FileInfo) error {
 // Update block map state, removing any deleted or invalid files.
 func (m *BlockMap) Update(files []protocol.FileInfo) error {
 	batch := new(leveldb.Batch)
-	buf := make([]byte, 4)
+	buf := make([]byte, 8)
 	for _, file := range files {
 		if file.IsDirectory() {
 			continue
@@ -71,9 +71,9 @@ func (m *BlockMap) Update(files []protocol.FileInfo) error {
 			continue
 		}
 
+		blockSize := file.BlockSize()
 		for i, block := range file.Blocks {
-			binary.BigEndian.PutUint32(buf, uint32(i))
-			batch.Put(m.blockKey(block.Hash, file.Name), buf)
+			batch.Put(m.blockKey(block.Hash, file.Name), toBlockValue(buf, int32(i), blockSize))
 		}
 	}
 	return m.db.Write(batch, nil)
@@ -129,11 +129,12 @@ func (f *BlockFinder) String() string {
 }
 
 // Iterate takes an iterator function which iterates over all matching blocks
-// for the given hash. The iterator function has to return either true (if
-// they are happy with the block) or false to continue iterating for whatever
-// reason. The iterator finally returns the result, whether or not a
+// for the given hash. The iterator function is given the index of the block
+// within the file and the block size of the file, and has to return either
+// true (if they are happy with the block) or false to continue iterating for
+// whatever reason. The iterator finally returns the result, whether or not a
 // satisfying block was eventually found.
-func (f *BlockFinder) Iterate(folders []string, hash []byte, iterFn func(string, string, int32) bool) bool {
+func (f *BlockFinder) Iterate(folders []string, hash []byte, iterFn func(string, string, int32, int) bool) bool {
 	for _, folder := range folders {
 		key := toBlockKey(hash, folder, "")
 		iter := f.db.NewIterator(util.BytesPrefix(key), nil)
@@ -141,8 +142,8 @@ func (f *BlockFinder) Iterate(folders []string, hash []byte, iterFn func(string,
 
 		for iter.Next() && iter.Error() == nil {
 			folder, file := fromBlockKey(iter.Key())
-			index := int32(binary.BigEndian.Uint32(iter.Value()))
-			if iterFn(folder, osutil.NativeFilename(file), index) {
+			index, blockSize := fromBlockValue(iter.Value())
+			if iterFn(folder, osutil.NativeFilename(file), index, blockSize) {
 				return true
 			}
 		}
@@ -152,13 +153,12 @@ func (f *BlockFinder) Iterate(folders []string, hash []byte, iterFn func(string,
 
 // Fix repairs incorrect blockmap entries, removing the old entry and
 // replacing it with a new entry for the given block
-func (f *BlockFinder) Fix(folder, file string, index int32, oldHash, newHash []byte) error {
-	buf := make([]byte, 4)
-	binary.BigEndian.PutUint32(buf, uint32(index))
+func (f *BlockFinder) Fix(folder, file string, index int32, blockSize int, oldHash, newHash []byte) error {
+	buf := make([]byte, 8)
 
 	batch := new(leveldb.Batch)
 	batch.Delete(toBlockKey(oldHash, folder, file))
-	batch.Put(toBlockKey(newHash, folder, file), buf)
+	batch.Put(toBlockKey(newHash, folder, file), toBlockValue(buf, index, blockSize))
 	return f.db.Write(batch, nil)
 }
 
@@ -176,6 +176,27 @@ func toBlockKey(hash []byte, folder, file string) []byte {
 	return o
 }
 
+// toBlockValue returns a byte slice, using the space in buf, encoding the
+// following information:
+//	   block index (4 bytes)
+//	   block size of the file (4 bytes, only when not the standard size)
+func toBlockValue(buf []byte, index int32, blockSize int) []byte {
+	binary.BigEndian.PutUint32(buf, uint32(index))
+	if blockSize == protocol.BlockSize {
+		return buf[:4]
+	}
+	binary.BigEndian.PutUint32(buf[4:], uint32(blockSize))
+	return buf[:8]
+}
+
+func fromBlockValue(data []byte) (int32, int) {
+	index := int32(binary.BigEndian.Uint32(data))
+	if len(data) < 8 {
+		return index, protocol.BlockSize
+	}
+	return index, int(binary.BigEndian.Uint32(data[4:]))
+}
+
 func fromBlockKey(data []byte) (string, string) {
 	if len(data) < 1+64+32+1 {
 		panic("Incorrect key length")
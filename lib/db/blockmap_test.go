@@ -85,21 +85,21 @@ func TestBlockMapAddUpdateWipe(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	f.Iterate(folders, f1.Blocks[0].Hash, func(folder, file string, index int32) bool {
+	f.Iterate(folders, f1.Blocks[0].Hash, func(folder, file string, index int32, _ int) bool {
 		if folder != "folder1" || file != "f1" || index != 0 {
 			t.Fatal("Mismatch")
 		}
 		return true
 	})
 
-	f.Iterate(folders, f2.Blocks[0].Hash, func(folder, file string, index int32) bool {
+	f.Iterate(folders, f2.Blocks[0].Hash, func(folder, file string, index int32, _ int) bool {
 		if folder != "folder1" || file != "f2" || index != 0 {
 			t.Fatal("Mismatch")
 		}
 		return true
 	})
 
-	f.Iterate(folders, f3.Blocks[0].Hash, func(folder, file string, index int32) bool {
+	f.Iterate(folders, f3.Blocks[0].Hash, func(folder, file string, index int32, _ int) bool {
 		t.Fatal("Unexpected block")
 		return true
 	})
@@ -114,17 +114,17 @@ func TestBlockMapAddUpdateWipe(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	f.Iterate(folders, f1.Blocks[0].Hash, func(folder, file string, index int32) bool {
+	f.Iterate(folders, f1.Blocks[0].Hash, func(folder, file string, index int32, _ int) bool {
 		t.Fatal("Unexpected block")
 		return false
 	})
 
-	f.Iterate(folders, f2.Blocks[0].Hash, func(folder, file string, index int32) bool {
+	f.Iterate(folders, f2.Blocks[0].Hash, func(folder, file string, index int32, _ int) bool {
 		t.Fatal("Unexpected block")
 		return false
 	})
 
-	f.Iterate(folders, f3.Blocks[0].Hash, func(folder, file string, index int32) bool {
+	f.Iterate(folders, f3.Blocks[0].Hash, func(folder, file string, index int32, _ int) bool {
 		if folder != "folder1" || file != "f3" || index != 0 {
 			t.Fatal("Mismatch")
 		}
@@ -171,7 +171,7 @@ func TestBlockFinderLookup(t *testing.T) {
 	}
 
 	counter := 0
-	f.Iterate(folders, f1.Blocks[0].Hash, func(folder, file string, index int32) bool {
+	f.Iterate(folders, f1.Blocks[0].Hash, func(folder, file string, index int32, _ int) bool {
 		counter++
 		switch counter {
 		case 1:
@@ -200,7 +200,7 @@ func TestBlockFinderLookup(t *testing.T) {
 	}
 
 	counter = 0
-	f.Iterate(folders, f1.Blocks[0].Hash, func(folder, file string, index int32) bool {
+	f.Iterate(folders, f1.Blocks[0].Hash, func(folder, file string, index int32, _ int) bool {
 		counter++
 		switch counter {
 		case 1:
@@ -223,7 +223,7 @@ func TestBlockFinderLookup(t *testing.T) {
 func TestBlockFinderFix(t *testing.T) {
 	db, f := setup()
 
-	iterFn := func(folder, file string, index int32) bool {
+	iterFn := func(folder, file string, index int32, _ int) bool {
 		return true
 	}
 
@@ -237,7 +237,7 @@ func TestBlockFinderFix(t *testing.T) {
 		t.Fatal("Block not found")
 	}
 
-	err = f.Fix("folder1", f1.Name, 0, f1.Blocks[0].Hash, f2.Blocks[0].Hash)
+	err = f.Fix("folder1", f1.Name, 0, protocol.BlockSize, f1.Blocks[0].Hash, f2.Blocks[0].Hash)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -250,3 +250,40 @@ func TestBlockFinderFix(t *testing.T) {
 		t.Fatal("Block not found")
 	}
 }
+
+func TestBlockFinderBlockSize(t *testing.T) {
+	db, f := setup()
+
+	large := protocol.FileInfo{
+		Name: "large",
+		Blocks: []protocol.BlockInfo{
+			{Size: 4 * protocol.BlockSize, Hash: f1.Blocks[0].Hash},
+			{Size: 42, Hash: f1.Blocks[1].Hash},
+		},
+	}
+
+	m := NewBlockMap(db, "folder1")
+	err := m.Add([]protocol.FileInfo{f2, large})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		hash      []byte
+		index     int32
+		blockSize int
+	}{
+		{f1.Blocks[1].Hash, 1, 4 * protocol.BlockSize},
+		{f2.Blocks[3].Hash, 3, protocol.BlockSize},
+	} {
+		found := f.Iterate(folders, tc.hash, func(folder, file string, index int32, blockSize int) bool {
+			if index != tc.index || blockSize != tc.blockSize {
+				t.Errorf("Got index %d, block size %d for %s; expected %d, %d", index, blockSize, file, tc.index, tc.blockSize)
+			}
+			return true
+		})
+		if !found {
+			t.Error("Block not found")
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// A Conflict describes a file that was changed concurrently on two devices,
+// where the losing version was moved aside to a conflict copy.
+type Conflict struct {
+	Name         string            `json:"name"`         // The file in conflict, holding the winning version
+	ConflictName string            `json:"conflictName"` // The conflict copy, holding the losing version
+	Winner       protocol.DeviceID `json:"winner"`       // The device that made the winning change
+	Loser        protocol.DeviceID `json:"loser"`        // The device that made the losing change
+	Time         time.Time         `json:"time"`
+}
+
+// ConflictRepo keeps track of the unresolved conflicts in a folder, keyed by
+// the name of the conflict copy.
+type ConflictRepo struct {
+	ns *NamespacedKV
+}
+
+func NewConflictRepo(ldb *leveldb.DB, folder string) *ConflictRepo {
+	prefix := string(rune(KeyTypeConflict)) + folder + "\x00"
+
+	return &ConflictRepo{
+		ns: NewNamespacedKV(ldb, prefix),
+	}
+}
+
+func (r *ConflictRepo) Add(c Conflict) {
+	if debug {
+		l.Debugf("conflict: storing %+v", c)
+	}
+	// Marshal a pointer, as protocol.DeviceID is a text marshaler only by
+	// reference.
+	bs, err := json.Marshal(&c)
+	if err != nil {
+		panic(err)
+	}
+	r.ns.PutBytes(c.ConflictName, bs)
+}
+
+func (r *ConflictRepo) Get(conflictName string) (Conflict, bool) {
+	bs, ok := r.ns.Bytes(conflictName)
+	if !ok {
+		return Conflict{}, false
+	}
+	var c Conflict
+	if err := json.Unmarshal(bs, &c); err != nil {
+		l.Infof("Corrupt conflict record for %q: %v", conflictName, err)
+		return Conflict{}, false
+	}
+	return c, true
+}
+
+// List returns all recorded conflicts, sorted by conflict copy name.
+func (r *ConflictRepo) List() []Conflict {
+	keys := r.ns.Keys()
+	conflicts := make([]Conflict, 0, len(keys))
+	for _, key := range keys {
+		if c, ok := r.Get(key); ok {
+			conflicts = append(conflicts, c)
+		}
+	}
+	return conflicts
+}
+
+func (r *ConflictRepo) Remove(conflictName string) {
+	r.ns.Delete(conflictName)
+}
+
+func (r *ConflictRepo) Drop() {
+	r.ns.Reset()
+}
@@ -0,0 +1,59 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// EncryptedFileRepo keeps the encrypted form of the files in a folder that
+// is shared with untrusted devices, keyed by the plain name, as it's
+// expensive to produce.
+type EncryptedFileRepo struct {
+	ns *NamespacedKV
+}
+
+func NewEncryptedFileRepo(ldb *leveldb.DB, folder string) *EncryptedFileRepo {
+	prefix := string(rune(KeyTypeEncryptedFile)) + folder + "\x00"
+
+	return &EncryptedFileRepo{
+		ns: NewNamespacedKV(ldb, prefix),
+	}
+}
+
+// Get returns the encrypted form of the given version of the named file, if
+// it's known.
+func (r *EncryptedFileRepo) Get(name string, version protocol.Vector) (protocol.FileInfo, bool) {
+	bs, ok := r.ns.Bytes(name)
+	if !ok {
+		return protocol.FileInfo{}, false
+	}
+	var f protocol.FileInfo
+	if err := f.UnmarshalXDR(bs); err != nil {
+		l.Infof("Corrupt encrypted file record for %q: %v", name, err)
+		return protocol.FileInfo{}, false
+	}
+	if !f.Version.Equal(version) {
+		return protocol.FileInfo{}, false
+	}
+	return f, true
+}
+
+// Put stores the encrypted form of the named file, replacing any other
+// version of it.
+func (r *EncryptedFileRepo) Put(name string, f protocol.FileInfo) {
+	r.ns.PutBytes(name, f.MustMarshalXDR())
+}
+
+func (r *EncryptedFileRepo) Remove(name string) {
+	r.ns.Delete(name)
+}
+
+func (r *EncryptedFileRepo) Drop() {
+	r.ns.Reset()
+}
@@ -51,6 +51,17 @@ func (n *NamespacedKV) Reset() {
 	}
 }
 
+// Keys returns the keys of all entries in this namespace, in order.
+func (n NamespacedKV) Keys() []string {
+	it := n.db.NewIterator(util.BytesPrefix(n.prefix), nil)
+	defer it.Release()
+	var keys []string
+	for it.Next() {
+		keys = append(keys, string(it.Key()[len(n.prefix):]))
+	}
+	return keys
+}
+
 // PutInt64 stores a new int64. Any existing value (even if of another type)
 // is overwritten.
 func (n *NamespacedKV) PutInt64(key string, val int64) {
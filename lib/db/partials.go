@@ -0,0 +1,113 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"encoding/json"
+
+	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// A partialFile records which blocks of a version of a file are complete in
+// its temporary file, as a bitmap of block indexes.
+type partialFile struct {
+	Version protocol.Vector `json:"version"`
+	Blocks  []byte          `json:"blocks"`
+}
+
+// PartialFileRepo keeps track of the progress of files being pulled, so that
+// an interrupted pull can resume without verifying the temporary file again.
+// The caller is responsible for only recording blocks that have been synced
+// to disk.
+type PartialFileRepo struct {
+	ns *NamespacedKV
+}
+
+func NewPartialFileRepo(ldb *leveldb.DB, folder string) *PartialFileRepo {
+	prefix := string(rune(KeyTypePartialFile)) + folder + "\x00"
+
+	return &PartialFileRepo{
+		ns: NewNamespacedKV(ldb, prefix),
+	}
+}
+
+func (r *PartialFileRepo) get(name string) (partialFile, bool) {
+	bs, ok := r.ns.Bytes(name)
+	if !ok {
+		return partialFile{}, false
+	}
+	var pf partialFile
+	if err := json.Unmarshal(bs, &pf); err != nil {
+		l.Infof("Corrupt partial file record for %q: %v", name, err)
+		return partialFile{}, false
+	}
+	return pf, true
+}
+
+// Blocks returns the indexes, in increasing order, of the blocks of the given
+// version of the file that are known to be complete. Progress recorded for
+// any other version is forgotten.
+func (r *PartialFileRepo) Blocks(name string, version protocol.Vector) []int32 {
+	pf, ok := r.get(name)
+	if !ok {
+		return nil
+	}
+	if !pf.Version.Equal(version) {
+		if debug {
+			l.Debugf("partial: dropping stale record for %s", name)
+		}
+		r.ns.Delete(name)
+		return nil
+	}
+
+	var indexes []int32
+	for i, b := range pf.Blocks {
+		for bit := uint(0); bit < 8; bit++ {
+			if b&(1<<bit) != 0 {
+				indexes = append(indexes, int32(i*8)+int32(bit))
+			}
+		}
+	}
+	return indexes
+}
+
+// Add records the given blocks of the version of the file as complete, in
+// addition to those recorded before for the same version.
+func (r *PartialFileRepo) Add(name string, version protocol.Vector, indexes []int32) {
+	if len(indexes) == 0 {
+		return
+	}
+
+	pf, ok := r.get(name)
+	if !ok || !pf.Version.Equal(version) {
+		pf = partialFile{Version: version}
+	}
+	for _, idx := range indexes {
+		for int(idx/8) >= len(pf.Blocks) {
+			pf.Blocks = append(pf.Blocks, 0)
+		}
+		pf.Blocks[idx/8] |= 1 << uint(idx%8)
+	}
+
+	if debug {
+		l.Debugf("partial: %d more blocks of %s", len(indexes), name)
+	}
+	bs, err := json.Marshal(pf)
+	if err != nil {
+		panic(err)
+	}
+	r.ns.PutBytes(name, bs)
+}
+
+func (r *PartialFileRepo) Remove(name string) {
+	r.ns.Delete(name)
+}
+
+func (r *PartialFileRepo) Drop() {
+	r.ns.Reset()
+}
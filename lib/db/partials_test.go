@@ -0,0 +1,63 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestPartialFileRepo(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo1 := NewPartialFileRepo(ldb, "folder1")
+	repo2 := NewPartialFileRepo(ldb, "folder")
+
+	v1 := protocol.Vector{{ID: 1, Value: 1}}
+	v2 := protocol.Vector{{ID: 1, Value: 2}}
+
+	if blocks := repo1.Blocks("file", v1); blocks != nil {
+		t.Errorf("unexpected blocks %v in empty repo", blocks)
+	}
+
+	repo1.Add("file", v1, []int32{3, 0, 17})
+	repo1.Add("file", v1, []int32{8, 3})
+	expected := []int32{0, 3, 8, 17}
+	if blocks := repo1.Blocks("file", v1); !reflect.DeepEqual(blocks, expected) {
+		t.Errorf("blocks %v != expected %v", blocks, expected)
+	}
+	if blocks := repo2.Blocks("file", v1); blocks != nil {
+		t.Errorf("unexpected blocks %v in other folder", blocks)
+	}
+
+	// Progress on a new version starts over.
+	repo1.Add("file", v2, []int32{1})
+	if blocks := repo1.Blocks("file", v2); !reflect.DeepEqual(blocks, []int32{1}) {
+		t.Errorf("unexpected blocks %v for new version", blocks)
+	}
+
+	// Asking for another version forgets the record.
+	if blocks := repo1.Blocks("file", v1); blocks != nil {
+		t.Errorf("unexpected blocks %v for old version", blocks)
+	}
+	if blocks := repo1.Blocks("file", v2); blocks != nil {
+		t.Errorf("unexpected blocks %v after stale lookup", blocks)
+	}
+
+	repo1.Add("file", v1, []int32{1})
+	repo1.Remove("file")
+	if blocks := repo1.Blocks("file", v1); blocks != nil {
+		t.Errorf("unexpected blocks %v after remove", blocks)
+	}
+}
@@ -25,8 +25,13 @@ type FileSet struct {
 	folder       string
 	db           *leveldb.DB
 	blockmap     *BlockMap
+	winsConflict ConflictResolver
 }
 
+// A ConflictResolver returns true if the file a should be chosen over the
+// file b, when they have been changed concurrently.
+type ConflictResolver func(a, b protocol.FileInfo) bool
+
 // FileIntf is the set of methods implemented by both protocol.FileInfo and
 // protocol.FileInfoTruncated.
 type FileIntf interface {
@@ -50,6 +55,7 @@ func NewFileSet(folder string, db *leveldb.DB) *FileSet {
 		db:           db,
 		blockmap:     NewBlockMap(db, folder),
 		mutex:        sync.NewMutex(),
+		winsConflict: protocol.FileInfo.WinsConflict,
 	}
 
 	ldbCheckGlobals(db, []byte(folder))
@@ -77,7 +83,7 @@ func (s *FileSet) Replace(device protocol.DeviceID, fs []protocol.FileInfo) {
 	normalizeFilenames(fs)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.localVersion[device] = ldbReplace(s.db, []byte(s.folder), device[:], fs)
+	s.localVersion[device] = ldbReplace(s.db, []byte(s.folder), device[:], fs, s.winsConflict)
 	if len(fs) == 0 {
 		// Reset the local version if all files were removed.
 		s.localVersion[device] = 0
@@ -108,11 +114,21 @@ func (s *FileSet) Update(device protocol.DeviceID, fs []protocol.FileInfo) {
 		s.blockmap.Discard(discards)
 		s.blockmap.Update(updates)
 	}
-	if lv := ldbUpdate(s.db, []byte(s.folder), device[:], fs); lv > s.localVersion[device] {
+	if lv := ldbUpdate(s.db, []byte(s.folder), device[:], fs, s.winsConflict); lv > s.localVersion[device] {
 		s.localVersion[device] = lv
 	}
 }
 
+// SetConflictResolver sets the function used to pick the global version of
+// files that have been changed concurrently, instead of
+// protocol.FileInfo.WinsConflict. It affects the files updated after the
+// call.
+func (s *FileSet) SetConflictResolver(fn ConflictResolver) {
+	s.mutex.Lock()
+	s.winsConflict = fn
+	s.mutex.Unlock()
+}
+
 func (s *FileSet) WithNeed(device protocol.DeviceID, fn Iterator) {
 	if debug {
 		l.Debugf("%s WithNeed(%v)", s.folder, device)
@@ -213,6 +229,9 @@ func DropFolder(db *leveldb.DB, folder string) {
 	}
 	bm.Drop()
 	NewVirtualMtimeRepo(db, folder).Drop()
+	NewConflictRepo(db, folder).Drop()
+	NewPartialFileRepo(db, folder).Drop()
+	NewEncryptedFileRepo(db, folder).Drop()
 }
 
 func normalizeFilenames(fs []protocol.FileInfo) {
@@ -24,9 +24,9 @@ func (f FileInfoTruncated) Size() int64 {
 	return f.ActualSize
 }
 
-func BlocksToSize(num int) int64 {
+func BlocksToSize(num, blockSize int) int64 {
 	if num < 2 {
-		return protocol.BlockSize / 2
+		return int64(blockSize / 2)
 	}
-	return int64(num-1)*protocol.BlockSize + protocol.BlockSize/2
+	return int64(num-1)*int64(blockSize) + int64(blockSize/2)
 }
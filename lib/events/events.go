@@ -41,6 +41,11 @@ const (
 	FolderScanProgress
 	ExternalPortMappingChanged
 	RelayStateChanged
+	FolderPaused
+	FolderResumed
+	ConflictCreated
+	ConflictResolved
+	DeletionsHeld
 
 	AllEvents = (1 << iota) - 1
 )
@@ -93,6 +98,16 @@ func (t EventType) String() string {
 		return "ExternalPortMappingChanged"
 	case RelayStateChanged:
 		return "RelayStateChanged"
+	case FolderPaused:
+		return "FolderPaused"
+	case FolderResumed:
+		return "FolderResumed"
+	case ConflictCreated:
+		return "ConflictCreated"
+	case ConflictResolved:
+		return "ConflictResolved"
+	case DeletionsHeld:
+		return "DeletionsHeld"
 	default:
 		return "Unknown"
 	}
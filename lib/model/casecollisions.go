@@ -0,0 +1,219 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/db"
+	"github.com/syncthing/syncthing/lib/osutil"
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+var errCaseConflict = errors.New("case conflict: another file has the same name differing only in case, which the file system can't tell apart")
+
+// The results of probing the case sensitivity of a folder.
+const (
+	caseUnprobed int32 = iota
+	caseProbedSensitive
+	caseProbedInsensitive
+)
+
+// caseInsensitive returns true if names differing only in case refer to the
+// same file in the folder. Unless configured, this is found out by probing
+// the folder the first time we need to know.
+func (p *rwFolder) caseInsensitive() bool {
+	switch p.caseSensitivity {
+	case config.CaseSensitive:
+		return false
+	case config.CaseInsensitive:
+		return true
+	}
+
+	if insensitive, ok := p.probedCase(); ok {
+		return insensitive
+	}
+	insensitive, err := osutil.IsCaseInsensitive(p.dir)
+	if err != nil {
+		// We'll fail to create files in the folder for the same reason,
+		// so a guess will do until we can probe it.
+		if debug {
+			l.Debugln(p, "probing case sensitivity:", err)
+		}
+		return usuallyCaseInsensitive()
+	}
+	if debug {
+		l.Debugln(p, "case insensitive:", insensitive)
+	}
+	probe := caseProbedSensitive
+	if insensitive {
+		probe = caseProbedInsensitive
+	}
+	atomic.StoreInt32(&p.caseProbe, probe)
+	return insensitive
+}
+
+// probedCase returns whether the folder was found to be case insensitive,
+// and whether it has been probed at all.
+func (p *rwFolder) probedCase() (bool, bool) {
+	probe := atomic.LoadInt32(&p.caseProbe)
+	return probe == caseProbedInsensitive, probe != caseUnprobed
+}
+
+// usuallyCaseInsensitive returns true if file systems are case insensitive
+// by default on this OS.
+func usuallyCaseInsensitive() bool {
+	return runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+}
+
+// folderCaseInsensitive returns whether the folder is case insensitive, as
+// far as is known without probing it: as configured, as found out by its
+// puller, or else as usual.
+func folderCaseInsensitive(cfg config.FolderConfiguration, runner service) bool {
+	switch cfg.CaseSensitivity {
+	case config.CaseSensitive:
+		return false
+	case config.CaseInsensitive:
+		return true
+	}
+	if p, ok := runner.(*rwFolder); ok {
+		if insensitive, ok := p.probedCase(); ok {
+			return insensitive
+		}
+	}
+	return usuallyCaseInsensitive()
+}
+
+// foldCase returns the name as it's compared on case insensitive file
+// systems.
+func foldCase(name string) string {
+	return strings.ToLower(name)
+}
+
+// caseCollisions keeps track of the names in the global index that differ
+// only in case, to decide which of them may be pulled into a case
+// insensitive folder without one replacing the other.
+type caseCollisions struct {
+	names   map[string][]string // folded name -> existing global names
+	claimed map[string]string   // folded name -> the name we keep
+	refused map[string]bool     // folded names of directories not pulled
+}
+
+// caseCollisions returns the case collisions of the global index for a
+// puller iteration. Going through the global index is only needed when it
+// changed since the last iteration.
+func (p *rwFolder) caseCollisions(files *db.FileSet) *caseCollisions {
+	ver := [2]int64{files.LocalVersion(protocol.LocalDeviceID)}
+	ver[1], _ = p.model.RemoteLocalVersion(p.folder)
+	if p.caseNames == nil || ver != p.caseNamesVer {
+		p.caseNames = globalCaseNames(files)
+		p.caseNamesVer = ver
+	}
+	return newCaseCollisions(p.caseNames)
+}
+
+func newCaseCollisions(names map[string][]string) *caseCollisions {
+	return &caseCollisions{
+		names:   names,
+		claimed: make(map[string]string),
+		refused: make(map[string]bool),
+	}
+}
+
+// globalCaseNames returns the existing names in the global index by their
+// folded names.
+func globalCaseNames(files *db.FileSet) map[string][]string {
+	names := make(map[string][]string)
+	files.WithGlobalTruncated(func(fi db.FileIntf) bool {
+		f := fi.(db.FileInfoTruncated)
+		if !f.IsDeleted() {
+			folded := foldCase(f.Name)
+			names[folded] = append(names[folded], f.Name)
+		}
+		return true
+	})
+	return names
+}
+
+// onDiskAs returns true if the file is on disk by exactly the given name,
+// and not just by a name differing only in case.
+func (p *rwFolder) onDiskAs(name string) bool {
+	diskName := p.diskName(name)
+	fd, err := os.Open(filepath.Join(p.dir, filepath.Dir(diskName)))
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+	names, err := fd.Readdirnames(-1)
+	if err != nil {
+		return false
+	}
+	base := filepath.Base(diskName)
+	for _, n := range names {
+		if n == base {
+			return true
+		}
+	}
+	return false
+}
+
+// hasTwin returns true if there is another existing file with the same
+// name but for case. Deleting the file on disk would delete that one too.
+func (c *caseCollisions) hasTwin(name string) bool {
+	for _, other := range c.names[foldCase(name)] {
+		if other != name {
+			return true
+		}
+	}
+	return false
+}
+
+// allow returns true if the file may be pulled. That is not the case if it
+// would replace a file differing only in case that we have or are about to
+// pull, or if one of its parent directories was not allowed.
+func (c *caseCollisions) allow(file protocol.FileInfo, current func(string) (protocol.FileInfo, bool)) bool {
+	folded := foldCase(file.Name)
+	for dir := filepath.Dir(folded); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		if c.refused[dir] {
+			return false
+		}
+	}
+
+	ok := c.allowName(file.Name, folded, current)
+	if !ok && file.IsDirectory() {
+		c.refused[folded] = true
+	}
+	return ok
+}
+
+func (c *caseCollisions) allowName(name, folded string, current func(string) (protocol.FileInfo, bool)) bool {
+	if !c.hasTwin(name) {
+		return true
+	}
+	if claimed, ok := c.claimed[folded]; ok {
+		return claimed == name
+	}
+
+	// The one we already have is kept; otherwise the first one we get to.
+	for _, other := range c.names[folded] {
+		if other == name {
+			continue
+		}
+		if cf, ok := current(other); ok && !cf.IsDeleted() {
+			c.claimed[folded] = other
+			return false
+		}
+	}
+	c.claimed[folded] = name
+	return true
+}
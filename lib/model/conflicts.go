@@ -0,0 +1,261 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/db"
+	"github.com/syncthing/syncthing/lib/events"
+	"github.com/syncthing/syncthing/lib/osutil"
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+// The ways a conflict can be resolved. "Mine" is the version this device
+// had, which was moved to the conflict copy; "theirs" is the version that
+// replaced it.
+const (
+	KeepMine   = "mine"
+	KeepTheirs = "theirs"
+	KeepBoth   = "both"
+)
+
+var errNoSuchConflict = errors.New("no such conflict")
+
+const conflictTimeFormat = "20060102-150405"
+
+// conflictName returns the name of a conflict copy of the file made at the
+// given time, of a change made by the device with the given short ID.
+func conflictName(name string, t time.Time, loser uint64) string {
+	ext := filepath.Ext(name)
+	withoutExt := name[:len(name)-len(ext)]
+	tag := ".sync-conflict-" + t.Format(conflictTimeFormat)
+	if loser != 0 {
+		tag += "-" + shortIDString(loser)
+	}
+	return withoutExt + tag + ext
+}
+
+// shortIDString returns the short ID as the first group of characters of the
+// device ID it belongs to.
+func shortIDString(id uint64) string {
+	var bs [8]byte
+	binary.BigEndian.PutUint64(bs[:], id)
+	return base32.StdEncoding.EncodeToString(bs[:])[:7]
+}
+
+// conflictCopies returns the names of the existing conflict copies of the
+// named file in the folder directory, oldest first.
+func conflictCopies(dir, name string) ([]string, error) {
+	ext := filepath.Ext(name)
+	prefix := filepath.Base(name[:len(name)-len(ext)]) + ".sync-conflict-"
+
+	fd, err := os.Open(filepath.Join(dir, filepath.Dir(name)))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fd.Readdirnames(-1)
+	fd.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var copies []string
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry, prefix) || !strings.HasSuffix(entry, ext) {
+			continue
+		}
+		tag := entry[len(prefix) : len(entry)-len(ext)]
+		if len(tag) < len(conflictTimeFormat) {
+			continue
+		}
+		if _, err := time.Parse(conflictTimeFormat, tag[:len(conflictTimeFormat)]); err != nil {
+			continue
+		}
+		copies = append(copies, filepath.Join(filepath.Dir(name), entry))
+	}
+
+	// The names differ only in the tag, starting with the time stamp.
+	sort.Strings(copies)
+	return copies, nil
+}
+
+// conflictResolver returns the function deciding which of two concurrently
+// changed files wins, according to the conflict policy of the folder.
+func conflictResolver(cfg config.FolderConfiguration) db.ConflictResolver {
+	if cfg.ConflictPolicy != config.ConflictPreferDevice {
+		return protocol.FileInfo.WinsConflict
+	}
+	preferred, err := protocol.DeviceIDFromString(cfg.ConflictPreferDevice)
+	if err != nil {
+		return protocol.FileInfo.WinsConflict
+	}
+
+	id := preferred.Short()
+	return func(a, b protocol.FileInfo) bool {
+		// The version with a change by the preferred device that the other
+		// one hasn't seen wins.
+		if ac, bc := a.Version.Counter(id), b.Version.Counter(id); ac != bc {
+			return ac > bc
+		}
+		return a.WinsConflict(b)
+	}
+}
+
+// conflictDevice returns the short ID of a device that has seen a change
+// recorded in the vector a but not in b, or zero if there is none.
+func conflictDevice(a, b protocol.Vector) uint64 {
+	for _, c := range a {
+		if c.Value > b.Counter(c.ID) {
+			return c.ID
+		}
+	}
+	return 0
+}
+
+// deviceByShortID returns the configured device with the given short ID.
+func (m *Model) deviceByShortID(id uint64) protocol.DeviceID {
+	if id == 0 {
+		return protocol.DeviceID{}
+	}
+	if m.id.Short() == id {
+		return m.id
+	}
+	for device := range m.cfg.Devices() {
+		if device.Short() == id {
+			return device
+		}
+	}
+	return protocol.DeviceID{}
+}
+
+// recordConflict remembers a conflict copy created when the local version
+// of a file lost to the version of the incoming file.
+func (m *Model) recordConflict(folder, name, conflictName string, local, remote protocol.Vector) {
+	c := db.Conflict{
+		Name:         name,
+		ConflictName: conflictName,
+		Winner:       m.deviceByShortID(conflictDevice(remote, local)),
+		Loser:        m.deviceByShortID(conflictDevice(local, remote)),
+		Time:         time.Now(),
+	}
+	db.NewConflictRepo(m.db, folder).Add(c)
+
+	events.Default.Log(events.ConflictCreated, map[string]string{
+		"folder":       folder,
+		"name":         c.Name,
+		"conflictName": c.ConflictName,
+		"winner":       c.Winner.String(),
+		"loser":        c.Loser.String(),
+	})
+}
+
+// Conflicts returns the unresolved conflicts in the folder. Conflicts whose
+// conflict copy has been removed by other means are forgotten.
+func (m *Model) Conflicts(folder string) ([]db.Conflict, error) {
+	m.fmut.RLock()
+	cfg, ok := m.folderCfgs[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, errors.New("no such folder")
+	}
+
+	repo := db.NewConflictRepo(m.db, folder)
+	conflicts := repo.List()
+	res := conflicts[:0]
+	for _, c := range conflicts {
+		if _, err := osutil.Lstat(cfg.FilePath(c.ConflictName)); os.IsNotExist(err) {
+			repo.Remove(c.ConflictName)
+			continue
+		}
+		res = append(res, c)
+	}
+	return res, nil
+}
+
+// ResolveConflict resolves the conflict that resulted in the given conflict
+// copy, by keeping either or both of the versions. A version that is not
+// kept is archived if the folder has versioning, and removed otherwise.
+func (m *Model) ResolveConflict(folder, conflictName, keep string) error {
+	m.fmut.RLock()
+	cfg, ok := m.folderCfgs[folder]
+	ver := m.folderVersioners[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return errors.New("no such folder")
+	}
+	if cfg.Paused {
+		return errFolderPaused
+	}
+
+	repo := db.NewConflictRepo(m.db, folder)
+	c, ok := repo.Get(osutil.NativeFilename(conflictName))
+	if !ok {
+		return errNoSuchConflict
+	}
+
+	realName := cfg.FilePath(c.Name)
+	conflictPath := cfg.FilePath(c.ConflictName)
+	discard := func(path string) error {
+		var err error
+		if ver != nil {
+			err = osutil.InWritableDir(ver.Archive, path)
+		} else {
+			err = osutil.InWritableDir(osutil.Remove, path)
+		}
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	switch keep {
+	case KeepMine:
+		if err := discard(realName); err != nil {
+			return err
+		}
+		if err := osutil.InWritableDir(func(path string) error {
+			return osutil.Rename(path, realName)
+		}, conflictPath); err != nil {
+			return err
+		}
+
+	case KeepTheirs:
+		if err := discard(conflictPath); err != nil {
+			return err
+		}
+
+	case KeepBoth:
+		// Both files stay as they are; the conflict copy is just a regular
+		// file from now on.
+
+	default:
+		return errors.New("invalid conflict resolution " + keep)
+	}
+
+	repo.Remove(c.ConflictName)
+	l.Infof("Resolved conflict in folder %q for %q (keep %s)", folder, c.Name, keep)
+	events.Default.Log(events.ConflictResolved, map[string]string{
+		"folder":       folder,
+		"name":         c.Name,
+		"conflictName": c.ConflictName,
+		"keep":         keep,
+	})
+
+	if keep == KeepBoth {
+		return nil
+	}
+	return m.ScanFolderSubs(folder, []string{c.Name, c.ConflictName})
+}
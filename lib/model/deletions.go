@@ -0,0 +1,302 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"errors"
+
+	"github.com/syncthing/syncthing/lib/db"
+	"github.com/syncthing/syncthing/lib/events"
+	"github.com/syncthing/syncthing/lib/osutil"
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+var errNoHeldDeletions = errors.New("no deletions are held")
+
+// heldDeletions are the deletions in a folder that exceeded the configured
+// maximum, waiting for the user to approve or reject them.
+type heldDeletions struct {
+	local    []protocol.FileInfo // found by the scanner, not yet in the index
+	remote   []protocol.FileInfo // needed from the cluster, not yet carried out
+	approved map[string]bool     // names of remote deletions the puller may carry out
+}
+
+// deletesExceeded returns true if deleting the given number of files in the
+// folder must be confirmed first.
+func (m *Model) deletesExceeded(folder string, deletes int) bool {
+	m.fmut.RLock()
+	cfg := m.folderCfgs[folder]
+	m.fmut.RUnlock()
+	if cfg.MaxDeletes <= 0 && cfg.MaxDeletesPct <= 0 {
+		return false
+	}
+	files, _, _ := m.LocalSize(folder)
+	return cfg.DeletesExceeded(deletes, files)
+}
+
+// holdLocalDeletions returns true if the deletions found by the scanner are
+// too many to add to the index unconfirmed, in which case they are held.
+func (m *Model) holdLocalDeletions(folder string, deletes []protocol.FileInfo) bool {
+	if len(deletes) == 0 || !m.deletesExceeded(folder, len(deletes)) {
+		return false
+	}
+
+	m.fmut.Lock()
+	held := m.heldDeletionsLocked(folder)
+	// A scan of a subdirectory only finds some of the deletions, so they
+	// are added to those held before.
+	seen := make(map[string]int, len(held.local))
+	for i, f := range held.local {
+		seen[f.Name] = i
+	}
+	for _, f := range deletes {
+		if i, ok := seen[f.Name]; ok {
+			held.local[i] = f
+		} else {
+			held.local = append(held.local, f)
+		}
+	}
+	nlocal, nremote := len(held.local), len(held.remote)
+	m.fmut.Unlock()
+
+	m.deletionsHeld(folder, nlocal, nremote)
+	return true
+}
+
+// allowRemoteDeletions returns true if the puller may carry out the
+// deletions needed from the cluster. If they are too many and haven't been
+// approved, they are held instead.
+func (m *Model) allowRemoteDeletions(folder string, deletes []protocol.FileInfo) bool {
+	if !m.remoteDeletesExceeded(folder, deletes) {
+		m.fmut.Lock()
+		if held, ok := m.folderDeletions[folder]; ok {
+			held.remote = nil
+			held.approved = nil
+			if len(held.local) == 0 {
+				delete(m.folderDeletions, folder)
+			}
+		}
+		m.fmut.Unlock()
+		return true
+	}
+
+	m.fmut.Lock()
+	held := m.heldDeletionsLocked(folder)
+	held.remote = deletes
+	nlocal, nremote := len(held.local), len(held.remote)
+	m.fmut.Unlock()
+
+	m.deletionsHeld(folder, nlocal, nremote)
+	return false
+}
+
+// remoteDeletesExceeded returns true if the deletions needed from the
+// cluster are too many to carry out without approval.
+func (m *Model) remoteDeletesExceeded(folder string, deletes []protocol.FileInfo) bool {
+	m.fmut.RLock()
+	held, ok := m.folderDeletions[folder]
+	unapproved := len(deletes)
+	if ok {
+		for _, f := range deletes {
+			if held.approved[f.Name] {
+				unapproved--
+			}
+		}
+	}
+	m.fmut.RUnlock()
+
+	return unapproved > 0 && m.deletesExceeded(folder, unapproved)
+}
+
+// Must be called with fmut held.
+func (m *Model) heldDeletionsLocked(folder string) *heldDeletions {
+	held, ok := m.folderDeletions[folder]
+	if !ok {
+		held = &heldDeletions{}
+		m.folderDeletions[folder] = held
+	}
+	return held
+}
+
+// deletionsHeld puts the folder in the needs confirmation state and lets
+// the user know. The counts are taken by the caller while holding fmut, as
+// the held deletions may be approved or rejected once it is released.
+func (m *Model) deletionsHeld(folder string, nlocal, nremote int) {
+	m.fmut.RLock()
+	runner, ok := m.folderRunners[folder]
+	m.fmut.RUnlock()
+
+	l.Infof("Folder %q: holding %d local and %d remote deletions until confirmed", folder, nlocal, nremote)
+	if ok {
+		runner.setHeld(true)
+	}
+	events.Default.Log(events.DeletionsHeld, map[string]interface{}{
+		"folder": folder,
+		"local":  nlocal,
+		"remote": nremote,
+	})
+}
+
+// HeldDeletions returns the names of the files whose deletion, found by the
+// scanner or needed from the cluster, waits to be approved or rejected.
+func (m *Model) HeldDeletions(folder string) (local, remote []string, err error) {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+	if _, ok := m.folderCfgs[folder]; !ok {
+		return nil, nil, errors.New("no such folder")
+	}
+
+	local, remote = []string{}, []string{}
+	if held, ok := m.folderDeletions[folder]; ok {
+		for _, f := range held.local {
+			local = append(local, f.Name)
+		}
+		for _, f := range held.remote {
+			remote = append(remote, f.Name)
+		}
+	}
+	return local, remote, nil
+}
+
+// ApproveDeletions adds the held local deletions to the index, and lets the
+// puller carry out the held remote ones.
+func (m *Model) ApproveDeletions(folder string) error {
+	held, err := m.takeHeldDeletions(folder)
+	if err != nil {
+		return err
+	}
+
+	if len(held.remote) > 0 {
+		approved := make(map[string]bool, len(held.remote))
+		for _, f := range held.remote {
+			approved[f.Name] = true
+		}
+		m.fmut.Lock()
+		m.heldDeletionsLocked(folder).approved = approved
+		m.fmut.Unlock()
+	}
+
+	m.fmut.RLock()
+	fs := m.folderFiles[folder]
+	cfg := m.folderCfgs[folder]
+	m.fmut.RUnlock()
+
+	batch := make([]protocol.FileInfo, 0, indexBatchSize)
+	for _, f := range held.local {
+		if len(batch) == indexBatchSize {
+			m.updateLocals(folder, batch)
+			batch = batch[:0]
+		}
+		if !heldLocalDeletionValid(fs, f) {
+			continue
+		}
+		if _, err := osutil.Lstat(cfg.FilePath(f.Name)); err == nil {
+			// The file is back.
+			continue
+		}
+		batch = append(batch, f)
+	}
+	if len(batch) > 0 {
+		m.updateLocals(folder, batch)
+	}
+
+	m.deletionsConfirmed(folder)
+	return nil
+}
+
+// RejectDeletions keeps the files whose deletion was held. Files deleted
+// locally are marked invalid, so that the puller fetches them again, and
+// files deleted by the cluster are given a new version, which brings them
+// back on the other devices.
+func (m *Model) RejectDeletions(folder string) error {
+	held, err := m.takeHeldDeletions(folder)
+	if err != nil {
+		return err
+	}
+
+	m.fmut.RLock()
+	fs := m.folderFiles[folder]
+	cfg := m.folderCfgs[folder]
+	m.fmut.RUnlock()
+
+	batch := make([]protocol.FileInfo, 0, indexBatchSize)
+	for _, f := range held.local {
+		if len(batch) == indexBatchSize {
+			m.updateLocals(folder, batch)
+			batch = batch[:0]
+		}
+		if !heldLocalDeletionValid(fs, f) {
+			continue
+		}
+		if _, err := osutil.Lstat(cfg.FilePath(f.Name)); err == nil {
+			// The file is back and the next scan takes care of it.
+			continue
+		}
+		cur, _ := fs.Get(protocol.LocalDeviceID, f.Name)
+		cur.Flags |= protocol.FlagInvalid
+		cur.LocalVersion = 0
+		// The puller must not take the file for one it has and only needs
+		// to update the metadata of.
+		cur.Blocks = nil
+		batch = append(batch, cur)
+	}
+	for _, f := range held.remote {
+		if len(batch) == indexBatchSize {
+			m.updateLocals(folder, batch)
+			batch = batch[:0]
+		}
+		cur, ok := fs.Get(protocol.LocalDeviceID, f.Name)
+		if !ok || cur.IsDeleted() || cur.IsInvalid() {
+			continue
+		}
+		if gf, ok := fs.GetGlobal(f.Name); ok && gf.IsDeleted() {
+			cur.Version = cur.Version.Merge(gf.Version).Update(m.shortID)
+			cur.LocalVersion = 0
+			batch = append(batch, cur)
+		}
+	}
+	if len(batch) > 0 {
+		m.updateLocals(folder, batch)
+	}
+
+	m.deletionsConfirmed(folder)
+	return nil
+}
+
+// takeHeldDeletions removes and returns the deletions held in the folder.
+func (m *Model) takeHeldDeletions(folder string) (*heldDeletions, error) {
+	m.fmut.Lock()
+	defer m.fmut.Unlock()
+	if _, ok := m.folderCfgs[folder]; !ok {
+		return nil, errors.New("no such folder")
+	}
+	held, ok := m.folderDeletions[folder]
+	if !ok || len(held.local) == 0 && len(held.remote) == 0 {
+		return nil, errNoHeldDeletions
+	}
+	delete(m.folderDeletions, folder)
+	return held, nil
+}
+
+// deletionsConfirmed returns the folder to its normal state and has the
+// puller reevaluate what it needs.
+func (m *Model) deletionsConfirmed(folder string) {
+	m.fmut.RLock()
+	runner, ok := m.folderRunners[folder]
+	m.fmut.RUnlock()
+	if ok {
+		runner.setHeld(false)
+		runner.IndexUpdated()
+	}
+}
+
+// heldLocalDeletionValid returns true if the file hasn't changed in the
+// index since its deletion was held.
+func heldLocalDeletionValid(fs *db.FileSet, f protocol.FileInfo) bool {
+	cur, ok := fs.Get(protocol.LocalDeviceID, f.Name)
+	return ok && !cur.IsDeleted() && !cur.IsInvalid() && f.Version.GreaterEqual(cur.Version)
+}
@@ -7,32 +7,64 @@
 package model
 
 import (
+	"time"
+
 	"github.com/syncthing/syncthing/lib/protocol"
 	"github.com/syncthing/syncthing/lib/sync"
 )
 
-// deviceActivity tracks the number of outstanding requests per device and can
-// answer which device is least busy. It is safe for use from multiple
+const (
+	// Assumed for devices we haven't requested anything from yet. These are
+	// on the optimistic side, so that new devices get a chance to show what
+	// they can do.
+	defaultLatency    = 50 * time.Millisecond
+	defaultThroughput = 10 << 20 // bytes per second
+
+	// Failed requests make a device look this much slower each, up to
+	// maxFailurePenalty times in a row, until it succeeds or failureMemory
+	// has passed since the last failure.
+	failurePenalty    = 4
+	maxFailurePenalty = 4
+	failureMemory     = time.Minute
+)
+
+// deviceStats is what we have learned about serving requests from a device.
+type deviceStats struct {
+	latency     time.Duration // Round trip time of a request, disregarding the data
+	throughput  float64       // Transfer rate in bytes per second, once the data flows
+	failures    int           // Number of failed requests since the last success
+	lastFailure time.Time
+}
+
+// deviceActivity tracks the number of outstanding requests per device and how
+// well each device has served requests, and can answer which device is
+// expected to serve a request soonest. It is safe for use from multiple
 // goroutines.
 type deviceActivity struct {
-	act map[protocol.DeviceID]int
-	mut sync.Mutex
+	act   map[protocol.DeviceID]int
+	stats map[protocol.DeviceID]deviceStats
+	mut   sync.Mutex
 }
 
 func newDeviceActivity() *deviceActivity {
 	return &deviceActivity{
-		act: make(map[protocol.DeviceID]int),
-		mut: sync.NewMutex(),
+		act:   make(map[protocol.DeviceID]int),
+		stats: make(map[protocol.DeviceID]deviceStats),
+		mut:   sync.NewMutex(),
 	}
 }
 
+// leastBusy returns the device among those available that is expected to
+// serve a block request soonest, considering both the requests already
+// waiting for it and how it has performed so far.
 func (m *deviceActivity) leastBusy(availability []protocol.DeviceID) protocol.DeviceID {
 	m.mut.Lock()
-	low := 2<<30 - 1
+	var low time.Duration
 	var selected protocol.DeviceID
-	for _, device := range availability {
-		if usage := m.act[device]; usage < low {
-			low = usage
+	for i, device := range availability {
+		cost := time.Duration(m.act[device]+1) * m.expectedLocked(device, protocol.BlockSize)
+		if i == 0 || cost < low {
+			low = cost
 			selected = device
 		}
 	}
@@ -40,6 +72,33 @@ func (m *deviceActivity) leastBusy(availability []protocol.DeviceID) protocol.De
 	return selected
 }
 
+// expected returns the time a request for size bytes from the device is
+// expected to take, not counting any requests queued before it.
+func (m *deviceActivity) expected(device protocol.DeviceID, size int) time.Duration {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.expectedLocked(device, size)
+}
+
+func (m *deviceActivity) expectedLocked(device protocol.DeviceID, size int) time.Duration {
+	s, ok := m.stats[device]
+	if !ok {
+		s = deviceStats{latency: defaultLatency, throughput: defaultThroughput}
+	}
+
+	d := s.latency + time.Duration(float64(size)/s.throughput*float64(time.Second))
+	if s.failures > 0 && time.Since(s.lastFailure) < failureMemory {
+		failures := s.failures
+		if failures > maxFailurePenalty {
+			failures = maxFailurePenalty
+		}
+		for i := 0; i < failures; i++ {
+			d *= failurePenalty
+		}
+	}
+	return d
+}
+
 func (m *deviceActivity) using(device protocol.DeviceID) {
 	m.mut.Lock()
 	m.act[device]++
@@ -51,3 +110,46 @@ func (m *deviceActivity) done(device protocol.DeviceID) {
 	m.act[device]--
 	m.mut.Unlock()
 }
+
+// record updates the statistics for the device with the outcome of a
+// request for size bytes that took the given time.
+func (m *deviceActivity) record(device protocol.DeviceID, size int, d time.Duration, err error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	s, ok := m.stats[device]
+	if !ok {
+		s = deviceStats{latency: defaultLatency, throughput: defaultThroughput}
+		if err == nil {
+			// Better than any assumption.
+			s.latency = d
+		}
+	}
+
+	if err != nil {
+		s.failures++
+		s.lastFailure = time.Now()
+		m.stats[device] = s
+		return
+	}
+	s.failures = 0
+
+	// The latency is the fastest we've seen a request served, drifting up
+	// slowly so that we notice when the device moves further away.
+	if d < s.latency {
+		s.latency = d
+	} else {
+		s.latency += (d - s.latency) / 16
+	}
+
+	// The throughput is a moving average over the time spent beyond the
+	// latency, which may be too short to tell.
+	transfer := d - s.latency
+	if transfer < time.Millisecond {
+		transfer = time.Millisecond
+	}
+	rate := float64(size) / transfer.Seconds()
+	s.throughput += (rate - s.throughput) / 4
+
+	m.stats[device] = s
+}
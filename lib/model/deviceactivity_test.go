@@ -7,7 +7,9 @@
 package model
 
 import (
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/syncthing/syncthing/lib/protocol"
 )
@@ -56,3 +58,42 @@ func TestDeviceActivity(t *testing.T) {
 		t.Errorf("Least busy device should be n0 (%v) not %v", n0, lb)
 	}
 }
+
+func TestDeviceActivityScoring(t *testing.T) {
+	n0 := protocol.DeviceID([32]byte{1, 2, 3, 4})
+	n1 := protocol.DeviceID([32]byte{5, 6, 7, 8})
+	n2 := protocol.DeviceID([32]byte{9, 10, 11, 12})
+	devices := []protocol.DeviceID{n0, n1, n2}
+	na := newDeviceActivity()
+
+	// n0 is far away and slow, n1 is close and fast.
+	for i := 0; i < 10; i++ {
+		na.record(n0, protocol.BlockSize, 2*time.Second, nil)
+		na.record(n1, protocol.BlockSize, 5*time.Millisecond, nil)
+	}
+	if lb := na.leastBusy(devices); lb != n1 {
+		t.Errorf("Least busy device should be n1 (%v) not %v", n1, lb)
+	}
+
+	// Even with a few requests waiting for it, n1 beats the unknown n2.
+	na.using(n1)
+	na.using(n1)
+	if lb := na.leastBusy(devices); lb != n1 {
+		t.Errorf("Least busy device should still be n1 (%v) not %v", n1, lb)
+	}
+
+	// Failures make n1 lose out to n2, until it succeeds again.
+	na.record(n1, protocol.BlockSize, time.Second, errors.New("failed"))
+	na.record(n1, protocol.BlockSize, time.Second, errors.New("failed"))
+	if lb := na.leastBusy(devices); lb != n2 {
+		t.Errorf("Least busy device should be n2 (%v) not %v", n2, lb)
+	}
+	na.record(n1, protocol.BlockSize, 5*time.Millisecond, nil)
+	if lb := na.leastBusy(devices); lb != n1 {
+		t.Errorf("Least busy device should be n1 (%v) again, not %v", n1, lb)
+	}
+
+	if exp := na.expected(n0, protocol.BlockSize); exp < time.Second {
+		t.Errorf("Expected time %v for slow device is too optimistic", exp)
+	}
+}
@@ -0,0 +1,413 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/db"
+	"github.com/syncthing/syncthing/lib/events"
+	"github.com/syncthing/syncthing/lib/ignore"
+	"github.com/syncthing/syncthing/lib/osutil"
+	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syncthing/syncthing/lib/scanner"
+)
+
+var errDirRenameChanged = errors.New("directory contents changed since last scan")
+
+// parentIn returns the closest directory above the named file for which
+// has returns true.
+func parentIn(name string, has func(dir string) bool) (string, bool) {
+	for dir := filepath.Dir(name); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		if has(dir) {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// dirRenameFinder tells the scanner which directory in the index, no
+// longer on disk, a new directory was renamed from. It's used for one scan.
+type dirRenameFinder struct {
+	model   *Model
+	cfg     config.FolderConfiguration
+	ignores *ignore.Matcher
+	missing map[string][]string // directories not on disk -> names of their children
+	sources map[string]bool     // directories found renamed
+}
+
+func newDirRenameFinder(m *Model, cfg config.FolderConfiguration, ignores *ignore.Matcher) *dirRenameFinder {
+	return &dirRenameFinder{
+		model:   m,
+		cfg:     cfg,
+		ignores: ignores,
+		sources: make(map[string]bool),
+	}
+}
+
+// RenamedFrom returns the missing directory that has the same children in
+// the index as the new directory has on disk.
+func (r *dirRenameFinder) RenamedFrom(name string) (string, bool) {
+	if r.missing == nil {
+		r.findMissing()
+	}
+	if len(r.missing) == 0 {
+		return "", false
+	}
+
+	fd, err := os.Open(r.cfg.FilePath(name))
+	if err != nil {
+		return "", false
+	}
+	names, err := fd.Readdirnames(-1)
+	fd.Close()
+	if err != nil {
+		return "", false
+	}
+	children := names[:0]
+	for _, child := range names {
+		if r.cfg.SafeNames {
+			child = osutil.DecodeFilename(child)
+		}
+		if defTempNamer.IsTemporary(child) || r.ignores.Match(filepath.Join(name, child)) {
+			continue
+		}
+		children = append(children, child)
+	}
+	if len(children) == 0 {
+		return "", false
+	}
+	sort.Strings(children)
+
+	var from string
+	for dir, dirChildren := range r.missing {
+		if stringsEqual(dirChildren, children) && (from == "" || dir < from) {
+			from = dir
+		}
+	}
+	if from == "" {
+		return "", false
+	}
+	delete(r.missing, from)
+	r.sources[from] = true
+	return from, true
+}
+
+// findMissing goes through the directories in the index to find those no
+// longer on disk, and the children they had.
+func (r *dirRenameFinder) findMissing() {
+	r.missing = make(map[string][]string)
+	r.model.fmut.RLock()
+	fs := r.model.folderFiles[r.cfg.ID]
+	r.model.fmut.RUnlock()
+
+	isMissing := func(dir string) bool {
+		_, ok := r.missing[dir]
+		return ok
+	}
+	fs.WithHaveTruncated(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
+		f := fi.(db.FileInfoTruncated)
+		if f.IsDeleted() || f.IsInvalid() {
+			return true
+		}
+		if dir, ok := parentIn(f.Name, isMissing); ok {
+			// Files are sorted, so we've seen the parent already.
+			if dir == filepath.Dir(f.Name) {
+				r.missing[dir] = append(r.missing[dir], filepath.Base(f.Name))
+			}
+			return true
+		}
+		if f.IsDirectory() && !f.IsSymlink() {
+			if _, err := osutil.Lstat(r.cfg.FilePath(f.Name)); os.IsNotExist(err) {
+				r.missing[f.Name] = nil
+			}
+		}
+		return true
+	})
+}
+
+// renamed returns true if the file was in a directory found renamed.
+func (r *dirRenameFinder) renamed(name string) bool {
+	if r.sources[name] {
+		return true
+	}
+	_, ok := parentIn(name, func(dir string) bool { return r.sources[dir] })
+	return ok
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// dirRename is a directory renamed on another device, with the names of the
+// files in it, relative to the directory.
+type dirRename struct {
+	from, to string
+	items    []string
+
+	// Filled in by checkDirRename.
+	fromDir, toDir protocol.FileInfo   // the deleted and the new directory
+	deleted        []protocol.FileInfo // the deleted files under the old name
+	needed         []protocol.FileInfo // the files needed under the new name
+}
+
+// findDirRenames looks through what we need for new directories holding the
+// same files as directories we have that are being deleted.
+func (p *rwFolder) findDirRenames(files *db.FileSet, ignores *ignore.Matcher) []dirRename {
+	if p.versioner != nil {
+		// The files being deleted are to be archived, which is done one by
+		// one.
+		return nil
+	}
+
+	gone := make(map[string][]string)  // deleted directories we have -> items
+	added := make(map[string][]string) // new directories -> items
+	var addedOrder []string
+	invalid := make(map[string]bool)
+
+	isGone := func(dir string) bool {
+		_, ok := gone[dir]
+		return ok
+	}
+	isAdded := func(dir string) bool {
+		_, ok := added[dir]
+		return ok
+	}
+	files.WithNeedTruncated(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
+		f := fi.(db.FileInfoTruncated)
+		if dir, ok := parentIn(f.Name, isGone); ok {
+			if f.IsDeleted() {
+				gone[dir] = append(gone[dir], f.Name[len(dir)+1:])
+			} else {
+				invalid[dir] = true
+			}
+			return true
+		}
+		if dir, ok := parentIn(f.Name, isAdded); ok {
+			if !f.IsDeleted() && !ignores.Match(f.Name) {
+				added[dir] = append(added[dir], f.Name[len(dir)+1:])
+			} else {
+				invalid[dir] = true
+			}
+			return true
+		}
+
+		if !f.IsDirectory() || f.IsSymlink() || ignores.Match(f.Name) {
+			return true
+		}
+		cur, ok := p.currentFile(f.Name)
+		switch {
+		case f.IsDeleted() && ok && !cur.IsDeleted() && cur.IsDirectory() && !cur.IsSymlink():
+			gone[f.Name] = nil
+		case !f.IsDeleted() && (!ok || cur.IsDeleted()):
+			added[f.Name] = nil
+			addedOrder = append(addedOrder, f.Name)
+		}
+		return true
+	})
+
+	// Directories with the same names in them are candidates. Needed files
+	// are sorted, and so are the names.
+	candidates := make(map[string][]string)
+	for dir, items := range gone {
+		if !invalid[dir] && len(items) > 0 {
+			key := strings.Join(items, "\x00")
+			candidates[key] = append(candidates[key], dir)
+		}
+	}
+	for _, dirs := range candidates {
+		sort.Strings(dirs)
+	}
+
+	var renames []dirRename
+	for _, dir := range addedOrder {
+		items := added[dir]
+		if invalid[dir] || len(items) == 0 {
+			continue
+		}
+		key := strings.Join(items, "\x00")
+		if from := candidates[key]; len(from) > 0 {
+			renames = append(renames, dirRename{from: from[0], to: dir, items: items})
+			candidates[key] = from[1:]
+		}
+	}
+	return renames
+}
+
+// checkDirRename returns true if the directory can be moved to its new
+// name, as we have the same files in it as are needed under the new name,
+// and nothing else. Nothing is changed on disk.
+func (p *rwFolder) checkDirRename(r *dirRename, files *db.FileSet) bool {
+	fromDir, ok := files.GetGlobal(r.from)
+	if !ok || !fromDir.IsDeleted() {
+		return false
+	}
+	toDir, ok := files.GetGlobal(r.to)
+	if !ok || toDir.IsDeleted() {
+		return false
+	}
+
+	// The files we have under the old name must be the ones needed under
+	// the new one.
+	locals := make(map[string]protocol.FileInfo, len(r.items))
+	deleted := make([]protocol.FileInfo, 0, len(r.items))
+	needed := make([]protocol.FileInfo, 0, len(r.items))
+	for _, item := range r.items {
+		lf, ok := files.Get(protocol.LocalDeviceID, filepath.Join(r.from, item))
+		if !ok || lf.IsDeleted() || lf.IsInvalid() {
+			return false
+		}
+		df, ok := files.GetGlobal(lf.Name)
+		if !ok || !df.IsDeleted() {
+			return false
+		}
+		gf, ok := files.GetGlobal(filepath.Join(r.to, item))
+		if !ok || gf.IsDeleted() || gf.IsInvalid() || gf.IsDirectory() != lf.IsDirectory() || gf.IsSymlink() != lf.IsSymlink() {
+			return false
+		}
+		if !gf.IsDirectory() && !scanner.BlocksEqual(gf.Blocks, lf.Blocks) {
+			return false
+		}
+		locals[item] = lf
+		deleted = append(deleted, df)
+		needed = append(needed, gf)
+	}
+
+	// And what's on disk must be what we have in the index, as everything
+	// there is moved.
+	fromPath := p.diskPath(r.from)
+	seen := 0
+	err := filepath.Walk(fromPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == fromPath {
+			return nil
+		}
+		rel, err := filepath.Rel(fromPath, path)
+		if err != nil {
+			return err
+		}
+		if p.safeNames {
+			rel = osutil.DecodeFilename(rel)
+		}
+		lf, ok := locals[rel]
+		if !ok {
+			return errDirRenameChanged
+		}
+		if info.Mode().IsRegular() {
+			mtime := p.virtualMtimeRepo.GetMtime(lf.Name, info.ModTime())
+			if lf.IsDirectory() || lf.IsSymlink() || info.Size() != lf.Size() || mtime.Unix() != lf.Modified {
+				return errDirRenameChanged
+			}
+		} else if info.IsDir() != (lf.IsDirectory() && !lf.IsSymlink()) {
+			return errDirRenameChanged
+		}
+		seen++
+		return nil
+	})
+	if err != nil || seen != len(r.items) {
+		if debug {
+			l.Debugln(p, "not renaming", r.from, "to", r.to, err)
+		}
+		return false
+	}
+	if _, err := osutil.Lstat(p.diskPath(r.to)); !os.IsNotExist(err) {
+		return false
+	}
+
+	r.fromDir, r.toDir = fromDir, toDir
+	r.deleted, r.needed = deleted, needed
+	return true
+}
+
+// renameDir moves the directory to its new name, if checkDirRename allows,
+// and returns the number of changes this made to the index.
+func (p *rwFolder) renameDir(r dirRename, files *db.FileSet) int {
+	if !p.checkDirRename(&r, files) {
+		return 0
+	}
+
+	var err error
+	events.Default.Log(events.ItemStarted, map[string]string{
+		"folder": p.folder,
+		"item":   r.from,
+		"type":   "dir",
+		"action": "delete",
+	})
+	events.Default.Log(events.ItemStarted, map[string]string{
+		"folder": p.folder,
+		"item":   r.to,
+		"type":   "dir",
+		"action": "update",
+	})
+	defer func() {
+		events.Default.Log(events.ItemFinished, map[string]interface{}{
+			"folder": p.folder,
+			"item":   r.from,
+			"error":  events.Error(err),
+			"type":   "dir",
+			"action": "delete",
+		})
+		events.Default.Log(events.ItemFinished, map[string]interface{}{
+			"folder": p.folder,
+			"item":   r.to,
+			"error":  events.Error(err),
+			"type":   "dir",
+			"action": "update",
+		})
+	}()
+
+	if debug {
+		l.Debugln(p, "taking directory rename shortcut", r.from, "->", r.to)
+	}
+
+	if err = osutil.TryRename(p.diskPath(r.from), p.diskPath(r.to)); err != nil {
+		l.Infof("Puller (folder %q, dir %q): rename from %q: %v", p.folder, r.to, r.from, err)
+		return 0
+	}
+
+	// Everything is in place, so what remains is the metadata of the new
+	// files, and the index.
+	p.handleDir(r.toDir)
+	for _, f := range r.needed {
+		switch {
+		case f.IsDirectory() && !f.IsSymlink():
+			p.handleDir(f)
+		case f.IsSymlink():
+			p.dbUpdates <- dbUpdateJob{f, dbUpdateHandleFile}
+		default:
+			if p.shortcutFile(f) == nil {
+				p.dbUpdates <- dbUpdateJob{f, dbUpdateHandleFile}
+			}
+		}
+	}
+	for i := len(r.deleted) - 1; i >= 0; i-- {
+		f := r.deleted[i]
+		if f.IsDirectory() && !f.IsSymlink() {
+			p.dbUpdates <- dbUpdateJob{f, dbUpdateDeleteDir}
+		} else {
+			p.dbUpdates <- dbUpdateJob{f, dbUpdateDeleteFile}
+		}
+	}
+	p.dbUpdates <- dbUpdateJob{r.fromDir, dbUpdateDeleteDir}
+
+	return 2 * (len(r.items) + 1)
+}
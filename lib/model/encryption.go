@@ -0,0 +1,533 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/db"
+	"github.com/syncthing/syncthing/lib/events"
+	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syncthing/syncthing/lib/sync"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// An encrypted file, as stored by untrusted devices, starts with the
+// metadata of the plain file: its FileInfo, preceded by the length of it,
+// encrypted in chunks of metaChunkSize. The encrypted contents follow, each
+// block of the plain file encrypted by itself, or in two halves for the
+// largest block size, to keep within the maximum block size.
+const metaChunkSize = protocol.BlockSize - protocol.EncryptionOverhead
+
+var (
+	errFileChanged       = errors.New("file changed since it was scanned")
+	errMetadataMismatch  = errors.New("encrypted metadata does not match file")
+	errUnalignedEncRange = errors.New("request not aligned with encrypted blocks")
+)
+
+// folderEncryption translates between the files of a folder and the
+// encrypted form they take on the untrusted devices the folder is shared
+// with.
+type folderEncryption struct {
+	folder string
+	cfg    config.FolderConfiguration
+	key    *protocol.FolderKey
+	cache  *db.EncryptedFileRepo
+}
+
+func newFolderEncryption(ldb *leveldb.DB, cfg config.FolderConfiguration) *folderEncryption {
+	return &folderEncryption{
+		folder: cfg.ID,
+		cfg:    cfg,
+		key:    protocol.KeyFromPassword(cfg.ID, cfg.EncryptionPassword),
+		cache:  db.NewEncryptedFileRepo(ldb, cfg.ID),
+	}
+}
+
+func (e *folderEncryption) encryptName(name string) string {
+	return filepath.FromSlash(e.key.EncryptName(filepath.ToSlash(name)))
+}
+
+func (e *folderEncryption) decryptName(name string) (string, error) {
+	plain, err := e.key.DecryptName(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.FromSlash(plain), nil
+}
+
+// dataChunkSize returns the size of the plain chunks the contents of the
+// file are encrypted in.
+func dataChunkSize(f protocol.FileInfo) int {
+	bs := f.BlockSize()
+	if bs+protocol.EncryptionOverhead > protocol.MaxBlockSize {
+		return bs / 2
+	}
+	return bs
+}
+
+// metadata returns the plain metadata of the file, as stored at the start
+// of the encrypted file.
+func metadata(f protocol.FileInfo) []byte {
+	meta := protocol.FileInfo{
+		Name:     filepath.ToSlash(f.Name),
+		Flags:    f.Flags & (protocol.FlagsAll | protocol.FlagPosixMeta | protocol.FlagHardLink),
+		Modified: f.Modified,
+		Version:  f.Version,
+		Blocks:   f.Blocks,
+		Posix:    f.Posix,
+		HardLink: filepath.ToSlash(f.HardLink),
+	}
+	bs := meta.MustMarshalXDR()
+	res := make([]byte, 4+len(bs))
+	binary.BigEndian.PutUint32(res, uint32(len(bs)))
+	copy(res[4:], bs)
+	return res
+}
+
+// metadataSize returns the size of the encrypted metadata.
+func metadataSize(meta []byte) int64 {
+	chunks := (len(meta) + metaChunkSize - 1) / metaChunkSize
+	return int64(len(meta) + chunks*protocol.EncryptionOverhead)
+}
+
+// cachedFileInfo returns the file as announced to untrusted devices, if
+// that is possible without reading the file.
+func (e *folderEncryption) cachedFileInfo(f protocol.FileInfo) (protocol.FileInfo, bool) {
+	if f.IsDeleted() || f.IsDirectory() || f.IsInvalid() {
+		return e.emptyFileInfo(f), true
+	}
+	cached, ok := e.cache.Get(f.Name, f.Version)
+	if !ok {
+		return protocol.FileInfo{}, false
+	}
+	cached.LocalVersion = f.LocalVersion
+	return cached, true
+}
+
+// emptyFileInfo returns the encrypted file without any blocks.
+func (e *folderEncryption) emptyFileInfo(f protocol.FileInfo) protocol.FileInfo {
+	return protocol.FileInfo{
+		Name:         e.encryptName(f.Name),
+		Flags:        f.Flags&(protocol.FlagDeleted|protocol.FlagInvalid|protocol.FlagDirectory) | protocol.FlagNoPermBits,
+		Version:      f.Version,
+		LocalVersion: f.LocalVersion,
+	}
+}
+
+// encryptFileInfo returns the file as announced to untrusted devices. Doing
+// so requires reading and encrypting all of the file the first time.
+func (e *folderEncryption) encryptFileInfo(f protocol.FileInfo) (protocol.FileInfo, error) {
+	if enc, ok := e.cachedFileInfo(f); ok {
+		return enc, nil
+	}
+
+	enc := e.emptyFileInfo(f)
+	var offset int64
+	add := func(data []byte) {
+		hash := sha256.Sum256(data)
+		enc.Blocks = append(enc.Blocks, protocol.BlockInfo{
+			Offset: offset,
+			Size:   int32(len(data)),
+			Hash:   hash[:],
+		})
+		offset += int64(len(data))
+	}
+
+	meta := metadata(f)
+	for i := 0; i < len(meta); i += metaChunkSize {
+		end := i + metaChunkSize
+		if end > len(meta) {
+			end = len(meta)
+		}
+		add(e.key.EncryptBlock(meta[i:end]))
+	}
+
+	chunk := dataChunkSize(f)
+	for i := range f.Blocks {
+		data, err := e.readBlock(f, i)
+		if err != nil {
+			return protocol.FileInfo{}, err
+		}
+		for len(data) > 0 {
+			n := chunk
+			if n > len(data) {
+				n = len(data)
+			}
+			add(e.key.EncryptBlock(data[:n]))
+			data = data[n:]
+		}
+	}
+
+	e.cache.Put(f.Name, enc)
+	return enc, nil
+}
+
+// readBlock returns the contents of the i:th block of the file, provided
+// they are still what they were when the file was scanned.
+func (e *folderEncryption) readBlock(f protocol.FileInfo, i int) ([]byte, error) {
+	buf := make([]byte, f.Blocks[i].Size)
+	if err := readFileAt(e.cfg.FilePath(f.Name), buf, int64(i)*int64(f.BlockSize())); err != nil {
+		return nil, err
+	}
+	if hash := sha256.Sum256(buf); !bytes.Equal(hash[:], f.Blocks[i].Hash) {
+		return nil, errFileChanged
+	}
+	return buf, nil
+}
+
+// readEncrypted fills buf with the encrypted file at the given offset. The
+// range must be exactly one of the blocks of the encrypted file.
+func (e *folderEncryption) readEncrypted(f protocol.FileInfo, offset int64, buf []byte) error {
+	var data []byte
+
+	meta := metadata(f)
+	metaSize := metadataSize(meta)
+	if offset < metaSize {
+		if offset%protocol.BlockSize != 0 {
+			return errUnalignedEncRange
+		}
+		start := int(offset/protocol.BlockSize) * metaChunkSize
+		end := start + metaChunkSize
+		if end > len(meta) {
+			end = len(meta)
+		}
+		data = e.key.EncryptBlock(meta[start:end])
+	} else {
+		chunk := int64(dataChunkSize(f))
+		rel := offset - metaSize
+		if rel%(chunk+protocol.EncryptionOverhead) != 0 {
+			return errUnalignedEncRange
+		}
+		plainOffset := rel / (chunk + protocol.EncryptionOverhead) * chunk
+		bs := int64(f.BlockSize())
+		i := int(plainOffset / bs)
+		if i >= len(f.Blocks) {
+			return protocol.ErrNoSuchFile
+		}
+		block, err := e.readBlock(f, i)
+		if err != nil {
+			return err
+		}
+		start := plainOffset - int64(i)*bs
+		end := start + chunk
+		if end > int64(len(block)) {
+			end = int64(len(block))
+		}
+		data = e.key.EncryptBlock(block[start:end])
+	}
+
+	if len(data) != len(buf) {
+		return errUnalignedEncRange
+	}
+	copy(buf, data)
+	return nil
+}
+
+// request fetches the given range of the plain file from a device that
+// stores it encrypted. The range must start at a block boundary.
+func (e *folderEncryption) request(nc protocol.Connection, f protocol.FileInfo, offset int64, size int) ([]byte, error) {
+	chunk := int64(dataChunkSize(f))
+	if offset%chunk != 0 {
+		return nil, errUnalignedEncRange
+	}
+
+	metaSize := metadataSize(metadata(f))
+	encName := e.encryptName(f.Name)
+	fileSize := f.Size()
+
+	res := make([]byte, 0, size)
+	for pos := offset; pos < offset+int64(size) && pos < fileSize; pos += chunk {
+		n := chunk
+		if pos+n > fileSize {
+			n = fileSize - pos
+		}
+		encOffset := metaSize + pos/chunk*(chunk+protocol.EncryptionOverhead)
+		data, err := nc.Request(e.folder, encName, encOffset, int(n)+protocol.EncryptionOverhead, nil, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+		plain, err := e.key.DecryptBlock(data)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, plain...)
+	}
+	if len(res) > size {
+		res = res[:size]
+	}
+	return res, nil
+}
+
+// decryptFileInfo returns the plain form of a file announced by an
+// untrusted device. Unless the version is already known, the metadata is
+// fetched from the device.
+func (e *folderEncryption) decryptFileInfo(enc protocol.FileInfo, known func(name string) (protocol.FileInfo, bool), fetch func(name string, offset int64, size int) ([]byte, error)) (protocol.FileInfo, error) {
+	name, err := e.decryptName(enc.Name)
+	if err != nil {
+		return protocol.FileInfo{}, err
+	}
+
+	f := protocol.FileInfo{
+		Name:         name,
+		Flags:        enc.Flags,
+		Version:      enc.Version,
+		LocalVersion: enc.LocalVersion,
+	}
+	if enc.IsDeleted() || enc.IsDirectory() || enc.IsInvalid() || len(enc.Blocks) == 0 {
+		return f, nil
+	}
+
+	if kf, ok := known(name); ok && kf.Version.Equal(enc.Version) && !kf.IsDeleted() {
+		kf.LocalVersion = enc.LocalVersion
+		return kf, nil
+	}
+
+	// The first chunk tells the length of the metadata; keep fetching until
+	// we have it all.
+	var meta []byte
+	var offset int64
+	for _, block := range enc.Blocks {
+		data, err := fetch(enc.Name, offset, int(block.Size))
+		if err != nil {
+			return protocol.FileInfo{}, err
+		}
+		plain, err := e.key.DecryptBlock(data)
+		if err != nil {
+			return protocol.FileInfo{}, err
+		}
+		meta = append(meta, plain...)
+		offset += int64(block.Size)
+
+		if len(meta) >= 4 && len(meta) >= 4+int(binary.BigEndian.Uint32(meta)) {
+			break
+		}
+	}
+	if len(meta) < 4 || len(meta) < 4+int(binary.BigEndian.Uint32(meta)) {
+		return protocol.FileInfo{}, errMetadataMismatch
+	}
+
+	var mf protocol.FileInfo
+	if err := mf.UnmarshalXDR(meta[4 : 4+binary.BigEndian.Uint32(meta)]); err != nil {
+		return protocol.FileInfo{}, err
+	}
+	mf.Name = filepath.FromSlash(mf.Name)
+	mf.HardLink = filepath.FromSlash(mf.HardLink)
+	if mf.Name != name || !mf.Version.Equal(enc.Version) {
+		// The device is trying to pass off the metadata of another file or
+		// version as this one.
+		return protocol.FileInfo{}, errMetadataMismatch
+	}
+	mf.LocalVersion = enc.LocalVersion
+	return mf, nil
+}
+
+// untrustedEncryption returns the encryption of the folder if it's shared
+// with the device as untrusted, and nil otherwise.
+func (m *Model) untrustedEncryption(folder string, device protocol.DeviceID) *folderEncryption {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+
+	if !m.folderDeviceLocked(folder, device).Untrusted {
+		return nil
+	}
+	return m.folderCrypto[folder]
+}
+
+// requestEncrypted serves a request from an untrusted device for a block of
+// an encrypted file.
+func (m *Model) requestEncrypted(enc *folderEncryption, deviceID protocol.DeviceID, folder, name string, offset int64, buf []byte) error {
+	plainName, err := enc.decryptName(name)
+	if err != nil {
+		return protocol.ErrNoSuchFile
+	}
+
+	lf, ok := m.CurrentFolderFile(folder, plainName)
+	if !ok {
+		return protocol.ErrNoSuchFile
+	}
+	if lf.IsInvalid() || lf.IsDeleted() || lf.IsDirectory() {
+		return protocol.ErrInvalid
+	}
+
+	if debug {
+		l.Debugf("%v REQ(in; encrypted): %s: %q / %q o=%d s=%d", m, deviceID, folder, plainName, offset, len(buf))
+	}
+	return enc.readEncrypted(lf, offset, buf)
+}
+
+// An untrustedIndexJob is an index message from an untrusted device, to be
+// decrypted.
+type untrustedIndexJob struct {
+	folder  string
+	files   []protocol.FileInfo
+	replace bool
+}
+
+// An untrustedIndexQueue holds the index messages from an untrusted device
+// while they are decrypted one by one. Decrypting may involve requests to
+// the device, so it can't be done while the connection waits for us.
+type untrustedIndexQueue struct {
+	jobs   []untrustedIndexJob
+	mut    sync.Mutex
+	signal chan struct{}
+	stop   chan struct{}
+}
+
+func newUntrustedIndexQueue() *untrustedIndexQueue {
+	return &untrustedIndexQueue{
+		mut:    sync.NewMutex(),
+		signal: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}
+}
+
+func (q *untrustedIndexQueue) push(job untrustedIndexJob) {
+	q.mut.Lock()
+	q.jobs = append(q.jobs, job)
+	q.mut.Unlock()
+
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the next job, waiting for one if necessary. It returns false
+// when the queue is stopped.
+func (q *untrustedIndexQueue) pop() (untrustedIndexJob, bool) {
+	for {
+		q.mut.Lock()
+		if len(q.jobs) > 0 {
+			job := q.jobs[0]
+			q.jobs = q.jobs[1:]
+			q.mut.Unlock()
+			return job, true
+		}
+		q.mut.Unlock()
+
+		select {
+		case <-q.signal:
+		case <-q.stop:
+			return untrustedIndexJob{}, false
+		}
+	}
+}
+
+// queueUntrustedIndex queues an index message from an untrusted device for
+// decryption.
+func (m *Model) queueUntrustedIndex(deviceID protocol.DeviceID, job untrustedIndexJob) {
+	m.pmut.Lock()
+	q, ok := m.indexQueues[deviceID]
+	if !ok {
+		q = newUntrustedIndexQueue()
+		m.indexQueues[deviceID] = q
+		go m.decryptIndexes(deviceID, q)
+	}
+	m.pmut.Unlock()
+
+	q.push(job)
+}
+
+func (m *Model) decryptIndexes(deviceID protocol.DeviceID, q *untrustedIndexQueue) {
+	for {
+		job, ok := q.pop()
+		if !ok {
+			return
+		}
+		m.decryptIndex(deviceID, job)
+	}
+}
+
+// decryptIndex decrypts the index message and updates what we know about
+// the files the device has, like Index and IndexUpdate do for trusted
+// devices. Files that can't be decrypted are left out.
+func (m *Model) decryptIndex(deviceID protocol.DeviceID, job untrustedIndexJob) {
+	m.fmut.RLock()
+	files, ok := m.folderFiles[job.folder]
+	cfg := m.folderCfgs[job.folder]
+	runner := m.folderRunners[job.folder]
+	enc := m.folderCrypto[job.folder]
+	readOnly := m.folderDeviceLocked(job.folder, deviceID).ReadOnly
+	m.fmut.RUnlock()
+	if !ok || enc == nil {
+		return
+	}
+
+	m.pmut.RLock()
+	nc, connected := m.conn[deviceID]
+	m.pmut.RUnlock()
+	if !connected {
+		return
+	}
+
+	known := func(name string) (protocol.FileInfo, bool) {
+		if f, ok := files.Get(protocol.LocalDeviceID, name); ok {
+			return f, true
+		}
+		return files.GetGlobal(name)
+	}
+	fetch := func(name string, offset int64, size int) ([]byte, error) {
+		return nc.Request(job.folder, name, offset, size, nil, 0, nil)
+	}
+
+	fs := make([]protocol.FileInfo, 0, len(job.files))
+	for _, ef := range job.files {
+		f, err := enc.decryptFileInfo(ef, known, fetch)
+		if err != nil {
+			if debug {
+				l.Debugf("%v decrypting %q from %s: %v", m, ef.Name, deviceID, err)
+			}
+			continue
+		}
+		fs = append(fs, f)
+	}
+	fs = filterIndex(job.folder, fs, cfg.IgnoreDelete)
+	if readOnly {
+		fs = markReadOnlyChanges(files, fs)
+	}
+
+	// The device may have disconnected while we were busy, in which case
+	// its files have been forgotten and should stay that way.
+	m.pmut.RLock()
+	if _, connected = m.conn[deviceID]; connected {
+		if job.replace {
+			files.Replace(deviceID, fs)
+		} else {
+			files.Update(deviceID, fs)
+		}
+	}
+	m.pmut.RUnlock()
+	if !connected {
+		return
+	}
+
+	events.Default.Log(events.RemoteIndexUpdated, map[string]interface{}{
+		"device":  deviceID.String(),
+		"folder":  job.folder,
+		"items":   len(fs),
+		"version": files.LocalVersion(deviceID),
+	})
+
+	if runner != nil {
+		runner.IndexUpdated()
+	}
+}
+
+// stopUntrustedIndexesLocked stops decrypting index messages from the device.
+// Must be called with pmut held.
+func (m *Model) stopUntrustedIndexesLocked(deviceID protocol.DeviceID) {
+	if q, ok := m.indexQueues[deviceID]; ok {
+		close(q.stop)
+		delete(m.indexQueues, deviceID)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/db"
+	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// modelConnection passes requests on to a model, as if from the given device.
+type modelConnection struct {
+	FakeConnection
+	m    *Model
+	from protocol.DeviceID
+}
+
+func (c modelConnection) Request(folder, name string, offset int64, size int, hash []byte, flags uint32, options []protocol.Option) ([]byte, error) {
+	buf := make([]byte, size)
+	if err := c.m.Request(c.from, folder, name, offset, hash, flags, options, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 2*protocol.BlockSize+1234)
+	rand.New(rand.NewSource(42)).Read(data)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fcfg := config.FolderConfiguration{
+		ID:                 "default",
+		RawPath:            dir,
+		EncryptionPassword: "secret",
+		Devices: []config.FolderDeviceConfiguration{
+			{DeviceID: device1, Untrusted: true},
+			{DeviceID: device2},
+		},
+	}
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}},
+	})
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.StartFolderRO("default")
+	m.ServeBackground()
+	m.ScanFolder("default")
+
+	plain, ok := m.CurrentFolderFile("default", "file")
+	if !ok {
+		t.Fatal("file not scanned")
+	}
+
+	if m.untrustedEncryption("default", device2) != nil {
+		t.Error("trusted device should not get encrypted files")
+	}
+	enc := m.untrustedEncryption("default", device1)
+	if enc == nil {
+		t.Fatal("untrusted device should get encrypted files")
+	}
+
+	ef, err := enc.encryptFileInfo(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ef.Name == "file" || ef.Modified != 0 || ef.Flags != protocol.FlagNoPermBits {
+		t.Errorf("encrypted file leaks metadata: %v", ef)
+	}
+	if !ef.Version.Equal(plain.Version) {
+		t.Errorf("version %v != %v", ef.Version, plain.Version)
+	}
+
+	// The untrusted device can fetch every block of the encrypted file, and
+	// the trusted device the plain file from it in turn.
+
+	var encData []byte
+	for _, b := range ef.Blocks {
+		buf := make([]byte, b.Size)
+		if err := m.Request(device1, "default", ef.Name, int64(len(encData)), nil, 0, nil, buf); err != nil {
+			t.Fatal(err)
+		}
+		encData = append(encData, buf...)
+	}
+	if bytes.Contains(encData, data[:64]) {
+		t.Error("encrypted file contains plain data")
+	}
+	if err := m.Request(device1, "default", "file", 0, nil, 0, nil, make([]byte, 10)); err != protocol.ErrNoSuchFile {
+		t.Errorf("untrusted device got plain file; err = %v", err)
+	}
+
+	remote := modelConnection{m: m, from: device1}
+	known := func(string) (protocol.FileInfo, bool) {
+		return protocol.FileInfo{}, false
+	}
+	fetch := func(name string, offset int64, size int) ([]byte, error) {
+		return remote.Request("default", name, offset, size, nil, 0, nil)
+	}
+
+	df, err := enc.decryptFileInfo(ef, known, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if df.Name != plain.Name || df.Flags != plain.Flags || df.Modified != plain.Modified || !df.Version.Equal(plain.Version) {
+		t.Errorf("decrypted file %v != %v", df, plain)
+	}
+	if !reflect.DeepEqual(df.Blocks, plain.Blocks) {
+		t.Errorf("decrypted blocks %v != %v", df.Blocks, plain.Blocks)
+	}
+
+	var got []byte
+	for _, b := range plain.Blocks {
+		bs, err := enc.request(remote, plain, int64(len(got)), int(b.Size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, bs...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("decrypted data differs from plain data")
+	}
+
+	// Metadata for another version of the file is refused.
+	other := ef
+	other.Version = other.Version.Update(device2.Short())
+	if _, err := enc.decryptFileInfo(other, known, fetch); err != errMetadataMismatch {
+		t.Errorf("unexpected error %v for mismatched version", err)
+	}
+}
+
+func TestEncryptedIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte("some data")
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(data)
+
+	fcfg := config.FolderConfiguration{
+		ID:                 "default",
+		RawPath:            dir,
+		EncryptionPassword: "secret",
+	}
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	fs := db.NewFileSet("default", ldb)
+	fs.Update(protocol.LocalDeviceID, []protocol.FileInfo{
+		{Name: "dir", Flags: protocol.FlagDirectory, Version: protocol.Vector{{ID: 1, Value: 1}}},
+		{Name: "file", Version: protocol.Vector{{ID: 1, Value: 1}}, Blocks: []protocol.BlockInfo{{Size: int32(len(data)), Hash: hash[:]}}},
+		{Name: "link", Flags: protocol.FlagSymlink, Version: protocol.Vector{{ID: 1, Value: 1}}, Blocks: []protocol.BlockInfo{{Size: 4, Hash: hash[:]}}},
+	})
+
+	enc := newFolderEncryption(ldb, fcfg)
+	conn := indexRecorder{FakeConnection{id: device1}, make(chan []protocol.FileInfo, 1)}
+	caps := peerCapabilities{maxBlockSize: protocol.BlockSize}
+	if _, err := sendIndexTo(true, 0, conn, "default", fs, nil, caps, enc); err != nil {
+		t.Fatal(err)
+	}
+
+	names := make(map[string]protocol.FileInfo)
+	for _, f := range <-conn.indexes {
+		names[f.Name] = f
+	}
+	if len(names) != 2 {
+		t.Errorf("sent %d files, expected the directory and the file", len(names))
+	}
+	if _, ok := names[enc.encryptName("link")]; ok {
+		t.Error("symlink sent to untrusted device")
+	}
+	if f, ok := names[enc.encryptName("file")]; !ok || f.IsInvalid() || len(f.Blocks) == 0 {
+		t.Errorf("file not sent encrypted: %v", f)
+	}
+	if _, ok := enc.cache.Get("file", protocol.Vector{{ID: 1, Value: 1}}); !ok {
+		t.Error("encrypted file not cached")
+	}
+}
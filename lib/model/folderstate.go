@@ -20,6 +20,7 @@ const (
 	FolderScanning
 	FolderSyncing
 	FolderError
+	FolderNeedsConfirmation
 )
 
 func (s folderState) String() string {
@@ -32,6 +33,8 @@ func (s folderState) String() string {
 		return "syncing"
 	case FolderError:
 		return "error"
+	case FolderNeedsConfirmation:
+		return "needsConfirmation"
 	default:
 		return "unknown"
 	}
@@ -44,15 +47,20 @@ type stateTracker struct {
 	current folderState
 	err     error
 	changed time.Time
+	held    bool // deletions are held for confirmation
 }
 
 // setState sets the new folder state, for states other than FolderError.
+// While deletions are held, FolderIdle becomes FolderNeedsConfirmation.
 func (s *stateTracker) setState(newState folderState) {
 	if newState == FolderError {
 		panic("must use setError")
 	}
 
 	s.mut.Lock()
+	if newState == FolderIdle && s.held {
+		newState = FolderNeedsConfirmation
+	}
 	if newState != s.current {
 		/* This should hold later...
 		if s.current != FolderIdle && (newState == FolderScanning || newState == FolderSyncing) {
@@ -115,9 +123,13 @@ func (s *stateTracker) setError(err error) {
 func (s *stateTracker) clearError() {
 	s.mut.Lock()
 	if s.current == FolderError {
+		newState := FolderIdle
+		if s.held {
+			newState = FolderNeedsConfirmation
+		}
 		eventData := map[string]interface{}{
 			"folder": s.folder,
-			"to":     FolderIdle.String(),
+			"to":     newState.String(),
 			"from":   s.current.String(),
 		}
 
@@ -125,7 +137,7 @@ func (s *stateTracker) clearError() {
 			eventData["duration"] = time.Since(s.changed).Seconds()
 		}
 
-		s.current = FolderIdle
+		s.current = newState
 		s.err = nil
 		s.changed = time.Now()
 
@@ -133,3 +145,16 @@ func (s *stateTracker) clearError() {
 	}
 	s.mut.Unlock()
 }
+
+// setHeld sets whether the folder has deletions held for confirmation, and
+// updates the state of an idle folder accordingly.
+func (s *stateTracker) setHeld(held bool) {
+	s.mut.Lock()
+	s.held = held
+	current := s.current
+	s.mut.Unlock()
+
+	if current == FolderIdle || current == FolderNeedsConfirmation {
+		s.setState(FolderIdle)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/watcher"
+)
+
+const (
+	// defaultWatchDelay is how long the folder must be quiet after a change
+	// before it is scanned, unless configured otherwise.
+	defaultWatchDelay = 10 * time.Second
+	// maxWatchDelayFactor bounds the total time a scan is postponed by a
+	// steady stream of changes, as a multiple of the delay.
+	maxWatchDelayFactor = 6
+	// maxWatchPaths is the number of distinct changed paths above which the
+	// whole folder is scanned instead.
+	maxWatchPaths = 1000
+	// watchRescanInterval is the least time between periodic rescans of a
+	// watched folder. They are then only a safety net for notifications
+	// that got lost without us noticing.
+	watchRescanInterval = time.Hour
+)
+
+// A folderWatcher listens for file system notifications in a folder and
+// scans the changed paths once things have quieted down. When notifications
+// are lost the whole folder is scanned. While the folder is watched, the
+// periodic rescans are stretched to watchRescanInterval; if it cannot be
+// watched at all, they are all there is.
+type folderWatcher struct {
+	model  *Model
+	runner service
+	folder string
+	dir    string
+	delay  time.Duration
+	stop   chan struct{}
+}
+
+func newFolderWatcher(model *Model, runner service, folder, dir string, delay time.Duration) *folderWatcher {
+	if delay <= 0 {
+		delay = defaultWatchDelay
+	}
+	return &folderWatcher{
+		model:  model,
+		runner: runner,
+		folder: folder,
+		dir:    dir,
+		delay:  delay,
+		stop:   make(chan struct{}),
+	}
+}
+
+func (w *folderWatcher) Serve() {
+	if debug {
+		l.Debugln(w, "starting")
+		defer l.Debugln(w, "exiting")
+	}
+
+	fw, err := watcher.New(w.dir)
+	if err != nil {
+		l.Infof("Cannot watch folder %q for changes (%v); relying on periodic rescans", w.folder, err)
+		// Returning would make the supervisor restart us over and over.
+		<-w.stop
+		return
+	}
+	defer fw.Close()
+
+	w.runner.setWatched(true)
+	defer w.runner.setWatched(false)
+
+	timer := time.NewTimer(w.delay)
+	timer.Stop()
+	defer timer.Stop()
+
+	pending := make(map[string]struct{})
+	fullScan := false
+	var first time.Time
+
+	schedule := func() {
+		now := time.Now()
+		if len(pending) == 0 && !fullScan {
+			first = now
+		}
+		next := w.delay
+		if deadline := first.Add(maxWatchDelayFactor * w.delay); deadline.Before(now.Add(next)) {
+			next = deadline.Sub(now)
+		}
+		timer.Reset(next)
+	}
+
+	for {
+		select {
+		case <-w.stop:
+			return
+
+		case name := <-fw.Events():
+			if w.ignored(name) {
+				continue
+			}
+			schedule()
+			if name == "" {
+				fullScan = true
+			} else if !fullScan {
+				pending[name] = struct{}{}
+				if len(pending) > maxWatchPaths {
+					fullScan = true
+				}
+			}
+
+		case <-fw.Overflow():
+			schedule()
+			fullScan = true
+
+		case <-timer.C:
+			if len(pending) == 0 && !fullScan {
+				continue
+			}
+
+			var subs []string
+			if !fullScan {
+				subs = pruneSubs(pending)
+			}
+			if debug {
+				l.Debugln(w, "scanning", subs)
+			}
+			if err := w.model.ScanFolderSubs(w.folder, subs); err != nil {
+				l.Infof("Scanning changes in folder %q: %v", w.folder, err)
+			}
+
+			pending = make(map[string]struct{})
+			fullScan = false
+		}
+	}
+}
+
+func (w *folderWatcher) Stop() {
+	close(w.stop)
+}
+
+func (w *folderWatcher) String() string {
+	return fmt.Sprintf("folderWatcher/%s@%p", w.folder, w)
+}
+
+// A watchState tells whether a folder is watched for changes, which
+// stretches the time between its periodic rescans. It is embedded in the
+// folder runners and set by the watcher.
+type watchState struct {
+	watched int32
+}
+
+func (s *watchState) setWatched(watched bool) {
+	var v int32
+	if watched {
+		v = 1
+	}
+	atomic.StoreInt32(&s.watched, v)
+}
+
+// rescanInterval returns the time between periodic rescans, given the
+// configured one.
+func (s *watchState) rescanInterval(intv time.Duration) time.Duration {
+	if intv > 0 && intv < watchRescanInterval && atomic.LoadInt32(&s.watched) != 0 {
+		return watchRescanInterval
+	}
+	return intv
+}
+
+// ignored returns true for changes that a scan would not pick up anyway.
+func (w *folderWatcher) ignored(name string) bool {
+	if name == "" {
+		return false
+	}
+	if defTempNamer.IsTemporary(name) {
+		return true
+	}
+
+	w.model.fmut.RLock()
+	ignores := w.model.folderIgnores[w.folder]
+	w.model.fmut.RUnlock()
+
+	return ignores.Match(name)
+}
+
+// pruneSubs returns the sorted paths, leaving out those that are below
+// another path in the set as they are covered by scanning the parent.
+func pruneSubs(paths map[string]struct{}) []string {
+	subs := make([]string, 0, len(paths))
+nextPath:
+	for path := range paths {
+		for parent := filepath.Dir(path); parent != "." && parent != string(filepath.Separator); parent = filepath.Dir(parent) {
+			if _, ok := paths[parent]; ok {
+				continue nextPath
+			}
+		}
+		subs = append(subs, path)
+	}
+	sort.Strings(subs)
+	return subs
+}
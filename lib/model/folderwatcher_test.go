@@ -0,0 +1,58 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPruneSubs(t *testing.T) {
+	paths := map[string]struct{}{
+		"a":                            {},
+		filepath.Join("a", "b"):        {},
+		filepath.Join("a", "b", "c"):   {},
+		"a b":                          {},
+		filepath.Join("x", "y"):        {},
+		filepath.Join("x", "y", "z"):   {},
+		filepath.Join("x", "yy", "zz"): {},
+	}
+	expected := []string{
+		"a",
+		"a b",
+		filepath.Join("x", "y"),
+		filepath.Join("x", "yy", "zz"),
+	}
+
+	if subs := pruneSubs(paths); !reflect.DeepEqual(subs, expected) {
+		t.Errorf("pruneSubs: %v != expected %v", subs, expected)
+	}
+}
+
+func TestRescanIntervalWatched(t *testing.T) {
+	var s watchState
+	cases := []struct {
+		intv, watched time.Duration
+	}{
+		{0, 0},
+		{time.Minute, watchRescanInterval},
+		{2 * watchRescanInterval, 2 * watchRescanInterval},
+	}
+
+	for _, tc := range cases {
+		s.setWatched(false)
+		if intv := s.rescanInterval(tc.intv); intv != tc.intv {
+			t.Errorf("unwatched rescan interval %v != configured %v", intv, tc.intv)
+		}
+		s.setWatched(true)
+		if intv := s.rescanInterval(tc.intv); intv != tc.watched {
+			t.Errorf("watched rescan interval for %v is %v, expected %v", tc.intv, intv, tc.watched)
+		}
+	}
+}
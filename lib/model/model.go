@@ -8,6 +8,7 @@ package model
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -18,6 +19,8 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	stdsync "sync"
 	"time"
@@ -47,6 +50,37 @@ const (
 	reqValidationCacheSize = 1000       // How many entries to aim for in the validation cache size
 )
 
+// The ClusterConfig options announcing optional protocol features.
+const (
+	weakHashOption     = "weakHash"     // Block lists may carry weak hashes of this kind
+	weakHashRollsum    = "rollsum"      // The weak hash kind we compute
+	maxBlockSizeOption = "maxBlockSize" // The largest block size handled, in bytes
+	posixMetaOption    = "posixMeta"    // Files may carry ownership and extended attributes
+	hardLinkOption     = "hardLinks"    // Files may be hard links to other files
+)
+
+// peerCapabilities are the optional protocol features announced by a device
+// in its cluster config.
+type peerCapabilities struct {
+	weakHashes   bool
+	maxBlockSize int
+	posixMeta    bool
+	hardLinks    bool
+}
+
+func capabilitiesOf(cm protocol.ClusterConfigMessage) peerCapabilities {
+	caps := peerCapabilities{
+		weakHashes:   cm.GetOption(weakHashOption) == weakHashRollsum,
+		maxBlockSize: protocol.BlockSize,
+		posixMeta:    cm.GetOption(posixMetaOption) == "true",
+		hardLinks:    cm.GetOption(hardLinkOption) == "true",
+	}
+	if bs, err := strconv.Atoi(cm.GetOption(maxBlockSizeOption)); err == nil && bs > caps.maxBlockSize {
+		caps.maxBlockSize = bs
+	}
+	return caps
+}
+
 type service interface {
 	Serve()
 	Stop()
@@ -59,6 +93,8 @@ type service interface {
 	setState(state folderState)
 	setError(err error)
 	clearError()
+	setHeld(held bool)
+	setWatched(watched bool)
 	getState() (folderState, time.Time, error)
 }
 
@@ -72,32 +108,44 @@ type Model struct {
 	id                protocol.DeviceID
 	shortID           uint64
 	cacheIgnoredFiles bool
+	scanLimit         *scanLimiter // for all folders together
 
 	deviceName    string
 	clientName    string
 	clientVersion string
 
-	folderCfgs     map[string]config.FolderConfiguration                  // folder -> cfg
-	folderFiles    map[string]*db.FileSet                                 // folder -> files
-	folderDevices  map[string][]protocol.DeviceID                         // folder -> deviceIDs
-	deviceFolders  map[protocol.DeviceID][]string                         // deviceID -> folders
-	deviceStatRefs map[protocol.DeviceID]*stats.DeviceStatisticsReference // deviceID -> statsRef
-	folderIgnores  map[string]*ignore.Matcher                             // folder -> matcher object
-	folderRunners  map[string]service                                     // folder -> puller or scanner
-	folderStatRefs map[string]*stats.FolderStatisticsReference            // folder -> statsRef
-	fmut           sync.RWMutex                                           // protects the above
+	folderCfgs       map[string]config.FolderConfiguration                  // folder -> cfg
+	folderFiles      map[string]*db.FileSet                                 // folder -> files
+	folderDevices    map[string][]protocol.DeviceID                         // folder -> deviceIDs
+	deviceFolders    map[protocol.DeviceID][]string                         // deviceID -> folders
+	deviceStatRefs   map[protocol.DeviceID]*stats.DeviceStatisticsReference // deviceID -> statsRef
+	folderIgnores    map[string]*ignore.Matcher                             // folder -> matcher object
+	folderRunners    map[string]service                                     // folder -> puller or scanner
+	folderTokens     map[string][]suture.ServiceToken                       // folder -> tokens for the runner and its helpers
+	folderVersioners map[string]versioner.Versioner                         // folder -> versioner, if versioning is enabled
+	folderStatRefs   map[string]*stats.FolderStatisticsReference            // folder -> statsRef
+	folderCrypto     map[string]*folderEncryption                           // folder -> encryption, if shared with untrusted devices
+	folderDeletions  map[string]*heldDeletions                              // folder -> deletions held for confirmation
+	folderCorrupt    map[string]map[string]corruptFile                      // folder -> file name -> found corrupt by verification
+	folderUnstable   map[string]*unstableRescan                             // folder -> scan of files that were still changing
+	folderScanLimits map[string]*scanLimiter                                // folder -> scan rate limit
+	fmut             sync.RWMutex                                           // protects the above
 
 	conn         map[protocol.DeviceID]Connection
 	deviceVer    map[protocol.DeviceID]string
 	devicePaused map[protocol.DeviceID]bool
+	indexQueues  map[protocol.DeviceID]*untrustedIndexQueue
 	pmut         sync.RWMutex // protects the above
 
 	reqValidationCache map[string]time.Time // folder / file name => time when confirmed to exist
-	rvmut              sync.RWMutex         // protects reqValidationCache
+	mismatchRescans    map[string]struct{}  // folder / file name => being rescanned after a hash mismatch
+	rvmut              sync.RWMutex         // protects the above
 }
 
 var (
-	symlinkWarning = stdsync.Once{}
+	symlinkWarning  = stdsync.Once{}
+	errFolderPaused = errors.New("folder is paused")
+	errNoVersioner  = errors.New("folder has no versioning")
 )
 
 // NewModel creates and starts a new model. The model starts in read-only mode,
@@ -119,6 +167,7 @@ func NewModel(cfg *config.Wrapper, id protocol.DeviceID, deviceName, clientName,
 		id:                 id,
 		shortID:            id.Short(),
 		cacheIgnoredFiles:  cfg.Options().CacheIgnoredFiles,
+		scanLimit:          newScanLimiter(cfg.Options().MaxScanKiBs),
 		deviceName:         deviceName,
 		clientName:         clientName,
 		clientVersion:      clientVersion,
@@ -129,11 +178,20 @@ func NewModel(cfg *config.Wrapper, id protocol.DeviceID, deviceName, clientName,
 		deviceStatRefs:     make(map[protocol.DeviceID]*stats.DeviceStatisticsReference),
 		folderIgnores:      make(map[string]*ignore.Matcher),
 		folderRunners:      make(map[string]service),
+		folderTokens:       make(map[string][]suture.ServiceToken),
+		folderVersioners:   make(map[string]versioner.Versioner),
 		folderStatRefs:     make(map[string]*stats.FolderStatisticsReference),
+		folderCrypto:       make(map[string]*folderEncryption),
+		folderDeletions:    make(map[string]*heldDeletions),
+		folderCorrupt:      make(map[string]map[string]corruptFile),
+		folderUnstable:     make(map[string]*unstableRescan),
+		folderScanLimits:   make(map[string]*scanLimiter),
 		conn:               make(map[protocol.DeviceID]Connection),
 		deviceVer:          make(map[protocol.DeviceID]string),
 		devicePaused:       make(map[protocol.DeviceID]bool),
+		indexQueues:        make(map[protocol.DeviceID]*untrustedIndexQueue),
 		reqValidationCache: make(map[string]time.Time),
+		mismatchRescans:    make(map[string]struct{}),
 
 		fmut:  sync.NewRWMutex(),
 		pmut:  sync.NewRWMutex(),
@@ -184,14 +242,24 @@ func (m *Model) StartFolderRW(folder string) {
 			// The versioner implements the suture.Service interface, so
 			// expects to be run in the background in addition to being called
 			// when files are going to be archived.
-			m.Add(service)
+			m.addFolderService(folder, service)
 		}
 		p.versioner = versioner
+
+		m.fmut.Lock()
+		m.folderVersioners[folder] = versioner
+		m.fmut.Unlock()
 	}
 
-	m.Add(p)
+	m.addFolderService(folder, p)
+	m.startFolderWatcher(cfg, p)
+	m.startFolderVerifier(cfg)
 
-	l.Okln("Ready to synchronize", folder, "(read-write)")
+	if cfg.ReceiveOnly {
+		l.Okln("Ready to synchronize", folder, "(receive only; local changes are not announced)")
+	} else {
+		l.Okln("Ready to synchronize", folder, "(read-write)")
+	}
 }
 
 // StartFolderRO starts read only processing on the current model. When in
@@ -212,11 +280,57 @@ func (m *Model) StartFolderRO(folder string) {
 	m.folderRunners[folder] = s
 	m.fmut.Unlock()
 
-	m.Add(s)
+	m.addFolderService(folder, s)
+	m.startFolderWatcher(cfg, s)
+	m.startFolderVerifier(cfg)
 
 	l.Okln("Ready to synchronize", folder, "(read only; no external updates accepted)")
 }
 
+// startFolderWatcher starts watching the folder for changes, if it is so
+// configured, on behalf of the runner.
+func (m *Model) startFolderWatcher(cfg config.FolderConfiguration, runner service) {
+	if !cfg.WatchChanges {
+		return
+	}
+	delay := time.Duration(cfg.WatchDelayS) * time.Second
+	m.addFolderService(cfg.ID, newFolderWatcher(m, runner, cfg.ID, cfg.Path(), delay))
+}
+
+// startFolderVerifier starts verifying the files in the folder from time to
+// time, if it is so configured.
+func (m *Model) startFolderVerifier(cfg config.FolderConfiguration) {
+	if cfg.VerifyIntervalS <= 0 {
+		return
+	}
+	intv := time.Duration(cfg.VerifyIntervalS) * time.Second
+	m.addFolderService(cfg.ID, newFolderVerifier(m, cfg.ID, intv))
+}
+
+// startFolder starts read only or read/write processing of the folder,
+// depending on its configuration.
+func (m *Model) startFolder(folder string) {
+	m.fmut.RLock()
+	cfg := m.folderCfgs[folder]
+	m.fmut.RUnlock()
+
+	if cfg.ReadOnly {
+		m.StartFolderRO(folder)
+	} else {
+		m.StartFolderRW(folder)
+	}
+}
+
+// addFolderService adds the service to the model supervisor and remembers
+// it as belonging to the folder, so that it can be removed when the folder
+// is paused.
+func (m *Model) addFolderService(folder string, svc suture.Service) {
+	token := m.Add(svc)
+	m.fmut.Lock()
+	m.folderTokens[folder] = append(m.folderTokens[folder], token)
+	m.fmut.Unlock()
+}
+
 type ConnectionInfo struct {
 	protocol.Statistics
 	Connected     bool
@@ -510,6 +624,7 @@ func (m *Model) Index(deviceID protocol.DeviceID, folder string, fs []protocol.F
 	cfg := m.folderCfgs[folder]
 	files, ok := m.folderFiles[folder]
 	runner := m.folderRunners[folder]
+	readOnly := m.folderDeviceLocked(folder, deviceID).ReadOnly
 	m.fmut.RUnlock()
 
 	if runner != nil {
@@ -522,7 +637,15 @@ func (m *Model) Index(deviceID protocol.DeviceID, folder string, fs []protocol.F
 		l.Fatalf("Index for nonexistant folder %q", folder)
 	}
 
+	if m.untrustedEncryption(folder, deviceID) != nil {
+		m.queueUntrustedIndex(deviceID, untrustedIndexJob{folder: folder, files: fs, replace: true})
+		return
+	}
+
 	fs = filterIndex(folder, fs, cfg.IgnoreDelete)
+	if readOnly {
+		fs = markReadOnlyChanges(files, fs)
+	}
 	files.Replace(deviceID, fs)
 
 	events.Default.Log(events.RemoteIndexUpdated, map[string]interface{}{
@@ -551,16 +674,25 @@ func (m *Model) IndexUpdate(deviceID protocol.DeviceID, folder string, fs []prot
 	}
 
 	m.fmut.RLock()
-	files := m.folderFiles[folder]
+	files, ok := m.folderFiles[folder]
 	cfg := m.folderCfgs[folder]
-	runner, ok := m.folderRunners[folder]
+	runner := m.folderRunners[folder]
+	readOnly := m.folderDeviceLocked(folder, deviceID).ReadOnly
 	m.fmut.RUnlock()
 
 	if !ok {
 		l.Fatalf("IndexUpdate for nonexistant folder %q", folder)
 	}
 
+	if m.untrustedEncryption(folder, deviceID) != nil {
+		m.queueUntrustedIndex(deviceID, untrustedIndexJob{folder: folder, files: fs})
+		return
+	}
+
 	fs = filterIndex(folder, fs, cfg.IgnoreDelete)
+	if readOnly {
+		fs = markReadOnlyChanges(files, fs)
+	}
 	files.Update(deviceID, fs)
 
 	events.Default.Log(events.RemoteIndexUpdated, map[string]interface{}{
@@ -570,7 +702,10 @@ func (m *Model) IndexUpdate(deviceID protocol.DeviceID, folder string, fs []prot
 		"version": files.LocalVersion(deviceID),
 	})
 
-	runner.IndexUpdated()
+	if runner != nil {
+		// Runner is not set while the folder is paused.
+		runner.IndexUpdated()
+	}
 }
 
 func (m *Model) folderSharedWith(folder string, deviceID protocol.DeviceID) bool {
@@ -584,6 +719,17 @@ func (m *Model) folderSharedWith(folder string, deviceID protocol.DeviceID) bool
 	return false
 }
 
+// folderDeviceLocked returns the configuration of the device in the folder.
+// Must be called with fmut held.
+func (m *Model) folderDeviceLocked(folder string, deviceID protocol.DeviceID) config.FolderDeviceConfiguration {
+	for _, dev := range m.folderCfgs[folder].Devices {
+		if dev.DeviceID == deviceID {
+			return dev
+		}
+	}
+	return config.FolderDeviceConfiguration{}
+}
+
 func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterConfigMessage) {
 	m.pmut.Lock()
 	if cm.ClientName == "syncthing" {
@@ -604,6 +750,21 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 		if addr != nil {
 			event["addr"] = addr.String()
 		}
+
+		caps := capabilitiesOf(cm)
+		m.fmut.RLock()
+		for _, folder := range m.deviceFolders[deviceID] {
+			if m.folderCfgs[folder].Paused {
+				continue
+			}
+			fs := m.folderFiles[folder]
+			var enc *folderEncryption
+			if m.folderDeviceLocked(folder, deviceID).Untrusted {
+				enc = m.folderCrypto[folder]
+			}
+			go sendIndexes(conn, folder, fs, m.folderIgnores[folder], caps, enc)
+		}
+		m.fmut.RUnlock()
 	}
 
 	m.pmut.Unlock()
@@ -624,6 +785,23 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 		}
 	}
 
+	// A device that doesn't trust us is sent our files encrypted, and
+	// can't make sense of what it gets from us. One that shares the folder
+	// with us read only ignores our changes.
+	for _, folder := range cm.Folders {
+		for _, device := range folder.Devices {
+			if !bytes.Equal(device.ID, m.id[:]) {
+				continue
+			}
+			if device.Flags&protocol.FlagShareTrusted == 0 {
+				l.Infof("Device %s shares folder %q with us as an untrusted device", deviceID, folder.ID)
+			}
+			if device.Flags&protocol.FlagShareReadOnly != 0 {
+				l.Infof("Device %s shares folder %q with us read only; changes made here will not be accepted", deviceID, folder.ID)
+			}
+		}
+	}
+
 	if m.cfg.Devices()[deviceID].Introducer {
 		// This device is an introducer. Go through the announced lists of folders
 		// and devices and add what we are missing.
@@ -679,7 +857,9 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 
 				folderCfg := m.cfg.Folders()[folder.ID]
 				folderCfg.Devices = append(folderCfg.Devices, config.FolderDeviceConfiguration{
-					DeviceID: id,
+					DeviceID:  id,
+					Untrusted: device.Flags&protocol.FlagShareTrusted == 0,
+					ReadOnly:  device.Flags&protocol.FlagShareReadOnly != 0,
 				})
 				m.cfg.SetFolder(folderCfg)
 
@@ -715,6 +895,7 @@ func (m *Model) Close(device protocol.DeviceID, err error) {
 	}
 	delete(m.conn, device)
 	delete(m.deviceVer, device)
+	m.stopUntrustedIndexesLocked(device)
 	m.pmut.Unlock()
 }
 
@@ -730,11 +911,22 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 		return protocol.ErrNoSuchFile
 	}
 
+	if m.IsFolderPaused(folder) {
+		if debug {
+			l.Debugf("%v REQ(in): %s: %q / %q o=%d s=%d; folder is paused", m, deviceID, folder, name, offset, len(buf))
+		}
+		return protocol.ErrNoSuchFile
+	}
+
 	if flags != 0 {
 		// We don't currently support or expect any flags.
 		return fmt.Errorf("protocol error: unknown flags 0x%x in Request message", flags)
 	}
 
+	if enc := m.untrustedEncryption(folder, deviceID); enc != nil {
+		return m.requestEncrypted(enc, deviceID, folder, name, offset, buf)
+	}
+
 	// Verify that the requested file exists in the local model. We only need
 	// to validate this file if we haven't done so recently, so we keep a
 	// cache of successfull results. "Recently" can be quite a long time, as
@@ -810,9 +1002,28 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 		l.Debugf("%v REQ(in): %s: %q / %q o=%d s=%d", m, deviceID, folder, name, offset, len(buf))
 	}
 	m.fmut.RLock()
-	fn := filepath.Join(m.folderCfgs[folder].Path(), name)
+	fn := m.folderCfgs[folder].FilePath(name)
 	m.fmut.RUnlock()
 
+	if err := readFileAt(fn, buf, offset); err != nil {
+		return err
+	}
+
+	// Don't serve data that isn't what was asked for. Either the file
+	// changed since it was scanned or it got corrupted.
+	if len(hash) > 0 {
+		if _, err := scanner.VerifyBuffer(buf, protocol.BlockInfo{Size: int32(len(buf)), Hash: hash}); err != nil {
+			l.Infof("Request from %s for %q in folder %q: data at offset %d doesn't match the requested hash; rescanning", deviceID, name, folder, offset)
+			m.rescanMismatch(folder, name)
+			return protocol.ErrHashMismatch
+		}
+	}
+	return nil
+}
+
+// readFileAt fills buf with the contents of the file at the given offset.
+// The contents of a symlink are its target.
+func readFileAt(fn string, buf []byte, offset int64) error {
 	var reader io.ReaderAt
 	var err error
 	if info, err := os.Lstat(fn); err == nil && info.Mode()&os.ModeSymlink != 0 {
@@ -959,12 +1170,10 @@ func (m *Model) AddConnection(conn Connection) {
 	cm := m.clusterConfig(deviceID)
 	conn.ClusterConfig(cm)
 
-	m.fmut.RLock()
-	for _, folder := range m.deviceFolders[deviceID] {
-		fs := m.folderFiles[folder]
-		go sendIndexes(conn, folder, fs, m.folderIgnores[folder])
-	}
-	m.fmut.RUnlock()
+	// Indexes are sent once we've seen the cluster config of the other side,
+	// as the options in it tell which parts of the files it can decode. The
+	// protocol requires it to be the first message, so this costs no more
+	// than a round trip.
 	m.pmut.Unlock()
 
 	m.deviceWasSeen(deviceID)
@@ -995,6 +1204,96 @@ func (m *Model) IsPaused(device protocol.DeviceID) bool {
 	return paused
 }
 
+// PauseFolder stops the puller or scanner of the folder. While paused the
+// folder database is left untouched, no index is sent for the folder and
+// requests for its files are refused. The paused state is saved to the
+// configuration.
+func (m *Model) PauseFolder(folder string) error {
+	return m.saveFolderPaused(folder, true)
+}
+
+// ResumeFolder restarts a folder previously paused by PauseFolder.
+func (m *Model) ResumeFolder(folder string) error {
+	return m.saveFolderPaused(folder, false)
+}
+
+func (m *Model) IsFolderPaused(folder string) bool {
+	m.fmut.RLock()
+	paused := m.folderCfgs[folder].Paused
+	m.fmut.RUnlock()
+	return paused
+}
+
+func (m *Model) saveFolderPaused(folder string, paused bool) error {
+	if err := m.setFolderPaused(folder, paused); err != nil {
+		return err
+	}
+
+	cfg, ok := m.cfg.Folders()[folder]
+	if !ok || cfg.Paused == paused {
+		return nil
+	}
+	cfg.Paused = paused
+	m.cfg.SetFolder(cfg)
+	return m.cfg.Save()
+}
+
+// setFolderPaused stops or starts the services of the folder as required by
+// the new paused state.
+func (m *Model) setFolderPaused(folder string, paused bool) error {
+	m.fmut.Lock()
+	cfg, ok := m.folderCfgs[folder]
+	if !ok {
+		m.fmut.Unlock()
+		return errors.New("no such folder")
+	}
+	if cfg.Paused == paused {
+		m.fmut.Unlock()
+		return nil
+	}
+	cfg.Paused = paused
+	m.folderCfgs[folder] = cfg
+	tokens := m.folderTokens[folder]
+	if paused {
+		delete(m.folderRunners, folder)
+		delete(m.folderTokens, folder)
+		// Deletions are found again when the folder is resumed, and so
+		// are files that were still changing.
+		delete(m.folderDeletions, folder)
+		if r, ok := m.folderUnstable[folder]; ok {
+			r.timer.Stop()
+			delete(m.folderUnstable, folder)
+		}
+	}
+	devices := m.folderDevices[folder]
+	m.fmut.Unlock()
+
+	if paused {
+		for _, token := range tokens {
+			m.Remove(token)
+		}
+		l.Infof("Folder %q was paused", folder)
+		events.Default.Log(events.FolderPaused, map[string]string{"folder": folder})
+	} else {
+		m.startFolder(folder)
+		l.Infof("Folder %q was resumed", folder)
+		events.Default.Log(events.FolderResumed, map[string]string{"folder": folder})
+	}
+
+	// Drop connections to the devices sharing the folder. When they
+	// reconnect they forget the index we sent previously for a paused folder,
+	// or get it sent again for a resumed one.
+	m.pmut.Lock()
+	for _, dev := range devices {
+		if conn, ok := m.conn[dev]; ok {
+			closeRawConn(conn)
+		}
+	}
+	m.pmut.Unlock()
+
+	return nil
+}
+
 func (m *Model) deviceStatRef(deviceID protocol.DeviceID) *stats.DeviceStatisticsReference {
 	m.fmut.Lock()
 	defer m.fmut.Unlock()
@@ -1028,7 +1327,7 @@ func (m *Model) receivedFile(folder string, file protocol.FileInfo) {
 	m.folderStatRef(folder).ReceivedFile(file.Name, file.IsDeleted())
 }
 
-func sendIndexes(conn protocol.Connection, folder string, fs *db.FileSet, ignores *ignore.Matcher) {
+func sendIndexes(conn protocol.Connection, folder string, fs *db.FileSet, ignores *ignore.Matcher, caps peerCapabilities, enc *folderEncryption) {
 	deviceID := conn.ID()
 	name := conn.Name()
 	var err error
@@ -1037,7 +1336,7 @@ func sendIndexes(conn protocol.Connection, folder string, fs *db.FileSet, ignore
 		l.Debugf("sendIndexes for %s-%s/%q starting", deviceID, name, folder)
 	}
 
-	minLocalVer, err := sendIndexTo(true, 0, conn, folder, fs, ignores)
+	minLocalVer, err := sendIndexTo(true, 0, conn, folder, fs, ignores, caps, enc)
 
 	sub := events.Default.Subscribe(events.LocalIndexUpdated)
 	defer events.Default.Unsubscribe(sub)
@@ -1052,7 +1351,7 @@ func sendIndexes(conn protocol.Connection, folder string, fs *db.FileSet, ignore
 			continue
 		}
 
-		minLocalVer, err = sendIndexTo(false, minLocalVer, conn, folder, fs, ignores)
+		minLocalVer, err = sendIndexTo(false, minLocalVer, conn, folder, fs, ignores, caps, enc)
 
 		// Wait a short amount of time before entering the next loop. If there
 		// are continous changes happening to the local index, this gives us
@@ -1065,7 +1364,7 @@ func sendIndexes(conn protocol.Connection, folder string, fs *db.FileSet, ignore
 	}
 }
 
-func sendIndexTo(initial bool, minLocalVer int64, conn protocol.Connection, folder string, fs *db.FileSet, ignores *ignore.Matcher) (int64, error) {
+func sendIndexTo(initial bool, minLocalVer int64, conn protocol.Connection, folder string, fs *db.FileSet, ignores *ignore.Matcher, caps peerCapabilities, enc *folderEncryption) (int64, error) {
 	deviceID := conn.ID()
 	name := conn.Name()
 	batch := make([]protocol.FileInfo, 0, indexBatchSize)
@@ -1073,23 +1372,11 @@ func sendIndexTo(initial bool, minLocalVer int64, conn protocol.Connection, fold
 	maxLocalVer := int64(0)
 	var err error
 
-	fs.WithHave(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
-		f := fi.(protocol.FileInfo)
-		if f.LocalVersion <= minLocalVer {
-			return true
-		}
-
-		if f.LocalVersion > maxLocalVer {
-			maxLocalVer = f.LocalVersion
-		}
-
-		if ignores.Match(f.Name) || symlinkInvalid(folder, f) {
-			if debug {
-				l.Debugln("not sending update for ignored/unsupported symlink", f)
-			}
-			return true
-		}
+	// Files that must be read to be encrypted for an untrusted device are
+	// encrypted after iterating, to not hold on to the database meanwhile.
+	var unencrypted []protocol.FileInfo
 
+	send := func(f protocol.FileInfo) bool {
 		if len(batch) == indexBatchSize || currentBatchSize > indexTargetSize {
 			if initial {
 				if err = conn.Index(folder, batch, 0, nil); err != nil {
@@ -1115,8 +1402,97 @@ func sendIndexTo(initial bool, minLocalVer int64, conn protocol.Connection, fold
 		batch = append(batch, f)
 		currentBatchSize += indexPerFileSize + len(f.Blocks)*indexPerBlockSize
 		return true
+	}
+
+	fs.WithHave(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
+		f := fi.(protocol.FileInfo)
+		if f.LocalVersion <= minLocalVer {
+			return true
+		}
+
+		if f.LocalVersion > maxLocalVer {
+			maxLocalVer = f.LocalVersion
+		}
+
+		if ignores.Match(f.Name) || symlinkInvalid(folder, f) {
+			if debug {
+				l.Debugln("not sending update for ignored/unsupported symlink", f)
+			}
+			return true
+		}
+
+		// Symlinks have no contents to encrypt, and their targets would
+		// leak in plain text.
+		if enc != nil && f.IsSymlink() {
+			if debug {
+				l.Debugln("not sending symlink to untrusted device", f)
+			}
+			return true
+		}
+
+		// Local changes in receive only folders are stored as invalid and
+		// announced as such. The flag itself is not part of the protocol.
+		f.Flags &^= protocol.FlagLocalChanged
+
+		// Older devices can't decode the weak hashes following the blocks.
+		if !caps.weakHashes {
+			for i := range f.Blocks {
+				f.Blocks[i].WeakHash = 0
+			}
+		}
+
+		// Nor can they decode files carrying ownership and extended
+		// attributes.
+		if !caps.posixMeta {
+			f.Flags &^= protocol.FlagPosixMeta
+			f.Posix = protocol.PosixMeta{}
+		}
+		if !caps.hardLinks {
+			f.Flags &^= protocol.FlagHardLink
+			f.HardLink = ""
+		}
+
+		// Likewise they can't handle blocks larger than the standard size.
+		// Such files are announced as invalid so that they are not
+		// requested from us.
+		if f.BlockSize() > caps.maxBlockSize {
+			f.Flags |= protocol.FlagInvalid
+		}
+
+		if enc != nil {
+			ef, ok := enc.cachedFileInfo(f)
+			if !ok {
+				unencrypted = append(unencrypted, f)
+				return true
+			}
+			f = encryptedForPeer(ef, caps)
+		}
+
+		return send(f)
 	})
 
+	// Untrusted devices get the encrypted file. One we can't encrypt,
+	// because it changed since it was scanned, is announced as invalid
+	// until the next scan.
+	for _, f := range unencrypted {
+		if err != nil {
+			break
+		}
+		ef, encErr := enc.encryptFileInfo(f)
+		if encErr != nil {
+			if debug {
+				l.Debugf("sendIndexes for %s-%s/%q: encrypting %q: %v", deviceID, name, folder, f.Name, encErr)
+			}
+			ef = protocol.FileInfo{
+				Name:         enc.encryptName(f.Name),
+				Flags:        protocol.FlagInvalid | protocol.FlagNoPermBits,
+				Version:      f.Version,
+				LocalVersion: f.LocalVersion,
+			}
+		}
+		send(encryptedForPeer(ef, caps))
+	}
+
 	if initial && err == nil {
 		err = conn.Index(folder, batch, 0, nil)
 		if debug && err == nil {
@@ -1132,6 +1508,19 @@ func sendIndexTo(initial bool, minLocalVer int64, conn protocol.Connection, fold
 	return maxLocalVer, err
 }
 
+// encryptedForPeer returns the encrypted file, announced as invalid if the
+// device can't handle its blocks.
+func encryptedForPeer(ef protocol.FileInfo, caps peerCapabilities) protocol.FileInfo {
+	for _, b := range ef.Blocks {
+		if int(b.Size) > caps.maxBlockSize {
+			ef.Flags |= protocol.FlagInvalid
+			ef.Blocks = nil
+			break
+		}
+	}
+	return ef
+}
+
 func (m *Model) updateLocals(folder string, fs []protocol.FileInfo) {
 	m.fmut.RLock()
 	files := m.folderFiles[folder]
@@ -1164,6 +1553,14 @@ func (m *Model) requestGlobal(deviceID protocol.DeviceID, folder, name string, o
 		l.Debugf("%v REQ(out): %s: %q / %q o=%d s=%d h=%x f=%x op=%s", m, deviceID, folder, name, offset, size, hash, flags, options)
 	}
 
+	if enc := m.untrustedEncryption(folder, deviceID); enc != nil {
+		f, ok := m.CurrentGlobalFile(folder, name)
+		if !ok {
+			return nil, protocol.ErrNoSuchFile
+		}
+		return enc.request(nc, f, offset, size)
+	}
+
 	return nc.Request(folder, name, offset, size, hash, flags, options)
 }
 
@@ -1175,12 +1572,25 @@ func (m *Model) AddFolder(cfg config.FolderConfiguration) {
 	m.fmut.Lock()
 	m.folderCfgs[cfg.ID] = cfg
 	m.folderFiles[cfg.ID] = db.NewFileSet(cfg.ID, m.db)
-
-	m.folderDevices[cfg.ID] = make([]protocol.DeviceID, len(cfg.Devices))
-	for i, device := range cfg.Devices {
-		m.folderDevices[cfg.ID][i] = device.DeviceID
+	m.folderFiles[cfg.ID].SetConflictResolver(conflictResolver(cfg))
+	m.folderScanLimits[cfg.ID] = newScanLimiter(cfg.MaxScanKiBs)
+
+	m.folderDevices[cfg.ID] = make([]protocol.DeviceID, 0, len(cfg.Devices))
+	var untrusted bool
+	for _, device := range cfg.Devices {
+		if device.Untrusted {
+			if cfg.EncryptionPassword == "" {
+				l.Warnf("Not sharing folder %q with untrusted device %v, as the folder has no encryption password", cfg.ID, device.DeviceID)
+				continue
+			}
+			untrusted = true
+		}
+		m.folderDevices[cfg.ID] = append(m.folderDevices[cfg.ID], device.DeviceID)
 		m.deviceFolders[device.DeviceID] = append(m.deviceFolders[device.DeviceID], cfg.ID)
 	}
+	if untrusted {
+		m.folderCrypto[cfg.ID] = newFolderEncryption(m.db, cfg)
+	}
 
 	ignores := ignore.New(m.cacheIgnoredFiles)
 	if err := ignores.Load(filepath.Join(cfg.Path(), ".stignore")); err != nil && !os.IsNotExist(err) {
@@ -1194,7 +1604,10 @@ func (m *Model) AddFolder(cfg config.FolderConfiguration) {
 func (m *Model) ScanFolders() map[string]error {
 	m.fmut.RLock()
 	folders := make([]string, 0, len(m.folderCfgs))
-	for folder := range m.folderCfgs {
+	for folder, cfg := range m.folderCfgs {
+		if cfg.Paused {
+			continue
+		}
 		folders = append(folders, folder)
 	}
 	m.fmut.RUnlock()
@@ -1236,8 +1649,13 @@ func (m *Model) ScanFolder(folder string) error {
 func (m *Model) ScanFolderSubs(folder string, subs []string) error {
 	m.fmut.Lock()
 	runner, ok := m.folderRunners[folder]
+	paused := m.folderCfgs[folder].Paused
 	m.fmut.Unlock()
 
+	if paused {
+		return errFolderPaused
+	}
+
 	// Folders are added to folderRunners only when they are started. We can't
 	// scan them before they have started, so that's what we need to check for
 	// here.
@@ -1271,6 +1689,15 @@ func (m *Model) internalScanFolderSubs(folder string, subs []string) error {
 		return errors.New("no such folder")
 	}
 
+	if folderCfg.SafeNames {
+		// Paths reported by the file system are as encoded on disk.
+		decoded := make([]string, len(subs))
+		for i := range subs {
+			decoded[i] = osutil.DecodeFilename(subs[i])
+		}
+		subs = decoded
+	}
+
 	if err := m.CheckFolderHealth(folder); err != nil {
 		runner.setError(err)
 		l.Infof("Stopping folder %s due to error: %s", folder, err)
@@ -1308,19 +1735,33 @@ nextSub:
 	}
 	subs = unifySubs
 
+	renames := newDirRenameFinder(m, folderCfg, ignores)
+	unstable := &unstableFiles{window: time.Duration(folderCfg.StableWindowS) * time.Second}
 	w := &scanner.Walker{
 		Folder:                folderCfg.ID,
 		Dir:                   folderCfg.Path(),
 		Subs:                  subs,
 		Matcher:               ignores,
 		BlockSize:             protocol.BlockSize,
+		UseLargeBlocks:        folderCfg.LargeBlocks,
 		TempNamer:             defTempNamer,
 		TempLifetime:          time.Duration(m.cfg.Options().KeepTemporariesH) * time.Hour,
 		CurrentFiler:          cFiler{m, folder},
+		Renames:               renames,
 		MtimeRepo:             db.NewVirtualMtimeRepo(m.db, folderCfg.ID),
 		IgnorePerms:           folderCfg.IgnorePerms,
+		Ownership:             folderCfg.SyncOwnership,
+		KeepOwnership:         folderCfg.SyncOwnership && !osutil.CanChown(),
+		Xattrs:                folderCfg.SyncXattrs,
+		HardLinks:             folderCfg.SyncHardLinks,
+		SafeNames:             folderCfg.SafeNames,
 		AutoNormalize:         folderCfg.AutoNormalize,
+		StableWindow:          unstable.window,
+		Unstable:              unstable,
 		Hashers:               m.numHashers(folder),
+		Limiter:               m.folderScanLimiter(folder),
+		LowPriority:           m.cfg.Options().ScanIdlePriority,
+		Walkers:               folderCfg.Walkers,
 		ShortID:               m.shortID,
 		ProgressTickIntervalS: folderCfg.ScanProgressIntervalS,
 	}
@@ -1355,9 +1796,13 @@ nextSub:
 			batch = batch[:0]
 			blocksHandled = 0
 		}
+		if folderCfg.ReceiveOnly {
+			f = markLocalChange(fs, f)
+		}
 		batch = append(batch, f)
 		blocksHandled += len(f.Blocks)
 	}
+	m.rescanUnstable(folder, unstable)
 
 	if err := m.CheckFolderHealth(folder); err != nil {
 		l.Infof("Stopping folder %s mid-scan due to folder error: %s", folder, err)
@@ -1367,6 +1812,7 @@ nextSub:
 	}
 
 	batch = batch[:0]
+	var deleted []protocol.FileInfo
 	// TODO: We should limit the Have scanning to start at sub
 	seenPrefix := false
 	var iterError error
@@ -1388,10 +1834,6 @@ nextSub:
 
 		seenPrefix = true
 		if !f.IsDeleted() {
-			if f.IsInvalid() {
-				return true
-			}
-
 			if len(batch) == batchSizeFiles {
 				if err := m.CheckFolderHealth(folder); err != nil {
 					iterError = err
@@ -1401,6 +1843,22 @@ nextSub:
 				batch = batch[:0]
 			}
 
+			localChanged := f.Flags&protocol.FlagLocalChanged != 0
+			if f.IsInvalid() && (!localChanged || !folderCfg.ReceiveOnly) {
+				if localChanged {
+					// The folder was receive only at some point but isn't
+					// any more. Clear the flag so that the file is picked
+					// up as a regular change on the next scan.
+					batch = append(batch, protocol.FileInfo{
+						Name:     f.Name,
+						Flags:    f.Flags &^ protocol.FlagLocalChanged,
+						Modified: f.Modified,
+						Version:  f.Version,
+					})
+				}
+				return true
+			}
+
 			if ignores.Match(f.Name) || symlinkInvalid(folder, f) {
 				// File has been ignored or an unsupported symlink. Set invalid bit.
 				if debug {
@@ -1413,7 +1871,7 @@ nextSub:
 					Version:  f.Version, // The file is still the same, so don't bump version
 				}
 				batch = append(batch, nf)
-			} else if _, err := osutil.Lstat(filepath.Join(folderCfg.Path(), f.Name)); err != nil {
+			} else if _, err := osutil.Lstat(folderCfg.FilePath(f.Name)); err != nil {
 				// File has been deleted.
 
 				// We don't specifically verify that the error is
@@ -1429,7 +1887,10 @@ nextSub:
 					Modified: f.Modified,
 					Version:  f.Version.Update(m.shortID),
 				}
-				batch = append(batch, nf)
+				if folderCfg.ReceiveOnly {
+					nf = markLocalChange(fs, nf)
+				}
+				deleted = append(deleted, nf)
 			}
 		}
 		return true
@@ -1447,6 +1908,35 @@ nextSub:
 		m.updateLocals(folder, batch)
 	}
 
+	updateDeleted := func(deleted []protocol.FileInfo) {
+		for len(deleted) > 0 {
+			n := len(deleted)
+			if n > batchSizeFiles {
+				n = batchSizeFiles
+			}
+			m.updateLocals(folder, deleted[:n])
+			deleted = deleted[n:]
+		}
+	}
+
+	// Files in renamed directories are still there under the new name.
+	// Deleting too many other files at once may well be a mistake, such as
+	// a disk that isn't mounted, so that has to be confirmed first.
+	var moved []protocol.FileInfo
+	kept := deleted[:0]
+	for _, f := range deleted {
+		if renames.renamed(f.Name) {
+			moved = append(moved, f)
+		} else {
+			kept = append(kept, f)
+		}
+	}
+	deleted = kept
+	updateDeleted(moved)
+	if !m.holdLocalDeletions(folder, deleted) {
+		updateDeleted(deleted)
+	}
+
 	runner.setState(FolderIdle)
 	return nil
 }
@@ -1500,6 +1990,22 @@ func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMe
 				Key:   "name",
 				Value: m.deviceName,
 			},
+			{
+				Key:   weakHashOption,
+				Value: weakHashRollsum,
+			},
+			{
+				Key:   maxBlockSizeOption,
+				Value: strconv.Itoa(protocol.MaxBlockSize),
+			},
+			{
+				Key:   posixMetaOption,
+				Value: "true",
+			},
+			{
+				Key:   hardLinkOption,
+				Value: "true",
+			},
 		},
 	}
 
@@ -1512,10 +2018,15 @@ func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMe
 			// DeviceID is a value type, but with an underlying array. Copy it
 			// so we don't grab aliases to the same array later on in device[:]
 			device := device
-			// TODO: Set read only bit when relevant
 			cn := protocol.Device{
-				ID:    device[:],
-				Flags: protocol.FlagShareTrusted,
+				ID: device[:],
+			}
+			fdc := m.folderDeviceLocked(folder, device)
+			if !fdc.Untrusted {
+				cn.Flags |= protocol.FlagShareTrusted
+			}
+			if fdc.ReadOnly {
+				cn.Flags |= protocol.FlagShareReadOnly
 			}
 			if deviceCfg := m.cfg.Devices()[device]; deviceCfg.Introducer {
 				cn.Flags |= protocol.FlagIntroducer
@@ -1532,7 +2043,11 @@ func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMe
 func (m *Model) State(folder string) (string, time.Time, error) {
 	m.fmut.RLock()
 	runner, ok := m.folderRunners[folder]
+	paused := m.folderCfgs[folder].Paused
 	m.fmut.RUnlock()
+	if paused {
+		return "paused", time.Time{}, nil
+	}
 	if !ok {
 		// The returned error should be an actual folder error, so returning
 		// errors.New("does not exist") or similar here would be
@@ -1548,7 +2063,7 @@ func (m *Model) Override(folder string) {
 	fs, ok := m.folderFiles[folder]
 	runner := m.folderRunners[folder]
 	m.fmut.RUnlock()
-	if !ok {
+	if !ok || runner == nil {
 		return
 	}
 
@@ -1582,6 +2097,201 @@ func (m *Model) Override(folder string) {
 	runner.setState(FolderIdle)
 }
 
+// Revert discards all local changes in a receive only folder. Files and
+// directories unknown to the cluster are removed, the rest are marked so
+// that the puller fetches the global version again.
+func (m *Model) Revert(folder string) error {
+	m.fmut.RLock()
+	fs, ok := m.folderFiles[folder]
+	cfg := m.folderCfgs[folder]
+	runner := m.folderRunners[folder]
+	m.fmut.RUnlock()
+	if cfg.Paused {
+		return errFolderPaused
+	}
+	if !ok || runner == nil {
+		return errors.New("no such folder")
+	}
+	if !cfg.ReceiveOnly {
+		return errors.New("folder is not receive only")
+	}
+
+	runner.setState(FolderScanning)
+	batch := make([]protocol.FileInfo, 0, indexBatchSize)
+	var dirs []protocol.FileInfo
+	fs.WithHave(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
+		f := fi.(protocol.FileInfo)
+		if f.Flags&protocol.FlagLocalChanged == 0 {
+			return true
+		}
+		if len(batch) == indexBatchSize {
+			m.updateLocals(folder, batch)
+			batch = batch[:0]
+		}
+
+		gf, ok := fs.GetGlobal(f.Name)
+		if ok && !gf.IsDeleted() {
+			// The cluster has a version of this file. Take on its version
+			// while staying invalid, so that the puller considers it needed
+			// but not in conflict.
+			f.Flags &^= protocol.FlagLocalChanged
+			f.Version = gf.Version
+			batch = append(batch, f)
+			return true
+		}
+
+		if f.IsDirectory() && !f.IsSymlink() {
+			// Directories are removed after their contents.
+			dirs = append(dirs, f)
+			return true
+		}
+
+		if err := revertRemove(cfg.FilePath(f.Name)); err != nil {
+			l.Infof("Revert (folder %q, file %q): %v", folder, f.Name, err)
+			return true
+		}
+		batch = append(batch, revertedDeleted(f, gf, ok))
+		return true
+	})
+
+	// WithHave is sorted, so children come after their parents.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		f := dirs[i]
+		if err := revertRemove(cfg.FilePath(f.Name)); err != nil {
+			l.Infof("Revert (folder %q, dir %q): %v", folder, f.Name, err)
+			continue
+		}
+		gf, ok := fs.GetGlobal(f.Name)
+		batch = append(batch, revertedDeleted(f, gf, ok))
+	}
+
+	if len(batch) > 0 {
+		m.updateLocals(folder, batch)
+	}
+	runner.setState(FolderIdle)
+
+	// Make sure the puller reevaluates what it needs.
+	runner.IndexUpdated()
+	return nil
+}
+
+func revertRemove(path string) error {
+	err := osutil.InWritableDir(osutil.Remove, path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// revertedDeleted returns the index entry for a reverted local change that
+// has been removed from disk: the global deleted version if there is one,
+// otherwise an invalid deleted entry that will never be announced.
+func revertedDeleted(f, gf protocol.FileInfo, haveGlobal bool) protocol.FileInfo {
+	if haveGlobal {
+		gf.Blocks = nil
+		gf.LocalVersion = 0
+		return gf
+	}
+	return protocol.FileInfo{
+		Name:     f.Name,
+		Flags:    (f.Flags | protocol.FlagDeleted | protocol.FlagInvalid) &^ protocol.FlagLocalChanged,
+		Modified: f.Modified,
+		Version:  f.Version,
+	}
+}
+
+// FolderErrors returns the errors for the files that could not be synced
+// in the last pull of the folder, and those found corrupt on disk.
+func (m *Model) FolderErrors(folder string) ([]fileError, error) {
+	m.fmut.RLock()
+	runner, ok := m.folderRunners[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, errors.New("no such folder")
+	}
+
+	errs := []fileError{}
+	if rf, ok := runner.(*rwFolder); ok {
+		errs = rf.currentErrors()
+	}
+	if corrupt := m.corruptErrors(folder); len(corrupt) > 0 {
+		errs = append(errs, corrupt...)
+		sort.Sort(fileErrorList(errs))
+	}
+	return errs, nil
+}
+
+// GetFolderVersions returns the archived versions of the files at or below
+// prefix in the folder, keyed by file name.
+func (m *Model) GetFolderVersions(folder, prefix string) (map[string][]versioner.FileVersion, error) {
+	m.fmut.RLock()
+	cfg, ok := m.folderCfgs[folder]
+	ver := m.folderVersioners[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, errors.New("no such folder")
+	}
+	if ver == nil {
+		return nil, errNoVersioner
+	}
+
+	path, err := folderSubPath(cfg.Path(), prefix)
+	if err != nil {
+		return nil, err
+	}
+	return ver.List(path)
+}
+
+// RestoreFolderVersions restores the given versions of files in the folder,
+// archiving the current files first. The returned map holds the error for
+// each file that could not be restored.
+func (m *Model) RestoreFolderVersions(folder string, versions map[string]time.Time) (map[string]string, error) {
+	m.fmut.RLock()
+	cfg, ok := m.folderCfgs[folder]
+	ver := m.folderVersioners[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, errors.New("no such folder")
+	}
+	if ver == nil {
+		return nil, errNoVersioner
+	}
+
+	errs := make(map[string]string)
+	var restored []string
+	for name, versionTime := range versions {
+		path, err := folderSubPath(cfg.Path(), name)
+		if err == nil {
+			err = ver.Restore(path, versionTime)
+		}
+		if err != nil {
+			l.Infof("Restoring %q in folder %q: %v", name, folder, err)
+			errs[name] = err.Error()
+			continue
+		}
+		restored = append(restored, osutil.NativeFilename(name))
+	}
+
+	if len(restored) > 0 {
+		// Pick up the restored files right away rather than waiting for the
+		// next rescan.
+		if err := m.ScanFolderSubs(folder, restored); err != nil {
+			return errs, err
+		}
+	}
+	return errs, nil
+}
+
+// folderSubPath returns the path of the named file in the folder, verifying
+// that it does not point outside of it.
+func folderSubPath(dir, name string) (string, error) {
+	path := filepath.Join(dir, osutil.NativeFilename(name))
+	if path != filepath.Clean(dir) && !strings.HasPrefix(path, filepath.Clean(dir)+string(filepath.Separator)) {
+		return "", errors.New("invalid subpath")
+	}
+	return path, nil
+}
+
 // CurrentLocalVersion returns the change version for the given folder.
 // This is guaranteed to increment if the contents of the local folder has
 // changed.
@@ -1824,10 +2534,8 @@ func (m *Model) CommitConfiguration(from, to config.Configuration) bool {
 				l.Debugln(m, "adding folder", folderID)
 			}
 			m.AddFolder(cfg)
-			if cfg.ReadOnly {
-				m.StartFolderRO(folderID)
-			} else {
-				m.StartFolderRW(folderID)
+			if !cfg.Paused {
+				m.startFolder(folderID)
 			}
 
 			// Drop connections to all devices that can now share the new
@@ -1852,6 +2560,17 @@ func (m *Model) CommitConfiguration(from, to config.Configuration) bool {
 			return false
 		}
 
+		// Pausing and resuming is handled without restart.
+		if fromCfg.Paused != toCfg.Paused {
+			m.setFolderPaused(folderID, toCfg.Paused)
+		}
+
+		// So is changing the scan rate limit, which applies to a scan in
+		// progress as well.
+		if fromCfg.MaxScanKiBs != toCfg.MaxScanKiBs {
+			m.setFolderScanRate(folderID, toCfg.MaxScanKiBs)
+		}
+
 		// This folder exists on both sides. Compare the device lists, as we
 		// can handle adding a device (but not currently removing one).
 
@@ -1891,9 +2610,12 @@ func (m *Model) CommitConfiguration(from, to config.Configuration) bool {
 			}
 		}
 
-		// Check if anything else differs, apart from the device list.
+		// Check if anything else differs, apart from the device list, the
+		// paused state and the scan rate limit.
 		fromCfg.Devices = nil
 		toCfg.Devices = nil
+		fromCfg.Paused = toCfg.Paused
+		fromCfg.MaxScanKiBs = toCfg.MaxScanKiBs
 		if !reflect.DeepEqual(fromCfg, toCfg) {
 			if debug {
 				l.Debugln(m, "requires restart, folder", folderID, "configuration differs")
@@ -1913,8 +2635,15 @@ func (m *Model) CommitConfiguration(from, to config.Configuration) bool {
 		}
 	}
 
-	// All of the generic options require restart
-	if !reflect.DeepEqual(from.Options, to.Options) {
+	// The scan rate limit and priority are changed without restart, the
+	// latter applying from the next scan.
+	m.scanLimit.setRate(to.Options.MaxScanKiBs)
+	fromOpts, toOpts := from.Options, to.Options
+	fromOpts.MaxScanKiBs = toOpts.MaxScanKiBs
+	fromOpts.ScanIdlePriority = toOpts.ScanIdlePriority
+
+	// All of the other generic options require restart
+	if !reflect.DeepEqual(fromOpts, toOpts) {
 		if debug {
 			l.Debugln(m, "requires restart, options differ")
 		}
@@ -1956,7 +2685,7 @@ func mapDeviceCfgs(devices []config.DeviceConfiguration) map[protocol.DeviceID]s
 
 func filterIndex(folder string, fs []protocol.FileInfo, dropDeletes bool) []protocol.FileInfo {
 	for i := 0; i < len(fs); {
-		if fs[i].Flags&^protocol.FlagsAll != 0 {
+		if fs[i].Flags&^(protocol.FlagsAll|protocol.FlagPosixMeta|protocol.FlagHardLink) != 0 {
 			if debug {
 				l.Debugln("dropping update for file with unknown bits set", fs[i])
 			}
@@ -1974,6 +2703,12 @@ func filterIndex(folder string, fs []protocol.FileInfo, dropDeletes bool) []prot
 			}
 			fs[i] = fs[len(fs)-1]
 			fs = fs[:len(fs)-1]
+		} else if fs[i].BlockSize() > protocol.MaxBlockSize {
+			if debug {
+				l.Debugln("dropping update for file with unsupported block size", fs[i])
+			}
+			fs[i] = fs[len(fs)-1]
+			fs = fs[:len(fs)-1]
 		} else {
 			i++
 		}
@@ -1981,6 +2716,55 @@ func filterIndex(folder string, fs []protocol.FileInfo, dropDeletes bool) []prot
 	return fs
 }
 
+// markReadOnlyChanges marks the files announced by a device the folder is
+// shared with read only as invalid, unless we already know of the same or a
+// newer version of them. What the device has is still known, but its
+// changes never become the global version.
+func markReadOnlyChanges(files *db.FileSet, fs []protocol.FileInfo) []protocol.FileInfo {
+	for i, f := range fs {
+		if gf, ok := files.GetGlobalTruncated(f.Name); ok && gf.Version.GreaterEqual(f.Version) {
+			continue
+		}
+		if debug {
+			l.Debugln("marking change from read only device invalid", f)
+		}
+		fs[i].Flags |= protocol.FlagInvalid
+	}
+	return fs
+}
+
+// markLocalChange flags a file scanned in a receive only folder as changed
+// locally, unless it matches the global version in which case it simply
+// takes on that version.
+func markLocalChange(fs *db.FileSet, f protocol.FileInfo) protocol.FileInfo {
+	gf, ok := fs.GetGlobal(f.Name)
+	switch {
+	case ok && sameContents(f, gf):
+		f.Flags &^= protocol.FlagInvalid | protocol.FlagLocalChanged
+		f.Version = gf.Version
+	case !ok && f.IsDeleted():
+		// Something we created locally is gone again. There is nothing to
+		// revert, but it must still not be announced.
+		f.Flags = (f.Flags | protocol.FlagInvalid) &^ protocol.FlagLocalChanged
+	default:
+		f.Flags |= protocol.FlagInvalid | protocol.FlagLocalChanged
+	}
+	return f
+}
+
+// sameContents returns true if the two files are of the same type and have
+// the same permissions and blocks.
+func sameContents(a, b protocol.FileInfo) bool {
+	const typeBits = protocol.FlagDeleted | protocol.FlagDirectory | protocol.FlagSymlink
+	if a.Flags&typeBits != b.Flags&typeBits {
+		return false
+	}
+	if a.HasPermissionBits() && b.HasPermissionBits() && !scanner.PermsEqual(a.Flags, b.Flags) {
+		return false
+	}
+	return scanner.BlocksEqual(a.Blocks, b.Blocks)
+}
+
 func symlinkInvalid(folder string, fi db.FileIntf) bool {
 	if !symlinks.Supported && fi.IsSymlink() && !fi.IsInvalid() && !fi.IsDeleted() {
 		symlinkWarning.Do(func() {
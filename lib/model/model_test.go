@@ -21,6 +21,8 @@ import (
 
 	"github.com/syncthing/syncthing/lib/config"
 	"github.com/syncthing/syncthing/lib/db"
+	"github.com/syncthing/syncthing/lib/events"
+	"github.com/syncthing/syncthing/lib/osutil"
 	"github.com/syncthing/syncthing/lib/protocol"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/storage"
@@ -151,7 +153,7 @@ func genFiles(n int) []protocol.FileInfo {
 		files[i] = protocol.FileInfo{
 			Name:     fmt.Sprintf("file%d", i),
 			Modified: t,
-			Blocks:   []protocol.BlockInfo{{0, 100, []byte("some hash bytes")}},
+			Blocks:   []protocol.BlockInfo{{Offset: 0, Size: 100, Hash: []byte("some hash bytes")}},
 		}
 	}
 
@@ -260,6 +262,17 @@ func (FakeConnection) Statistics() protocol.Statistics {
 	return protocol.Statistics{}
 }
 
+// An indexRecorder is a connection that passes on the indexes sent to it.
+type indexRecorder struct {
+	FakeConnection
+	indexes chan []protocol.FileInfo
+}
+
+func (r indexRecorder) Index(folder string, fs []protocol.FileInfo, flags uint32, options []protocol.Option) error {
+	r.indexes <- fs
+	return nil
+}
+
 func BenchmarkRequest(b *testing.B) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
 	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
@@ -274,7 +287,7 @@ func BenchmarkRequest(b *testing.B) {
 		files[i] = protocol.FileInfo{
 			Name:     fmt.Sprintf("file%d", i),
 			Modified: t,
-			Blocks:   []protocol.BlockInfo{{0, 100, []byte("some hash bytes")}},
+			Blocks:   []protocol.BlockInfo{{Offset: 0, Size: 100, Hash: []byte("some hash bytes")}},
 		}
 	}
 
@@ -1154,7 +1167,7 @@ func genDeepFiles(n, d int) []protocol.FileInfo {
 		}
 
 		files[i].Modified = t
-		files[i].Blocks = []protocol.BlockInfo{{0, 100, []byte("some hash bytes")}}
+		files[i].Blocks = []protocol.BlockInfo{{Offset: 0, Size: 100, Hash: []byte("some hash bytes")}}
 	}
 
 	return files
@@ -1226,3 +1239,636 @@ func TestIgnoreDelete(t *testing.T) {
 		t.Fatal("foo should not be marked for deletion")
 	}
 }
+
+func TestReadOnlyDevice(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+
+	// Changes from device1 should not be accepted
+	cfg := defaultFolderConfig.Copy()
+	cfg.Devices[0].ReadOnly = true
+
+	m.AddFolder(cfg)
+	m.ServeBackground()
+	m.StartFolderRW("default")
+	m.ScanFolder("default")
+
+	cm := m.clusterConfig(device1)
+	if cm.Folders[0].Devices[0].Flags&protocol.FlagShareReadOnly == 0 {
+		t.Error("Device1 should be flagged as read only")
+	}
+
+	// The device has the current version of foo, and a changed bar
+	foo, ok := m.CurrentGlobalFile("default", "foo")
+	if !ok {
+		t.Fatal("foo should exist")
+	}
+	bar, ok := m.CurrentGlobalFile("default", "bar")
+	if !ok {
+		t.Fatal("bar should exist")
+	}
+	barVersion := bar.Version
+	bar.Version = bar.Version.Update(142) // arbitrary short remote ID
+	bar.Modified++
+
+	m.AddConnection(Connection{
+		&net.TCPConn{},
+		FakeConnection{id: device1},
+		ConnectionTypeDirectAccept,
+	})
+	m.Index(device1, "default", []protocol.FileInfo{foo, bar}, 0, nil)
+
+	// Make sure we ignored the change but know what the device has
+	bar, ok = m.CurrentGlobalFile("default", "bar")
+	if !ok {
+		t.Fatal("bar should exist")
+	}
+	if !bar.Version.Equal(barVersion) {
+		t.Errorf("bar should not have been changed by read only device; version %v", bar.Version)
+	}
+	if av := m.Availability("default", "foo"); len(av) != 1 || av[0] != device1 {
+		t.Errorf("foo should be available from device1, not %v", av)
+	}
+	if av := m.Availability("default", "bar"); len(av) != 0 {
+		t.Errorf("bar should not be available from device1, not %v", av)
+	}
+}
+
+func TestReceiveOnlyRevert(t *testing.T) {
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+
+	fcfg := config.FolderConfiguration{
+		ID:          "default",
+		RawPath:     "testdata/recvonlyfolder",
+		ReceiveOnly: true,
+		Devices: []config.FolderDeviceConfiguration{
+			{
+				DeviceID: device1,
+			},
+		},
+	}
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{
+			{
+				DeviceID: device1,
+			},
+		},
+	})
+
+	os.RemoveAll(fcfg.RawPath)
+	defer os.RemoveAll(fcfg.RawPath)
+	if err := os.MkdirAll(fcfg.RawPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{".stfolder", "added", "remote"} {
+		if err := ioutil.WriteFile(filepath.Join(fcfg.RawPath, name), []byte("local"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(fcfg)
+	m.StartFolderRW("default")
+	m.ServeBackground()
+
+	remote := protocol.FileInfo{
+		Name:    "remote",
+		Flags:   0644,
+		Version: protocol.Vector{{ID: 42, Value: 1}},
+		Blocks:  []protocol.BlockInfo{{Size: 6, Hash: []byte("remote")}},
+	}
+	m.Index(device1, "default", []protocol.FileInfo{remote}, 0, nil)
+
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"added", "remote"} {
+		f, ok := m.CurrentFolderFile("default", name)
+		if !ok {
+			t.Fatalf("%s should exist locally", name)
+		}
+		if f.Flags&protocol.FlagLocalChanged == 0 || !f.IsInvalid() {
+			t.Errorf("%s should be an invalid local change, flags are 0%o", name, f.Flags)
+		}
+	}
+	if _, ok := m.CurrentGlobalFile("default", "added"); ok {
+		t.Error("local addition should not be part of the global index")
+	}
+	if gf, _ := m.CurrentGlobalFile("default", "remote"); !gf.Version.Equal(remote.Version) {
+		t.Errorf("local change should not affect the global version, got %v", gf.Version)
+	}
+
+	if err := m.Revert("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(fcfg.RawPath, "added")); !os.IsNotExist(err) {
+		t.Error("local addition should have been removed from disk")
+	}
+	f, _ := m.CurrentFolderFile("default", "added")
+	if !f.IsDeleted() || f.Flags&protocol.FlagLocalChanged != 0 {
+		t.Errorf("local addition should be deleted and no longer changed, flags are 0%o", f.Flags)
+	}
+	f, _ = m.CurrentFolderFile("default", "remote")
+	if f.Flags&protocol.FlagLocalChanged != 0 || !f.Version.Equal(remote.Version) {
+		t.Errorf("reverted file should await the global version, got flags 0%o version %v", f.Flags, f.Version)
+	}
+}
+
+func TestPauseFolder(t *testing.T) {
+	defer os.Remove("tmpconfig.xml")
+
+	cfg := config.Wrap("tmpconfig.xml", defaultConfig.Raw())
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+	m.StartFolderRO("default")
+	m.ServeBackground()
+	m.ScanFolder("default")
+
+	sub := events.Default.Subscribe(events.FolderPaused | events.FolderResumed)
+	defer events.Default.Unsubscribe(sub)
+
+	if err := m.PauseFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+	if !m.IsFolderPaused("default") || !cfg.Folders()["default"].Paused {
+		t.Error("folder should be paused in the model and the configuration")
+	}
+	if ev, err := sub.Poll(time.Second); err != nil || ev.Type != events.FolderPaused {
+		t.Errorf("expected FolderPaused event, got %v, %v", ev.Type, err)
+	}
+	if state, _, _ := m.State("default"); state != "paused" {
+		t.Errorf("unexpected state %q for paused folder", state)
+	}
+	if err := m.ScanFolder("default"); err != errFolderPaused {
+		t.Errorf("unexpected error %v scanning paused folder", err)
+	}
+	bs := make([]byte, 6)
+	if err := m.Request(device1, "default", "foo", 0, nil, 0, nil, bs); err != protocol.ErrNoSuchFile {
+		t.Errorf("unexpected error %v requesting from paused folder", err)
+	}
+	if _, ok := m.CurrentFolderFile("default", "foo"); !ok {
+		t.Error("paused folder should keep its index")
+	}
+
+	if err := m.ResumeFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+	if m.IsFolderPaused("default") || cfg.Folders()["default"].Paused {
+		t.Error("folder should not be paused after resume")
+	}
+	if ev, err := sub.Poll(time.Second); err != nil || ev.Type != events.FolderResumed {
+		t.Errorf("expected FolderResumed event, got %v, %v", ev.Type, err)
+	}
+	if err := m.ScanFolder("default"); err != nil {
+		t.Errorf("unexpected error %v scanning resumed folder", err)
+	}
+	if err := m.Request(device1, "default", "foo", 0, nil, 0, nil, bs); err != nil {
+		t.Errorf("unexpected error %v requesting from resumed folder", err)
+	}
+}
+
+func TestConflictResolution(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conflicts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.RawPath = dir
+	cfg := defaultConfig.Raw()
+	cfg.Folders = []config.FolderConfiguration{fcfg}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", cfg), protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.StartFolderRO("default")
+	m.ServeBackground()
+
+	ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte("theirs"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "file.sync-conflict-20150101-000000.txt"), []byte("mine"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "other.sync-conflict-20150101-000000.txt"), []byte("mine"), 0644)
+	m.ScanFolder("default")
+
+	sub := events.Default.Subscribe(events.ConflictCreated | events.ConflictResolved)
+	defer events.Default.Unsubscribe(sub)
+
+	local := protocol.Vector{{ID: device1.Short(), Value: 1}}
+	remote := protocol.Vector{{ID: protocol.LocalDeviceID.Short(), Value: 1}}
+	m.recordConflict("default", "file.txt", "file.sync-conflict-20150101-000000.txt", local, remote)
+	m.recordConflict("default", "other.txt", "other.sync-conflict-20150101-000000.txt", local, remote)
+	if ev, err := sub.Poll(time.Second); err != nil || ev.Type != events.ConflictCreated {
+		t.Errorf("expected ConflictCreated event, got %v, %v", ev.Type, err)
+	}
+
+	// A conflict copy removed by other means is no longer a conflict.
+	os.Remove(filepath.Join(dir, "other.sync-conflict-20150101-000000.txt"))
+
+	conflicts, err := m.Conflicts("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 {
+		t.Fatalf("expected one conflict, got %v", conflicts)
+	}
+	if c := conflicts[0]; c.Name != "file.txt" || c.Winner != protocol.LocalDeviceID || c.Loser != device1 {
+		t.Errorf("unexpected conflict %+v", c)
+	}
+
+	if err := m.ResolveConflict("default", "file.sync-conflict-20150101-000000.txt", "neither"); err == nil {
+		t.Error("unexpected nil error for invalid resolution")
+	}
+	if err := m.ResolveConflict("default", "file.sync-conflict-20150101-000000.txt", KeepMine); err != nil {
+		t.Fatal(err)
+	}
+	if bs, err := ioutil.ReadFile(filepath.Join(dir, "file.txt")); err != nil || string(bs) != "mine" {
+		t.Errorf("file should contain the conflict copy, got %q, %v", bs, err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "file.sync-conflict-20150101-000000.txt")); !os.IsNotExist(err) {
+		t.Error("conflict copy should be gone")
+	}
+	if f, ok := m.CurrentFolderFile("default", "file.sync-conflict-20150101-000000.txt"); !ok || !f.IsDeleted() {
+		t.Error("conflict copy should be deleted in the index")
+	}
+
+	for {
+		ev, err := sub.Poll(time.Second)
+		if err != nil {
+			t.Fatal("expected ConflictResolved event:", err)
+		}
+		if ev.Type == events.ConflictResolved {
+			break
+		}
+	}
+
+	if conflicts, _ := m.Conflicts("default"); len(conflicts) != 0 {
+		t.Errorf("unexpected conflicts %v after resolution", conflicts)
+	}
+	if err := m.ResolveConflict("default", "file.sync-conflict-20150101-000000.txt", KeepMine); err != errNoSuchConflict {
+		t.Errorf("unexpected error %v resolving resolved conflict", err)
+	}
+}
+
+func TestConflictResolverPreferDevice(t *testing.T) {
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.ConflictPolicy = config.ConflictPreferDevice
+	fcfg.ConflictPreferDevice = device2.String()
+	wins := conflictResolver(fcfg)
+
+	fromPreferred := protocol.FileInfo{
+		Name:     "file",
+		Modified: 1,
+		Version:  protocol.Vector{{ID: device2.Short(), Value: 1}},
+	}
+	newer := protocol.FileInfo{
+		Name:     "file",
+		Modified: 2,
+		Version:  protocol.Vector{{ID: device1.Short(), Value: 1}},
+	}
+
+	if !wins(fromPreferred, newer) || wins(newer, fromPreferred) {
+		t.Error("the change by the preferred device should win")
+	}
+	if wins := conflictResolver(defaultFolderConfig); wins(fromPreferred, newer) || !wins(newer, fromPreferred) {
+		t.Error("the newest change should win by default")
+	}
+}
+
+func TestHeldDeletions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deletions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{".stfolder", "a", "b", "c", "d"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.RawPath = dir
+	fcfg.MaxDeletes = 1
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: defaultConfig.Raw().Devices,
+	})
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.StartFolderRO("default")
+	m.ServeBackground()
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	sub := events.Default.Subscribe(events.DeletionsHeld)
+	defer events.Default.Unsubscribe(sub)
+
+	// The initial scan may still happen in the background, so the state is
+	// not settled right after ours.
+	waitFor := func(state string) error {
+		timeout := time.Now().Add(2 * time.Second)
+		for {
+			cur, _, _ := m.State("default")
+			if cur == state {
+				return nil
+			}
+			if time.Now().After(timeout) {
+				return fmt.Errorf("timed out waiting for state %s, current state %s", state, cur)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	removeAndScan := func(names ...string) {
+		for _, name := range names {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := m.ScanFolder("default"); err != nil {
+			t.Fatal(err)
+		}
+		if ev, err := sub.Poll(time.Second); err != nil {
+			t.Fatal("expected DeletionsHeld event:", err)
+		} else if n := ev.Data.(map[string]interface{})["local"]; n != len(names) {
+			t.Errorf("event reports %v held local deletions, expected %d", n, len(names))
+		}
+		if err := waitFor("needsConfirmation"); err != nil {
+			t.Error(err)
+		}
+		local, _, _ := m.HeldDeletions("default")
+		if len(local) != len(names) {
+			t.Errorf("held deletions %v, expected %v", local, names)
+		}
+		for _, name := range names {
+			if f, _ := m.CurrentFolderFile("default", name); f.IsDeleted() {
+				t.Errorf("deletion of %s should not be in the index before confirmation", name)
+			}
+		}
+	}
+
+	removeAndScan("a", "b")
+	if err := m.ApproveDeletions("default"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if f, _ := m.CurrentFolderFile("default", name); !f.IsDeleted() {
+			t.Errorf("approved deletion of %s should be in the index", name)
+		}
+	}
+	if err := waitFor("idle"); err != nil {
+		t.Error(err)
+	}
+
+	removeAndScan("c", "d")
+	if err := m.RejectDeletions("default"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"c", "d"} {
+		if f, _ := m.CurrentFolderFile("default", name); f.IsDeleted() || !f.IsInvalid() {
+			t.Errorf("rejected deletion of %s should leave it invalid, to be pulled again; flags are 0%o", name, f.Flags)
+		}
+	}
+	if err := m.RejectDeletions("default"); err != errNoHeldDeletions {
+		t.Errorf("unexpected error %v with no deletions held", err)
+	}
+}
+
+func TestScanDirRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dirrename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "old", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{".stfolder", filepath.Join("old", "a"), filepath.Join("old", "sub", "b")} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Moving files along with their directory is no mass deletion.
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.RawPath = dir
+	fcfg.MaxDeletes = 1
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: defaultConfig.Raw().Devices,
+	})
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.StartFolderRO("default")
+	m.ServeBackground()
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(filepath.Join(dir, "old"), filepath.Join(dir, "new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	if local, _, _ := m.HeldDeletions("default"); len(local) != 0 {
+		t.Errorf("renamed files should not be held as deleted: %v", local)
+	}
+	for _, name := range []string{"a", filepath.Join("sub", "b")} {
+		of, _ := m.CurrentFolderFile("default", filepath.Join("old", name))
+		nf, _ := m.CurrentFolderFile("default", filepath.Join("new", name))
+		if !of.IsDeleted() {
+			t.Errorf("%s should be deleted under the old name", name)
+		}
+		if nf.IsDeleted() || nf.Size() != int64(len(filepath.Join("old", name))) {
+			t.Errorf("%s should exist under the new name: %v", name, nf)
+		}
+	}
+}
+
+func TestScanUnstable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, ".stfolder"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.RawPath = dir
+	fcfg.StableWindowS = 1
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: defaultConfig.Raw().Devices,
+	})
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.StartFolderRO("default")
+	m.ServeBackground()
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("being written"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.CurrentFolderFile("default", "file"); ok {
+		t.Fatal("a file still changing should not be scanned")
+	}
+
+	// It's scanned by itself once it has settled.
+	timeout := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := m.CurrentFolderFile("default", "file"); ok {
+			break
+		}
+		if time.Now().After(timeout) {
+			t.Fatal("timed out waiting for the file to be scanned")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestScanRateWithoutRestart(t *testing.T) {
+	fcfg := defaultFolderConfig.Copy()
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: defaultConfig.Raw().Devices,
+	})
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	from := cfg.Raw().Copy()
+	to := from.Copy()
+	to.Folders[0].MaxScanKiBs = 100
+	to.Options.MaxScanKiBs = 200
+	to.Options.ScanIdlePriority = true
+	if !m.CommitConfiguration(from, to) {
+		t.Fatal("changing the scan rate should not require a restart")
+	}
+	if kibs := m.folderScanLimits["default"].kibs; kibs != 100 {
+		t.Errorf("folder scan rate is %d KiB/s, expected 100", kibs)
+	}
+	if kibs := m.scanLimit.kibs; kibs != 200 {
+		t.Errorf("global scan rate is %d KiB/s, expected 200", kibs)
+	}
+
+	from = to
+	to = from.Copy()
+	to.Options.MaxSendKbps = 100
+	if m.CommitConfiguration(from, to) {
+		t.Error("changing other options should still require a restart")
+	}
+}
+
+func TestIndexesAfterClusterConfig(t *testing.T) {
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.Devices = append(fcfg.Devices, config.FolderDeviceConfiguration{DeviceID: device2})
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}},
+	})
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.StartFolderRO("default")
+	m.ServeBackground()
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	weakHashes := func(device protocol.DeviceID, options []protocol.Option) bool {
+		conn := indexRecorder{FakeConnection{id: device}, make(chan []protocol.FileInfo, 1)}
+		m.AddConnection(Connection{&net.TCPConn{}, conn, ConnectionTypeDirectAccept})
+
+		// What we may send depends on what the other side supports, which
+		// we learn from its cluster config.
+		select {
+		case <-conn.indexes:
+			t.Fatal("index sent before the cluster config was received")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		m.ClusterConfig(device, protocol.ClusterConfigMessage{ClientName: "syncthing", Options: options})
+		select {
+		case fs := <-conn.indexes:
+			for _, f := range fs {
+				if f.Name == "foo" {
+					return f.Blocks[0].WeakHash != 0
+				}
+			}
+			t.Fatal("foo missing from the index")
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the index")
+		}
+		return false
+	}
+
+	if !weakHashes(device1, []protocol.Option{{Key: weakHashOption, Value: weakHashRollsum}}) {
+		t.Error("a device supporting weak hashes should be sent them")
+	}
+	if weakHashes(device2, nil) {
+		t.Error("a device not supporting weak hashes should not be sent them")
+	}
+}
+
+func TestScanSafeNamesSubs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sub := osutil.EncodeFilename("what?")
+	for _, name := range []string{".stfolder", sub} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.RawPath = dir
+	fcfg.SafeNames = true
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: defaultConfig.Raw().Devices,
+	})
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.StartFolderRO("default")
+	m.ServeBackground()
+
+	// Subdirectories are given as reported by the file system, and the
+	// caller's slice is left alone.
+	subs := []string{sub}
+	if err := m.ScanFolderSubs("default", subs); err != nil {
+		t.Fatal(err)
+	}
+	if subs[0] != sub {
+		t.Errorf("caller's subs changed to %q", subs[0])
+	}
+	if _, ok := m.CurrentFolderFile("default", "what?"); !ok {
+		t.Error("file should be scanned by its decoded name")
+	}
+}
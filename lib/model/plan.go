@@ -0,0 +1,201 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"errors"
+
+	"github.com/syncthing/syncthing/lib/db"
+	"github.com/syncthing/syncthing/lib/ignore"
+	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syncthing/syncthing/lib/scanner"
+)
+
+// A plannedAction is something the puller would do about a needed file.
+type plannedAction struct {
+	Action     string `json:"action"`             // create, update, rename, deleteFile, deleteDir or conflict
+	Name       string `json:"name"`               // the file the action is for
+	Type       string `json:"type"`               // file, dir or symlink
+	From       string `json:"from,omitempty"`     // the file or directory renamed
+	CopyBytes  int64  `json:"copyBytes"`          // data to copy from files we have
+	FetchBytes int64  `json:"fetchBytes"`         // data to fetch from other devices
+	Held       bool   `json:"held,omitempty"`     // the deletion would be held for confirmation
+	Discards   bool   `json:"discards,omitempty"` // a conflicting local change would be discarded, not kept as a conflict copy
+}
+
+// Plan returns what pulling the folder would do, without doing it. Paused
+// folders are planned for as well, to see what resuming them would do.
+func (m *Model) Plan(folder string) ([]plannedAction, error) {
+	m.fmut.RLock()
+	cfg, ok := m.folderCfgs[folder]
+	ignores := m.folderIgnores[folder]
+	versioner := m.folderVersioners[folder]
+	runner := m.folderRunners[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, errors.New("no such folder")
+	}
+	if cfg.ReadOnly {
+		return nil, errors.New("folder is read only")
+	}
+
+	p := newRWFolder(m, m.shortID, cfg)
+	p.pullTimer.Stop()
+	p.scanTimer.Stop()
+	p.versioner = versioner
+	return p.plan(ignores, folderCaseInsensitive(cfg, runner)), nil
+}
+
+// plan goes through the needed files making the same decisions as
+// pullerIteration, and returns the actions it would take. Whether the
+// folder is case insensitive is given, as finding out may require writing
+// to it.
+func (p *rwFolder) plan(ignores *ignore.Matcher, insensitive bool) []plannedAction {
+	p.model.fmut.RLock()
+	folderFiles := p.model.folderFiles[p.folder]
+	var folders []string
+	for folder := range p.model.folderCfgs {
+		folders = append(folders, folder)
+	}
+	p.model.fmut.RUnlock()
+
+	actions := []plannedAction{}
+
+	renamed := make(map[string]bool)
+	for _, r := range p.findDirRenames(folderFiles, ignores) {
+		if p.checkDirRename(&r, folderFiles) {
+			renamed[r.from] = true
+			renamed[r.to] = true
+			actions = append(actions, plannedAction{Action: "rename", Name: r.to, Type: "dir", From: r.from})
+		}
+	}
+
+	var queue []protocol.FileInfo
+	fileDeletions := map[string]protocol.FileInfo{}
+	dirDeletions := []protocol.FileInfo{}
+	buckets := renameBuckets{}
+
+	var collisions *caseCollisions
+	if insensitive {
+		collisions = p.caseCollisions(folderFiles)
+	}
+
+	folderFiles.WithNeed(protocol.LocalDeviceID, func(intf db.FileIntf) bool {
+		file := intf.(protocol.FileInfo)
+
+		switch p.decideNeeded(file, ignores, renamed, collisions) {
+		case neededDeleteFile:
+			fileDeletions[file.Name] = file
+			if df, ok := p.currentFile(file.Name); ok {
+				buckets.add(df)
+			}
+		case neededDeleteDir:
+			dirDeletions = append(dirDeletions, file)
+		case neededDir:
+			action := "update"
+			if cur, ok := p.currentFile(file.Name); !ok || cur.IsDeleted() {
+				action = "create"
+			}
+			actions = append(actions, plannedAction{Action: action, Name: file.Name, Type: "dir"})
+		case neededFile:
+			queue = append(queue, file)
+		}
+		return true
+	})
+
+	for _, f := range queue {
+		if candidate, ok := buckets.take(f); ok {
+			delete(fileDeletions, candidate.Name)
+			actions = append(actions, plannedAction{Action: "rename", Name: f.Name, Type: "file", From: candidate.Name})
+			continue
+		}
+		actions = append(actions, p.planFile(f, folders))
+	}
+
+	var deletions []protocol.FileInfo
+	for _, file := range fileDeletions {
+		deletions = append(deletions, file)
+	}
+	deletions = append(deletions, dirDeletions...)
+	held := len(deletions) > 0 && p.model.remoteDeletesExceeded(p.folder, deletions)
+
+	for _, file := range deletions {
+		if file.IsDirectory() {
+			continue
+		}
+		action := plannedAction{Action: "deleteFile", Name: file.Name, Type: fileType(file), Held: held}
+		if cur, ok := p.currentFile(file.Name); ok {
+			p.planConflict(&action, cur, file)
+		}
+		actions = append(actions, action)
+	}
+	for i := range dirDeletions {
+		dir := dirDeletions[len(dirDeletions)-i-1]
+		actions = append(actions, plannedAction{Action: "deleteDir", Name: dir.Name, Type: "dir", Held: held})
+	}
+
+	return actions
+}
+
+// planConflict marks the action for replacing or deleting the current file
+// as a conflict if it is one, by the conflict policy of the folder.
+func (p *rwFolder) planConflict(action *plannedAction, cur, file protocol.FileInfo) {
+	if !p.inConflict(cur.Version, file.Version) {
+		return
+	}
+	if !p.keepsConflictCopies() {
+		action.Discards = true
+		return
+	}
+	action.Action = "conflict"
+}
+
+// planFile returns what handleFile and the copiers would do about the file,
+// with the data that would be copied from blocks we have and fetched from
+// other devices.
+func (p *rwFolder) planFile(file protocol.FileInfo, folders []string) plannedAction {
+	action := plannedAction{Action: "update", Name: file.Name, Type: fileType(file)}
+	cur, ok := p.currentFile(file.Name)
+	switch {
+	case !ok || cur.IsDeleted():
+		action.Action = "create"
+	case !cur.IsDirectory() && !cur.IsSymlink():
+		// Directories and symlinks in the way are removed, never kept as
+		// conflict copies.
+		p.planConflict(&action, cur, file)
+	}
+
+	if ok && scanner.BlocksEqual(cur.Blocks, file.Blocks) {
+		// Only the metadata changes.
+		return action
+	}
+	for _, block := range file.Blocks {
+		if scanner.IsZeroBlock(block) {
+			continue
+		}
+		found := p.model.finder.Iterate(folders, block.Hash, func(string, string, int32, int) bool {
+			return true
+		})
+		if found {
+			action.CopyBytes += int64(block.Size)
+		} else {
+			action.FetchBytes += int64(block.Size)
+		}
+	}
+	return action
+}
+
+func fileType(f protocol.FileInfo) string {
+	switch {
+	case f.IsSymlink():
+		return "symlink"
+	case f.IsDirectory():
+		return "dir"
+	default:
+		return "file"
+	}
+}
@@ -16,6 +16,7 @@ import (
 
 type roFolder struct {
 	stateTracker
+	watchState
 
 	folder    string
 	intv      time.Duration
@@ -62,7 +63,8 @@ func (s *roFolder) Serve() {
 			return
 		}
 		// Sleep a random time between 3/4 and 5/4 of the configured interval.
-		sleepNanos := (s.intv.Nanoseconds()*3 + rand.Int63n(2*s.intv.Nanoseconds())) / 4
+		intv := s.rescanInterval(s.intv)
+		sleepNanos := (intv.Nanoseconds()*3 + rand.Int63n(2*intv.Nanoseconds())) / 4
 		s.timer.Reset(time.Duration(sleepNanos) * time.Nanosecond)
 	}
 
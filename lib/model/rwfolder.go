@@ -26,6 +26,7 @@ import (
 	"github.com/syncthing/syncthing/lib/symlinks"
 	"github.com/syncthing/syncthing/lib/sync"
 	"github.com/syncthing/syncthing/lib/versioner"
+	"github.com/syncthing/syncthing/lib/weakhash"
 )
 
 // TODO: Stop on errors
@@ -53,6 +54,13 @@ type copyBlocksState struct {
 // Which filemode bits to preserve
 const retainBits = os.ModeSetgid | os.ModeSetuid | os.ModeSticky
 
+// A block request taking hedgeFactor times as long as expected, and at least
+// minHedgeDelay, is also sent to another device.
+const (
+	hedgeFactor   = 4
+	minHedgeDelay = 2 * time.Second
+)
+
 var (
 	activity    = newDeviceActivity()
 	errNoDevice = errors.New("no available source device")
@@ -78,21 +86,36 @@ type dbUpdateJob struct {
 
 type rwFolder struct {
 	stateTracker
+	watchState
 
 	model            *Model
 	progressEmitter  *ProgressEmitter
 	virtualMtimeRepo *db.VirtualMtimeRepo
+	partialRepo      *db.PartialFileRepo
 
 	folder      string
 	dir         string
 	scanIntv    time.Duration
 	versioner   versioner.Versioner
 	ignorePerms bool
+	receiveOnly bool
+	ownership   bool
+	xattrs      bool
+	hardLinks   bool
+	safeNames   bool
 	copiers     int
 	pullers     int
 	shortID     uint64
 	order       config.PullOrder
 
+	conflictPolicy    config.ConflictPolicy
+	maxConflictCopies int
+
+	caseSensitivity config.CaseSensitivity
+	caseProbe       int32               // result of probing the folder, accessed atomically
+	caseNames       map[string][]string // global names by folded name
+	caseNamesVer    [2]int64            // local and remote versions caseNames is from
+
 	stop        chan struct{}
 	queue       *jobQueue
 	dbUpdates   chan dbUpdateJob
@@ -116,16 +139,27 @@ func newRWFolder(m *Model, shortID uint64, cfg config.FolderConfiguration) *rwFo
 		model:            m,
 		progressEmitter:  m.progressEmitter,
 		virtualMtimeRepo: db.NewVirtualMtimeRepo(m.db, cfg.ID),
+		partialRepo:      db.NewPartialFileRepo(m.db, cfg.ID),
 
 		folder:      cfg.ID,
 		dir:         cfg.Path(),
 		scanIntv:    time.Duration(cfg.RescanIntervalS) * time.Second,
 		ignorePerms: cfg.IgnorePerms,
+		receiveOnly: cfg.ReceiveOnly,
+		ownership:   cfg.SyncOwnership,
+		xattrs:      cfg.SyncXattrs,
+		hardLinks:   cfg.SyncHardLinks,
+		safeNames:   cfg.SafeNames,
 		copiers:     cfg.Copiers,
 		pullers:     cfg.Pullers,
 		shortID:     shortID,
 		order:       cfg.Order,
 
+		conflictPolicy:    cfg.ConflictPolicy,
+		maxConflictCopies: cfg.MaxConflictCopies,
+
+		caseSensitivity: cfg.CaseSensitivity,
+
 		stop:        make(chan struct{}),
 		queue:       newJobQueue(),
 		pullTimer:   time.NewTimer(shortPullIntv),
@@ -154,6 +188,48 @@ func (p *rwFolder) ignorePermissions(file protocol.FileInfo) bool {
 	return p.ignorePerms || file.Flags&protocol.FlagNoPermBits != 0
 }
 
+// applyPosixMeta sets the ownership and extended attributes of the file on
+// disk as announced, as far as the folder is set to sync them. Ownership is
+// only applied when we are privileged to do so.
+func (p *rwFolder) applyPosixMeta(path string, file protocol.FileInfo) error {
+	if file.Flags&protocol.FlagPosixMeta == 0 {
+		return nil
+	}
+	meta := file.Posix
+
+	if p.ownership && meta.Flags&protocol.PosixMetaOwnership != 0 && osutil.CanChown() {
+		uid, gid := osutil.LookupOwner(meta.User, meta.Group, int(meta.UID), int(meta.GID))
+		if err := os.Lchown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	if p.xattrs && meta.Flags&protocol.PosixMetaXattrs != 0 {
+		attrs := make(map[string][]byte, len(meta.Xattrs))
+		for _, x := range meta.Xattrs {
+			attrs[x.Name] = x.Value
+		}
+		if err := osutil.SetUserXattrs(path, attrs); err != nil && err != osutil.ErrXattrsUnsupported {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// diskName returns the name of the file on disk, relative to the folder.
+func (p *rwFolder) diskName(name string) string {
+	if p.safeNames {
+		return osutil.EncodeFilename(name)
+	}
+	return name
+}
+
+// diskPath returns the path of the file on disk.
+func (p *rwFolder) diskPath(name string) string {
+	return filepath.Join(p.dir, p.diskName(name))
+}
+
 // Serve will run scans and pulls. It will return when Stop()ed or on a
 // critical error.
 func (p *rwFolder) Serve() {
@@ -179,7 +255,8 @@ func (p *rwFolder) Serve() {
 		}
 
 		// Sleep a random time between 3/4 and 5/4 of the configured interval.
-		sleepNanos := (p.scanIntv.Nanoseconds()*3 + rand.Int63n(2*p.scanIntv.Nanoseconds())) / 4
+		scanIntv := p.rescanInterval(p.scanIntv)
+		sleepNanos := (scanIntv.Nanoseconds()*3 + rand.Int63n(2*scanIntv.Nanoseconds())) / 4
 		intv := time.Duration(sleepNanos) * time.Nanosecond
 
 		if debug {
@@ -276,6 +353,16 @@ func (p *rwFolder) Serve() {
 						curVer = lv
 					}
 					prevVer = curVer
+
+					// Files we refused to pull, such as those in case
+					// conflict, leave errors behind without changes.
+					if folderErrors := p.currentErrors(); len(folderErrors) > 0 {
+						events.Default.Log(events.FolderErrors, map[string]interface{}{
+							"folder": p.folder,
+							"errors": folderErrors,
+						})
+					}
+
 					if debug {
 						l.Debugln(p, "next pull in", nextPullIntv)
 					}
@@ -458,9 +545,27 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 
 	changed := 0
 
+	// Directories renamed on another device are renamed here in one go,
+	// instead of going through everything in them one by one.
+	renamed := make(map[string]bool)
+	for _, r := range p.findDirRenames(folderFiles, ignores) {
+		if n := p.renameDir(r, folderFiles); n > 0 {
+			renamed[r.from] = true
+			renamed[r.to] = true
+			changed += n
+		}
+	}
+
 	fileDeletions := map[string]protocol.FileInfo{}
 	dirDeletions := []protocol.FileInfo{}
-	buckets := map[string][]protocol.FileInfo{}
+	buckets := renameBuckets{}
+
+	// On case insensitive file systems, files with names differing only in
+	// case can't be told apart, so only one of them may be pulled.
+	var collisions *caseCollisions
+	if p.caseInsensitive() {
+		collisions = p.caseCollisions(folderFiles)
+	}
 
 	folderFiles.WithNeed(protocol.LocalDeviceID, func(intf db.FileIntf) bool {
 		// Needed items are delivered sorted lexicographically. We'll handle
@@ -469,8 +574,8 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 
 		file := intf.(protocol.FileInfo)
 
-		if ignores.Match(file.Name) {
-			// This is an ignored file. Skip it, continue iteration.
+		action := p.decideNeeded(file, ignores, renamed, collisions)
+		if action == neededSkip {
 			return true
 		}
 
@@ -478,31 +583,33 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 			l.Debugln(p, "handling", file.Name)
 		}
 
-		switch {
-		case file.IsDeleted():
-			// A deleted file, directory or symlink
+		switch action {
+		case neededRecordDelete:
+			if debug {
+				l.Debugln(p, "not deleting", file.Name, "with case twin")
+			}
+			jobType := dbUpdateDeleteFile
 			if file.IsDirectory() {
-				dirDeletions = append(dirDeletions, file)
-			} else {
-				fileDeletions[file.Name] = file
-				df, ok := p.model.CurrentFolderFile(p.folder, file.Name)
-				// Local file can be already deleted, but with a lower version
-				// number, hence the deletion coming in again as part of
-				// WithNeed, furthermore, the file can simply be of the wrong
-				// type if we haven't yet managed to pull it.
-				if ok && !df.IsDeleted() && !df.IsSymlink() && !df.IsDirectory() {
-					// Put files into buckets per first hash
-					key := string(df.Blocks[0].Hash)
-					buckets[key] = append(buckets[key], df)
-				}
+				jobType = dbUpdateDeleteDir
 			}
-		case file.IsDirectory() && !file.IsSymlink():
-			// A new or changed directory
+			p.dbUpdates <- dbUpdateJob{file, jobType}
+		case neededCaseConflict:
+			l.Infof("Puller (folder %q, file %q): %v", p.folder, file.Name, errCaseConflict)
+			p.newError(file.Name, errCaseConflict)
+			return true
+		case neededDeleteFile:
+			fileDeletions[file.Name] = file
+			if df, ok := p.currentFile(file.Name); ok {
+				buckets.add(df)
+			}
+		case neededDeleteDir:
+			dirDeletions = append(dirDeletions, file)
+		case neededDir:
 			if debug {
 				l.Debugln("Creating directory", file.Name)
 			}
 			p.handleDir(file)
-		default:
+		case neededFile:
 			// A new or changed file or symlink. This is the only case where we
 			// do stuff concurrently in the background
 			p.queue.Push(file.Name, file.Size(), file.Modified)
@@ -531,7 +638,6 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 
 	// Process the file queue
 
-nextFile:
 	for {
 		fileName, ok := p.queue.Pop()
 		if !ok {
@@ -545,32 +651,18 @@ nextFile:
 			continue
 		}
 
-		// Local file can be already deleted, but with a lower version
-		// number, hence the deletion coming in again as part of
-		// WithNeed, furthermore, the file can simply be of the wrong type if
-		// the global index changed while we were processing this iteration.
-		if !f.IsDeleted() && !f.IsSymlink() && !f.IsDirectory() {
-			key := string(f.Blocks[0].Hash)
-			for i, candidate := range buckets[key] {
-				if scanner.BlocksEqual(candidate.Blocks, f.Blocks) {
-					// Remove the candidate from the bucket
-					lidx := len(buckets[key]) - 1
-					buckets[key][i] = buckets[key][lidx]
-					buckets[key] = buckets[key][:lidx]
-
-					// candidate is our current state of the file, where as the
-					// desired state with the delete bit set is in the deletion
-					// map.
-					desired := fileDeletions[candidate.Name]
-					// Remove the pending deletion (as we perform it by renaming)
-					delete(fileDeletions, candidate.Name)
-
-					p.renameFile(desired, f)
-
-					p.queue.Done(fileName)
-					continue nextFile
-				}
-			}
+		if candidate, ok := buckets.take(f); ok {
+			// candidate is our current state of the file, where as the
+			// desired state with the delete bit set is in the deletion
+			// map.
+			desired := fileDeletions[candidate.Name]
+			// Remove the pending deletion (as we perform it by renaming)
+			delete(fileDeletions, candidate.Name)
+
+			p.renameFile(desired, f)
+
+			p.queue.Done(fileName)
+			continue
 		}
 
 		// Not a rename or a symlink, deal with it.
@@ -590,6 +682,21 @@ nextFile:
 	// Wait for the finisherChan to finish.
 	doneWg.Wait()
 
+	if len(fileDeletions)+len(dirDeletions) > 0 {
+		deletions := make([]protocol.FileInfo, 0, len(fileDeletions)+len(dirDeletions))
+		for _, file := range fileDeletions {
+			deletions = append(deletions, file)
+		}
+		deletions = append(deletions, dirDeletions...)
+		if !p.model.allowRemoteDeletions(p.folder, deletions) {
+			// Too many files would be deleted at once. They are left alone
+			// until confirmed, and don't count as changes meanwhile.
+			changed -= len(deletions)
+			fileDeletions = nil
+			dirDeletions = nil
+		}
+	}
+
 	for _, file := range fileDeletions {
 		if debug {
 			l.Debugln("Deleting file", file.Name)
@@ -612,6 +719,112 @@ nextFile:
 	return changed
 }
 
+// currentFile returns our current version of the file.
+func (p *rwFolder) currentFile(name string) (protocol.FileInfo, bool) {
+	return p.model.CurrentFolderFile(p.folder, name)
+}
+
+// isLocalChange returns true if we have a local change to the given file
+// that is not older than the needed version.
+func (p *rwFolder) isLocalChange(file protocol.FileInfo) bool {
+	cur, ok := p.model.CurrentFolderFile(p.folder, file.Name)
+	return ok && cur.Flags&protocol.FlagLocalChanged != 0 && cur.Version.GreaterEqual(file.Version)
+}
+
+// A neededAction is what the puller does about a needed file.
+type neededAction int
+
+const (
+	neededSkip         neededAction = iota // nothing, for now or for good
+	neededRecordDelete                     // the deletion is only recorded in the index
+	neededCaseConflict                     // refused, as it would replace a case twin
+	neededDeleteFile
+	neededDeleteDir
+	neededDir
+	neededFile // a file or symlink, queued to be pulled
+)
+
+// decideNeeded decides what to do about a needed file. It's what both
+// pullerIteration and plan go by. Items in renamed, or under them, are taken
+// care of by a directory rename, though the index may not say so yet.
+func (p *rwFolder) decideNeeded(file protocol.FileInfo, ignores *ignore.Matcher, renamed map[string]bool, collisions *caseCollisions) neededAction {
+	if len(renamed) > 0 {
+		isRenamed := func(dir string) bool {
+			return renamed[dir]
+		}
+		if _, ok := parentIn(file.Name, isRenamed); ok || renamed[file.Name] {
+			return neededSkip
+		}
+	}
+
+	if ignores.Match(file.Name) {
+		return neededSkip
+	}
+
+	if p.receiveOnly && p.isLocalChange(file) {
+		// This is a local change in a receive only folder that the
+		// cluster has not superseded. It stays until reverted.
+		return neededSkip
+	}
+
+	if collisions != nil {
+		if file.IsDeleted() && collisions.hasTwin(file.Name) && !p.onDiskAs(file.Name) {
+			// Removing the file would remove the one differing in case
+			// that we have on disk, so the deletion is only recorded.
+			return neededRecordDelete
+		}
+		if !file.IsDeleted() && !collisions.allow(file, p.currentFile) {
+			return neededCaseConflict
+		}
+	}
+
+	switch {
+	case file.IsDeleted() && file.IsDirectory():
+		return neededDeleteDir
+	case file.IsDeleted():
+		// A deleted file or symlink
+		return neededDeleteFile
+	case file.IsDirectory() && !file.IsSymlink():
+		return neededDir
+	default:
+		return neededFile
+	}
+}
+
+// renameBuckets holds the files about to be deleted by their first block
+// hash, as candidates for being renamed to needed files instead.
+type renameBuckets map[string][]protocol.FileInfo
+
+// add adds our current state of a file about to be deleted. Local file can
+// be already deleted, but with a lower version number, hence the deletion
+// coming in again as part of WithNeed, furthermore, the file can simply be
+// of the wrong type if we haven't yet managed to pull it.
+func (b renameBuckets) add(df protocol.FileInfo) {
+	if df.IsDeleted() || df.IsSymlink() || df.IsDirectory() {
+		return
+	}
+	key := string(df.Blocks[0].Hash)
+	b[key] = append(b[key], df)
+}
+
+// take returns and removes a file about to be deleted that has the same
+// blocks as the needed file, if there is one.
+func (b renameBuckets) take(f protocol.FileInfo) (protocol.FileInfo, bool) {
+	if f.IsDeleted() || f.IsSymlink() || f.IsDirectory() {
+		return protocol.FileInfo{}, false
+	}
+	key := string(f.Blocks[0].Hash)
+	for i, candidate := range b[key] {
+		if scanner.BlocksEqual(candidate.Blocks, f.Blocks) {
+			lidx := len(b[key]) - 1
+			b[key][i] = b[key][lidx]
+			b[key] = b[key][:lidx]
+			return candidate, true
+		}
+	}
+	return protocol.FileInfo{}, false
+}
+
 // handleDir creates or updates the given directory
 func (p *rwFolder) handleDir(file protocol.FileInfo) {
 	var err error
@@ -632,7 +845,7 @@ func (p *rwFolder) handleDir(file protocol.FileInfo) {
 		})
 	}()
 
-	realName := filepath.Join(p.dir, file.Name)
+	realName := p.diskPath(file.Name)
 	mode := os.FileMode(file.Flags & 0777)
 	if p.ignorePermissions(file) {
 		mode = 0777
@@ -680,6 +893,9 @@ func (p *rwFolder) handleDir(file protocol.FileInfo) {
 		}
 
 		if err = osutil.InWritableDir(mkdir, realName); err == nil {
+			err = p.applyPosixMeta(realName, file)
+		}
+		if err == nil {
 			p.dbUpdates <- dbUpdateJob{file, dbUpdateHandleDir}
 		} else {
 			l.Infof("Puller (folder %q, dir %q): %v", p.folder, file.Name, err)
@@ -697,7 +913,10 @@ func (p *rwFolder) handleDir(file protocol.FileInfo) {
 	// The directory already exists, so we just correct the mode bits. (We
 	// don't handle modification times on directories, because that sucks...)
 	// It's OK to change mode bits on stuff within non-writable directories.
-	if p.ignorePermissions(file) {
+	if err := p.applyPosixMeta(realName, file); err != nil {
+		l.Infof("Puller (folder %q, dir %q): %v", p.folder, file.Name, err)
+		p.newError(file.Name, err)
+	} else if p.ignorePermissions(file) {
 		p.dbUpdates <- dbUpdateJob{file, dbUpdateHandleDir}
 	} else if err := os.Chmod(realName, mode|(info.Mode()&retainBits)); err == nil {
 		p.dbUpdates <- dbUpdateJob{file, dbUpdateHandleDir}
@@ -726,7 +945,7 @@ func (p *rwFolder) deleteDir(file protocol.FileInfo) {
 		})
 	}()
 
-	realName := filepath.Join(p.dir, file.Name)
+	realName := p.diskPath(file.Name)
 	// Delete any temporary files lying around in the directory
 	dir, _ := os.Open(realName)
 	if dir != nil {
@@ -773,15 +992,16 @@ func (p *rwFolder) deleteFile(file protocol.FileInfo) {
 		})
 	}()
 
-	realName := filepath.Join(p.dir, file.Name)
+	realName := p.diskPath(file.Name)
 
 	cur, ok := p.model.CurrentFolderFile(p.folder, file.Name)
 	if ok && p.inConflict(cur.Version, file.Version) {
 		// There is a conflict here. Move the file to a conflict copy instead
 		// of deleting. Also merge with the version vector we had, to indicate
 		// we have resolved the conflict.
+		remote := file.Version
 		file.Version = file.Version.Merge(cur.Version)
-		err = osutil.InWritableDir(moveForConflict, realName)
+		err = p.moveForConflict(file.Name, cur.Version, remote)
 	} else if p.versioner != nil {
 		err = osutil.InWritableDir(p.versioner.Archive, realName)
 	} else {
@@ -840,8 +1060,8 @@ func (p *rwFolder) renameFile(source, target protocol.FileInfo) {
 		l.Debugln(p, "taking rename shortcut", source.Name, "->", target.Name)
 	}
 
-	from := filepath.Join(p.dir, source.Name)
-	to := filepath.Join(p.dir, target.Name)
+	from := p.diskPath(source.Name)
+	to := p.diskPath(target.Name)
 
 	if p.versioner != nil {
 		err = osutil.Copy(from, to)
@@ -980,17 +1200,43 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 	scanner.PopulateOffsets(file.Blocks)
 
 	// Figure out the absolute filenames we need once and for all
-	tempName := filepath.Join(p.dir, defTempNamer.TempName(file.Name))
-	realName := filepath.Join(p.dir, file.Name)
+	tempName := filepath.Join(p.dir, defTempNamer.TempName(p.diskName(file.Name)))
+	realName := p.diskPath(file.Name)
+
+	if p.hardLinks && file.Flags&protocol.FlagHardLink != 0 && p.linkTemp(file, tempName) {
+		// The temp file is a link to another file with the contents we
+		// want, so all that remains is to finish it.
+		if debug {
+			l.Debugf("%v linking %s to %s", p, file.Name, file.HardLink)
+		}
+		finisherChan <- &sharedPullerState{
+			file:        file,
+			folder:      p.folder,
+			tempName:    tempName,
+			realName:    realName,
+			reused:      len(file.Blocks),
+			ignorePerms: p.ignorePermissions(file),
+			version:     curFile.Version,
+			mut:         sync.NewMutex(),
+		}
+		return
+	}
 
 	reused := 0
 	var blocks []protocol.BlockInfo
 
-	// Check for an old temporary file which might have some blocks we could
-	// reuse.
-	tempBlocks, err := scanner.HashFile(tempName, protocol.BlockSize, 0, nil)
-	if err == nil {
-		// Check for any reusable blocks in the temp file
+	if done := p.resumableBlocks(file, tempName); done != nil {
+		// An earlier attempt was interrupted, and we know exactly which
+		// blocks it completed. There's no need to look at them again.
+		for i, block := range file.Blocks {
+			if _, ok := done[int32(i)]; !ok {
+				blocks = append(blocks, block)
+			}
+		}
+		reused = len(file.Blocks) - len(blocks)
+	} else if tempBlocks, err := scanner.HashFile(tempName, file.BlockSize(), 0, nil); err == nil {
+		// There is an old temporary file which might have some blocks we
+		// could reuse. Check for any reusable blocks in the temp file.
 		tempCopyBlocks, _ := scanner.BlockDiff(tempBlocks, file.Blocks)
 
 		// block.String() returns a string unique to the block
@@ -1016,7 +1262,21 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 			// file which already exists
 			osutil.InWritableDir(osutil.Remove, tempName)
 		}
+
+		// Remember the blocks we just verified, so we don't have to do it
+		// again if we are interrupted.
+		if p.partialRepo != nil {
+			p.partialRepo.Remove(file.Name)
+			var reusedIdx []int32
+			for _, block := range tempCopyBlocks {
+				reusedIdx = append(reusedIdx, blockIndex(file, block))
+			}
+			p.partialRepo.Add(file.Name, file.Version, reusedIdx)
+		}
 	} else {
+		if p.partialRepo != nil {
+			p.partialRepo.Remove(file.Name)
+		}
 		blocks = file.Blocks
 	}
 
@@ -1030,6 +1290,7 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 		reused:      reused,
 		ignorePerms: p.ignorePermissions(file),
 		version:     curFile.Version,
+		partials:    p.partialRepo,
 		mut:         sync.NewMutex(),
 	}
 
@@ -1044,10 +1305,82 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 	copyChan <- cs
 }
 
+// linkTemp creates the temp file as a hard link to the file the given one
+// is linked to, if we have that one with the same contents. It returns
+// false if the file should be pulled as usual instead, which is also the
+// case when the linked file has yet to be pulled itself.
+func (p *rwFolder) linkTemp(file protocol.FileInfo, tempName string) bool {
+	target, ok := p.model.CurrentFolderFile(p.folder, file.HardLink)
+	if !ok || target.IsDeleted() || target.IsInvalid() || target.IsDirectory() || target.IsSymlink() || !scanner.BlocksEqual(target.Blocks, file.Blocks) {
+		return false
+	}
+
+	// The file on disk must still be the one we know, or we'd be linking
+	// to other contents.
+	targetName := p.diskPath(target.Name)
+	info, err := osutil.Lstat(targetName)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != target.Size() ||
+		p.virtualMtimeRepo.GetMtime(target.Name, info.ModTime()).Unix() != target.Modified {
+		return false
+	}
+
+	osutil.InWritableDir(osutil.Remove, tempName)
+	err = osutil.InWritableDir(func(path string) error {
+		return os.Link(targetName, path)
+	}, tempName)
+	if err != nil {
+		if debug {
+			l.Debugln(p, "link", file.Name, "to", target.Name, err)
+		}
+		return false
+	}
+
+	if p.partialRepo != nil {
+		p.partialRepo.Remove(file.Name)
+	}
+	return true
+}
+
+// resumableBlocks returns the set of blocks of the file that are recorded as
+// complete in the temporary file, or nil if there is no usable record.
+func (p *rwFolder) resumableBlocks(file protocol.FileInfo, tempName string) map[int32]struct{} {
+	if p.partialRepo == nil {
+		return nil
+	}
+	indexes := p.partialRepo.Blocks(file.Name, file.Version)
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	// The temp file must still be there for the record to apply to it. Its
+	// size proves nothing, as it is truncated to the full size when created,
+	// so beyond that the record is trusted as long as the version matches.
+	last := indexes[len(indexes)-1]
+	info, err := osutil.Lstat(tempName)
+	if err != nil || !info.Mode().IsRegular() || int(last) >= len(file.Blocks) {
+		p.partialRepo.Remove(file.Name)
+		return nil
+	}
+
+	done := make(map[int32]struct{}, len(indexes))
+	for _, idx := range indexes {
+		done[idx] = struct{}{}
+	}
+	if debug {
+		l.Debugf("%v resuming %s with %d of %d blocks done", p, file.Name, len(done), len(file.Blocks))
+	}
+	return done
+}
+
 // shortcutFile sets file mode and modification time, when that's the only
 // thing that has changed.
 func (p *rwFolder) shortcutFile(file protocol.FileInfo) error {
-	realName := filepath.Join(p.dir, file.Name)
+	realName := p.diskPath(file.Name)
+	if err := p.applyPosixMeta(realName, file); err != nil {
+		l.Infof("Puller (folder %q, file %q): shortcut: %v", p.folder, file.Name, err)
+		p.newError(file.Name, err)
+		return err
+	}
 	if !p.ignorePermissions(file) {
 		if err := os.Chmod(realName, os.FileMode(file.Flags&0777)); err != nil {
 			l.Infof("Puller (folder %q, file %q): shortcut: chmod: %v", p.folder, file.Name, err)
@@ -1084,7 +1417,7 @@ func (p *rwFolder) shortcutSymlink(file protocol.FileInfo) (err error) {
 	if file.IsDirectory() {
 		tt = symlinks.TargetDirectory
 	}
-	err = symlinks.ChangeType(filepath.Join(p.dir, file.Name), tt)
+	err = symlinks.ChangeType(p.diskPath(file.Name), tt)
 	if err != nil {
 		l.Infof("Puller (folder %q, file %q): symlink shortcut: %v", p.folder, file.Name, err)
 		p.newError(file.Name, err)
@@ -1109,24 +1442,43 @@ func (p *rwFolder) copierRoutine(in <-chan copyBlocksState, pullChan chan<- pull
 			p.progressEmitter.Register(state.sharedPullerState)
 		}
 
-		folderRoots := make(map[string]string)
+		folderCfgs := make(map[string]config.FolderConfiguration)
 		var folders []string
 		p.model.fmut.RLock()
 		for folder, cfg := range p.model.folderCfgs {
-			folderRoots[folder] = cfg.Path()
+			folderCfgs[folder] = cfg
 			folders = append(folders, folder)
 		}
 		p.model.fmut.RUnlock()
 
+		// The weak hash finder reads through the existing file, so it's only
+		// set up once there is a block that isn't found otherwise.
+		var weakFinder *weakhash.Finder
+		weakFinderTried := false
+
 		for _, block := range state.blocks {
+			if scanner.IsZeroBlock(block) {
+				// Blocks of zeroes are left as holes in the temp file,
+				// there's no need to copy or pull them.
+				if err := state.zeroBlock(block); err != nil {
+					state.fail("dst zero", err)
+					break
+				}
+				state.copyDone(block)
+				continue
+			}
+
+			if cap(buf) < int(block.Size) {
+				buf = make([]byte, block.Size)
+			}
 			buf = buf[:int(block.Size)]
-			found := p.model.finder.Iterate(folders, block.Hash, func(folder, file string, index int32) bool {
-				fd, err := os.Open(filepath.Join(folderRoots[folder], file))
+			found := p.model.finder.Iterate(folders, block.Hash, func(folder, file string, index int32, blockSize int) bool {
+				fd, err := os.Open(folderCfgs[folder].FilePath(file))
 				if err != nil {
 					return false
 				}
 
-				_, err = fd.ReadAt(buf, protocol.BlockSize*int64(index))
+				_, err = fd.ReadAt(buf, int64(blockSize)*int64(index))
 				fd.Close()
 				if err != nil {
 					return false
@@ -1138,7 +1490,7 @@ func (p *rwFolder) copierRoutine(in <-chan copyBlocksState, pullChan chan<- pull
 						if debug {
 							l.Debugf("Finder block mismatch in %s:%s:%d expected %q got %q", folder, file, index, block.Hash, hash)
 						}
-						err = p.model.finder.Fix(folder, file, index, block.Hash, hash)
+						err = p.model.finder.Fix(folder, file, index, blockSize, block.Hash, hash)
 						if err != nil {
 							l.Warnln("finder fix:", err)
 						}
@@ -1158,6 +1510,27 @@ func (p *rwFolder) copierRoutine(in <-chan copyBlocksState, pullChan chan<- pull
 				return true
 			})
 
+			if !found && block.WeakHash != 0 && state.failed() == nil {
+				if !weakFinderTried {
+					weakFinder = p.newWeakFinder(state)
+					weakFinderTried = true
+				}
+				found, err = weakFinder.Iterate(block.WeakHash, buf, func(offset int64) bool {
+					if _, err := scanner.VerifyBuffer(buf, block); err != nil {
+						return false
+					}
+
+					if _, err := dstFd.WriteAt(buf, block.Offset); err != nil {
+						state.fail("dst write", err)
+					}
+					state.copiedFromOrigin()
+					return true
+				})
+				if err != nil && debug {
+					l.Debugln("Weak hash finder failed:", err)
+				}
+			}
+
 			if state.failed() != nil {
 				break
 			}
@@ -1170,13 +1543,41 @@ func (p *rwFolder) copierRoutine(in <-chan copyBlocksState, pullChan chan<- pull
 				}
 				pullChan <- ps
 			} else {
-				state.copyDone()
+				state.copyDone(block)
 			}
 		}
+		weakFinder.Close()
 		out <- state.sharedPullerState
 	}
 }
 
+// newWeakFinder returns a finder for blocks of the file that have moved to
+// other offsets in the existing version of it, or nil if there is no such
+// version.
+func (p *rwFolder) newWeakFinder(state copyBlocksState) *weakhash.Finder {
+	blockSize := state.file.BlockSize()
+	var hashes []uint32
+	for _, block := range state.blocks {
+		// Only full blocks are looked for, as the finder works with a fixed
+		// window size.
+		if block.WeakHash != 0 && int(block.Size) == blockSize {
+			hashes = append(hashes, block.WeakHash)
+		}
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	finder, err := weakhash.NewFinder(state.realName, blockSize, hashes)
+	if err != nil {
+		if debug && !os.IsNotExist(err) {
+			l.Debugln("Weak hash finder:", err)
+		}
+		return nil
+	}
+	return finder
+}
+
 func (p *rwFolder) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPullerState) {
 	for state := range in {
 		if state.failed() != nil {
@@ -1193,60 +1594,118 @@ func (p *rwFolder) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPul
 			continue
 		}
 
-		var lastError error
-		potentialDevices := p.model.Availability(p.folder, state.file.Name)
-		for {
-			// Select the least busy device to pull the block from. If we found no
-			// feasible device at all, fail the block (and in the long run, the
-			// file).
-			selected := activity.leastBusy(potentialDevices)
-			if selected == (protocol.DeviceID{}) {
-				if lastError != nil {
-					state.fail("pull", lastError)
-				} else {
-					state.fail("pull", errNoDevice)
-				}
-				break
-			}
+		buf, err := p.pullBlock(state)
+		if err != nil {
+			state.fail("pull", err)
+		} else if _, err = fd.WriteAt(buf, state.block.Offset); err != nil {
+			// Save the block data we got from the cluster
+			state.fail("save", err)
+		} else {
+			state.pullDone(state.block)
+		}
+		out <- state.sharedPullerState
+	}
+}
 
-			potentialDevices = removeDevice(potentialDevices, selected)
+// A blockResult is the outcome of requesting a block from a device.
+type blockResult struct {
+	device protocol.DeviceID
+	buf    []byte
+	err    error
+}
 
-			// Fetch the block, while marking the selected device as in use so that
-			// leastBusy can select another device when someone else asks.
-			activity.using(selected)
-			buf, lastError := p.model.requestGlobal(selected, p.folder, state.file.Name, state.block.Offset, int(state.block.Size), state.block.Hash, 0, nil)
-			activity.done(selected)
-			if lastError != nil {
-				if debug {
-					l.Debugln("request:", p.folder, state.file.Name, state.block.Offset, state.block.Size, "returned error:", lastError)
-				}
-				continue
+// pullBlock fetches the block from the devices that have it, trying the one
+// expected to serve it soonest first. Should a request take much longer than
+// expected, the block is requested from the next best device as well, and
+// the first correct answer wins. Failed requests are retried on other
+// devices until there are none left.
+func (p *rwFolder) pullBlock(state pullBlockState) ([]byte, error) {
+	potentialDevices := p.model.Availability(p.folder, state.file.Name)
+
+	// Buffered, so that requests still running when we return don't block.
+	results := make(chan blockResult, len(potentialDevices))
+	outstanding := 0
+
+	hedge := time.NewTimer(time.Hour)
+	hedge.Stop()
+	defer hedge.Stop()
+
+	// request starts a request to the most promising device not tried yet,
+	// and returns false if there is no such device.
+	request := func() bool {
+		selected := activity.leastBusy(potentialDevices)
+		if selected == (protocol.DeviceID{}) {
+			return false
+		}
+		potentialDevices = removeDevice(potentialDevices, selected)
+		outstanding++
+
+		delay := hedgeFactor * activity.expected(selected, int(state.block.Size))
+		if delay < minHedgeDelay {
+			delay = minHedgeDelay
+		}
+		if !hedge.Stop() {
+			select {
+			case <-hedge.C:
+			default:
 			}
+		}
+		hedge.Reset(delay)
 
-			// Verify that the received block matches the desired hash, if not
-			// try pulling it from another device.
-			_, lastError = scanner.VerifyBuffer(buf, state.block)
-			if lastError != nil {
-				if debug {
-					l.Debugln("request:", p.folder, state.file.Name, state.block.Offset, state.block.Size, "hash mismatch")
-				}
-				continue
+		// Mark the selected device as in use before the next selection, so
+		// that leastBusy can select another device when someone else asks.
+		activity.using(selected)
+		go func() {
+			t0 := time.Now()
+			buf, err := p.model.requestGlobal(selected, p.folder, state.file.Name, state.block.Offset, int(state.block.Size), state.block.Hash, 0, nil)
+			if err == nil {
+				// Verify that the received block matches the desired hash, if
+				// not try pulling it from another device.
+				_, err = scanner.VerifyBuffer(buf, state.block)
+			}
+			activity.record(selected, int(state.block.Size), time.Since(t0), err)
+			activity.done(selected)
+			results <- blockResult{selected, buf, err}
+		}()
+		return true
+	}
+
+	if !request() {
+		return nil, errNoDevice
+	}
+
+	var lastError error
+	for {
+		select {
+		case res := <-results:
+			outstanding--
+			if res.err == nil {
+				return res.buf, nil
+			}
+			if debug {
+				l.Debugln("request:", p.folder, state.file.Name, state.block.Offset, state.block.Size, "from", res.device, "returned error:", res.err)
+			}
+			lastError = res.err
+			if outstanding == 0 && !request() {
+				return nil, lastError
 			}
 
-			// Save the block data we got from the cluster
-			_, err = fd.WriteAt(buf, state.block.Offset)
-			if err != nil {
-				state.fail("save", err)
-			} else {
-				state.pullDone()
+		case <-hedge.C:
+			if debug {
+				l.Debugln("request:", p.folder, state.file.Name, state.block.Offset, state.block.Size, "is slow, asking another device")
 			}
-			break
+			request()
 		}
-		out <- state.sharedPullerState
 	}
 }
 
 func (p *rwFolder) performFinish(state *sharedPullerState) error {
+	// Set the ownership and extended attributes first, as changing the
+	// owner may clear some permission bits
+	if err := p.applyPosixMeta(state.tempName, state.file); err != nil {
+		return err
+	}
+
 	// Set the correct permission bits on the new file
 	if !p.ignorePermissions(state.file) {
 		if err := os.Chmod(state.tempName, os.FileMode(state.file.Flags&0777)); err != nil {
@@ -1289,8 +1748,9 @@ func (p *rwFolder) performFinish(state *sharedPullerState) error {
 			// archiving. Also merge with the version vector we had, to indicate
 			// we have resolved the conflict.
 
+			remote := state.file.Version
 			state.file.Version = state.file.Version.Merge(state.version)
-			if err = osutil.InWritableDir(moveForConflict, state.realName); err != nil {
+			if err = p.moveForConflict(state.file.Name, state.version, remote); err != nil {
 				return err
 			}
 
@@ -1309,6 +1769,9 @@ func (p *rwFolder) performFinish(state *sharedPullerState) error {
 	if err := osutil.Rename(state.tempName, state.realName); err != nil {
 		return err
 	}
+	if p.partialRepo != nil {
+		p.partialRepo.Remove(state.file.Name)
+	}
 
 	// If it's a symlink, the target of the symlink is inside the file.
 	if state.file.IsSymlink() {
@@ -1465,6 +1928,12 @@ func (p *rwFolder) inConflict(current, replacement protocol.Vector) bool {
 	return false
 }
 
+// keepsConflictCopies returns true if the local version of a file in
+// conflict is moved aside to a conflict copy, rather than discarded.
+func (p *rwFolder) keepsConflictCopies() bool {
+	return p.conflictPolicy != config.ConflictNoCopies
+}
+
 func invalidateFolder(cfg *config.Configuration, folderID string, err error) {
 	for i := range cfg.Folders {
 		folder := &cfg.Folders[i]
@@ -1485,19 +1954,67 @@ func removeDevice(devices []protocol.DeviceID, device protocol.DeviceID) []proto
 	return devices
 }
 
-func moveForConflict(name string) error {
-	ext := filepath.Ext(name)
-	withoutExt := name[:len(name)-len(ext)]
-	newName := withoutExt + time.Now().Format(".sync-conflict-20060102-150405") + ext
-	err := os.Rename(name, newName)
+// moveForConflict moves the named file aside to a conflict copy, as the
+// local version of it is in conflict with the remote one that replaces it,
+// and records the conflict. With the noCopies policy the local version is
+// archived or removed instead.
+func (p *rwFolder) moveForConflict(name string, local, remote protocol.Vector) error {
+	realName := p.diskPath(name)
+	var err error
+	if !p.keepsConflictCopies() {
+		if p.versioner != nil {
+			err = osutil.InWritableDir(p.versioner.Archive, realName)
+		} else {
+			err = osutil.InWritableDir(osutil.Remove, realName)
+		}
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	newName := conflictName(name, time.Now(), conflictDevice(local, remote))
+	err = osutil.InWritableDir(func(path string) error {
+		return os.Rename(path, p.diskPath(newName))
+	}, realName)
 	if os.IsNotExist(err) {
 		// We were supposed to move a file away but it does not exist. Either
 		// the user has already moved it away, or the conflict was between a
 		// remote modification and a local delete. In either way it does not
 		// matter, go ahead as if the move succeeded.
 		return nil
+	} else if err != nil {
+		return err
+	}
+
+	p.model.recordConflict(p.folder, name, newName, local, remote)
+
+	if p.maxConflictCopies > 0 {
+		p.removeOldConflictCopies(name)
+	}
+	return nil
+}
+
+// removeOldConflictCopies removes the oldest conflict copies of the named
+// file, keeping at most the configured number.
+func (p *rwFolder) removeOldConflictCopies(name string) {
+	copies, err := conflictCopies(p.dir, p.diskName(name))
+	if err != nil {
+		l.Infof("Puller (folder %q, file %q): listing conflict copies: %v", p.folder, name, err)
+		return
+	}
+	if len(copies) <= p.maxConflictCopies {
+		return
+	}
+
+	for _, copy := range copies[:len(copies)-p.maxConflictCopies] {
+		if debug {
+			l.Debugln(p, "removing old conflict copy", copy)
+		}
+		if err := osutil.InWritableDir(osutil.Remove, filepath.Join(p.dir, copy)); err != nil && !os.IsNotExist(err) {
+			l.Infof("Puller (folder %q, file %q): removing old conflict copy: %v", p.folder, copy, err)
+		}
 	}
-	return err
 }
 
 func (p *rwFolder) newError(path string, err error) {
@@ -7,11 +7,19 @@
 package model
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/db"
 	"github.com/syncthing/syncthing/lib/protocol"
 	"github.com/syncthing/syncthing/lib/scanner"
 	"github.com/syncthing/syncthing/lib/sync"
@@ -157,6 +165,63 @@ func TestHandleFileWithTemp(t *testing.T) {
 	}
 }
 
+func TestHandleFileResume(t *testing.T) {
+	// The temp file has blocks 2, 3, 4 and 7 in the right places, but only
+	// the first two are recorded as complete. We should:
+	// Copy: 1, 4, 5, 6, 7, 8
+
+	requiredFile := protocol.FileInfo{
+		Name:    "file",
+		Blocks:  blocks[1:],
+		Version: protocol.Vector{{ID: 1, Value: 1}},
+	}
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(defaultFolderConfig)
+
+	p := rwFolder{
+		folder:      "default",
+		dir:         "testdata",
+		model:       m,
+		partialRepo: db.NewPartialFileRepo(ldb, "default"),
+		errors:      make(map[string]string),
+		errorsMut:   sync.NewMutex(),
+	}
+	p.partialRepo.Add("file", requiredFile.Version, []int32{1, 2})
+
+	copyChan := make(chan copyBlocksState, 1)
+	p.handleFile(requiredFile, copyChan, nil)
+	toCopy := <-copyChan
+
+	if toCopy.reused != 2 {
+		t.Errorf("Unexpected reused count %d != 2", toCopy.reused)
+	}
+	expected := []int{1, 4, 5, 6, 7, 8}
+	if len(toCopy.blocks) != len(expected) {
+		t.Fatalf("Unexpected count of copy blocks: %d != %d", len(toCopy.blocks), len(expected))
+	}
+	for i, eq := range expected {
+		if string(toCopy.blocks[i].Hash) != string(blocks[eq].Hash) {
+			t.Errorf("Block mismatch: %s != %s", toCopy.blocks[i].String(), blocks[eq].String())
+		}
+	}
+
+	// A record for another version is not trusted; the temp file is verified
+	// and what was found is recorded instead.
+	requiredFile.Version = requiredFile.Version.Update(1)
+	p.handleFile(requiredFile, copyChan, nil)
+	toCopy = <-copyChan
+
+	if len(toCopy.blocks) != 4 {
+		t.Errorf("Unexpected count of copy blocks: %d != 4", len(toCopy.blocks))
+	}
+	done := p.partialRepo.Blocks("file", requiredFile.Version)
+	if len(done) != 4 || done[0] != 1 || done[3] != 6 {
+		t.Errorf("Unexpected recorded blocks %v", done)
+	}
+}
+
 func TestCopierFinder(t *testing.T) {
 	// After diff between required and existing we should:
 	// Copy: 1, 2, 3, 4, 6, 7, 8
@@ -193,7 +258,7 @@ func TestCopierFinder(t *testing.T) {
 	// Update index
 	m.updateLocals("default", []protocol.FileInfo{existingFile})
 
-	iterFn := func(folder, file string, index int32) bool {
+	iterFn := func(folder, file string, index int32, _ int) bool {
 		return true
 	}
 
@@ -258,9 +323,319 @@ func TestCopierFinder(t *testing.T) {
 	os.Remove(tempFile)
 }
 
+func TestCopierWeakHash(t *testing.T) {
+	// The existing file has a byte inserted at the start, so none of the
+	// required blocks are at block aligned offsets. They should all be found
+	// by their weak hash instead of being pulled.
+
+	orig := make([]byte, 3*protocol.BlockSize)
+	rand.Read(orig)
+	requiredBlocks, err := scanner.Blocks(bytes.NewReader(orig), protocol.BlockSize, int64(len(orig)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	realName := filepath.Join("testdata", "weakfile")
+	tempFile := filepath.Join("testdata", defTempNamer.TempName("weakfile"))
+	defer os.Remove(realName)
+	defer os.Remove(tempFile)
+	if err := ioutil.WriteFile(realName, append([]byte{0x42}, orig...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	requiredFile := protocol.FileInfo{
+		Name:   "weakfile",
+		Blocks: requiredBlocks,
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+
+	p := rwFolder{
+		folder:    "default",
+		dir:       "testdata",
+		model:     m,
+		errors:    make(map[string]string),
+		errorsMut: sync.NewMutex(),
+	}
+
+	copyChan := make(chan copyBlocksState)
+	pullChan := make(chan pullBlockState, len(requiredBlocks))
+	finisherChan := make(chan *sharedPullerState, 1)
+
+	go p.copierRoutine(copyChan, pullChan, finisherChan)
+
+	p.handleFile(requiredFile, copyChan, finisherChan)
+
+	finish := <-finisherChan
+	finish.fd.Close()
+
+	select {
+	case ps := <-pullChan:
+		t.Fatalf("Block %v should not have been pulled", ps.block)
+	default:
+	}
+
+	blks, err := scanner.HashFile(tempFile, protocol.BlockSize, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !scanner.BlocksEqual(blks, requiredBlocks) {
+		t.Error("Temp file does not have the required contents")
+	}
+}
+
+func TestCopierZeroBlocks(t *testing.T) {
+	// A sparse file with data at both ends. The blocks of zeroes in between
+	// should be neither copied nor pulled.
+
+	data := make([]byte, 4*protocol.BlockSize)
+	rand.Read(data[:protocol.BlockSize])
+	rand.Read(data[3*protocol.BlockSize:])
+	requiredBlocks, err := scanner.Blocks(bytes.NewReader(data), protocol.BlockSize, int64(len(data)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !scanner.IsZeroBlock(requiredBlocks[1]) || !scanner.IsZeroBlock(requiredBlocks[2]) || scanner.IsZeroBlock(requiredBlocks[0]) {
+		t.Fatal("zero blocks not detected")
+	}
+
+	tempFile := filepath.Join("testdata", defTempNamer.TempName("sparsefile"))
+	defer os.Remove(tempFile)
+
+	requiredFile := protocol.FileInfo{
+		Name:   "sparsefile",
+		Blocks: requiredBlocks,
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+
+	p := rwFolder{
+		folder:    "default",
+		dir:       "testdata",
+		model:     m,
+		errors:    make(map[string]string),
+		errorsMut: sync.NewMutex(),
+	}
+
+	copyChan := make(chan copyBlocksState)
+	pullChan := make(chan pullBlockState, len(requiredBlocks))
+	finisherChan := make(chan *sharedPullerState, 1)
+
+	go p.copierRoutine(copyChan, pullChan, finisherChan)
+
+	p.handleFile(requiredFile, copyChan, finisherChan)
+
+	finish := <-finisherChan
+	finish.fd.Close()
+
+	if len(pullChan) != 2 {
+		t.Fatalf("Expected 2 pulled blocks, got %d", len(pullChan))
+	}
+	for i := 0; i < 2; i++ {
+		ps := <-pullChan
+		if scanner.IsZeroBlock(ps.block) {
+			t.Errorf("Block of zeroes at %d should not have been pulled", ps.block.Offset)
+		}
+	}
+	if finish.copyNeeded != 0 {
+		t.Errorf("Expected all copies done, %d remaining", finish.copyNeeded)
+	}
+
+	info, err := os.Stat(tempFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(data)) {
+		t.Errorf("Temp file has size %d, expected %d", info.Size(), len(data))
+	}
+}
+
+func TestHandleFileHardLink(t *testing.T) {
+	// The file is a hard link to one we already have, so it should be
+	// linked instead of copied.
+
+	data := make([]byte, protocol.BlockSize+10)
+	rand.Read(data)
+	targetName := filepath.Join("testdata", "linktarget")
+	tempFile := filepath.Join("testdata", defTempNamer.TempName("linkfile"))
+	defer os.Remove(targetName)
+	defer os.Remove(tempFile)
+	if err := ioutil.WriteFile(targetName, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(targetName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataBlocks, err := scanner.Blocks(bytes.NewReader(data), protocol.BlockSize, int64(len(data)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targetFile := protocol.FileInfo{
+		Name:     "linktarget",
+		Modified: info.ModTime().Unix(),
+		Blocks:   dataBlocks,
+	}
+	requiredFile := protocol.FileInfo{
+		Name:     "linkfile",
+		Flags:    protocol.FlagHardLink,
+		HardLink: "linktarget",
+		Modified: info.ModTime().Unix(),
+		Blocks:   dataBlocks,
+	}
+
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.SyncHardLinks = true
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.updateLocals("default", []protocol.FileInfo{targetFile})
+
+	p := newRWFolder(m, 0, fcfg)
+
+	copyChan := make(chan copyBlocksState, 1)
+	finisherChan := make(chan *sharedPullerState, 1)
+
+	p.handleFile(requiredFile, copyChan, finisherChan)
+
+	select {
+	case <-copyChan:
+		t.Fatal("Linked file should not be copied")
+	case state := <-finisherChan:
+		if closed, err := state.finalClose(); !closed || err != nil {
+			t.Errorf("Linked file not ready to finish: %v %v", closed, err)
+		}
+	}
+
+	linkInfo, err := os.Stat(tempFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(info, linkInfo) {
+		t.Error("Temp file is not a link to the target")
+	}
+}
+
+func TestCaseCollisions(t *testing.T) {
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	set := db.NewFileSet("default", ldb)
+	set.Update(protocol.LocalDeviceID, []protocol.FileInfo{
+		{Name: "readme.md", Version: protocol.Vector{{ID: 1, Value: 1}}},
+	})
+	set.Update(device1, []protocol.FileInfo{
+		{Name: "README.md", Version: protocol.Vector{{ID: 2, Value: 1}}},
+		{Name: "Docs", Flags: protocol.FlagDirectory, Version: protocol.Vector{{ID: 2, Value: 1}}},
+		{Name: "docs", Flags: protocol.FlagDirectory, Version: protocol.Vector{{ID: 2, Value: 1}}},
+		{Name: filepath.Join("Docs", "a"), Version: protocol.Vector{{ID: 2, Value: 1}}},
+		{Name: filepath.Join("docs", "b"), Version: protocol.Vector{{ID: 2, Value: 1}}},
+		{Name: "other", Version: protocol.Vector{{ID: 2, Value: 1}}},
+		{Name: "Other", Flags: protocol.FlagDeleted, Version: protocol.Vector{{ID: 2, Value: 1}}},
+	})
+
+	current := func(name string) (protocol.FileInfo, bool) {
+		return set.Get(protocol.LocalDeviceID, name)
+	}
+	c := newCaseCollisions(globalCaseNames(set))
+
+	// In the order the puller sees them; the first of each group that we
+	// don't already have wins.
+	expected := []struct {
+		file  protocol.FileInfo
+		allow bool
+	}{
+		{protocol.FileInfo{Name: "Docs", Flags: protocol.FlagDirectory}, true},
+		{protocol.FileInfo{Name: filepath.Join("Docs", "a")}, true},
+		{protocol.FileInfo{Name: "README.md"}, false},
+		{protocol.FileInfo{Name: "docs", Flags: protocol.FlagDirectory}, false},
+		{protocol.FileInfo{Name: filepath.Join("docs", "b")}, false},
+		{protocol.FileInfo{Name: "other"}, true},
+	}
+	for _, tc := range expected {
+		if allow := c.allow(tc.file, current); allow != tc.allow {
+			t.Errorf("allow(%q) = %v, expected %v", tc.file.Name, allow, tc.allow)
+		}
+	}
+
+	if !c.hasTwin("Other") {
+		t.Error("deleted file should have a twin")
+	}
+	if c.hasTwin("other") {
+		t.Error("existing file has no twin")
+	}
+}
+
+func TestCaseTwinDeletion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{".stfolder", "Readme", "NOTES"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.RawPath = dir
+	fcfg.CaseSensitivity = config.CaseInsensitive
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: defaultConfig.Raw().Devices,
+	})
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(fcfg)
+
+	// Each file on disk has a twin in the index that is not, as if the
+	// folder came from a case sensitive file system.
+	version := protocol.Vector{{ID: 1, Value: 1}}
+	local := []protocol.FileInfo{
+		{Name: "Readme", Version: version, Blocks: []protocol.BlockInfo{{Size: 6, Hash: []byte("Readme")}}},
+		{Name: "README", Version: version, Blocks: []protocol.BlockInfo{{Size: 6, Hash: []byte("README")}}},
+		{Name: "NOTES", Version: version, Blocks: []protocol.BlockInfo{{Size: 5, Hash: []byte("NOTES")}}},
+		{Name: "notes", Version: version, Blocks: []protocol.BlockInfo{{Size: 5, Hash: []byte("notes")}}},
+	}
+	m.updateLocals("default", local)
+
+	// The other device deletes the spelling we have on disk of one, and
+	// the one we don't of the other.
+	remote := []protocol.FileInfo{local[1], local[2]}
+	for _, f := range []protocol.FileInfo{local[0], local[3]} {
+		f.Flags |= protocol.FlagDeleted
+		f.Blocks = nil
+		f.Version = f.Version.Update(42)
+		remote = append(remote, f)
+	}
+	m.Index(device1, "default", remote, 0, nil)
+
+	p := newRWFolder(m, 0, fcfg)
+	p.pullerIteration(nil)
+
+	if _, err := os.Lstat(filepath.Join(dir, "Readme")); !os.IsNotExist(err) {
+		t.Error("deleted file on disk by its own name should be gone")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "NOTES")); err != nil {
+		t.Error("file deleted by the name of its twin should remain:", err)
+	}
+	for _, name := range []string{"Readme", "notes"} {
+		if cur, ok := m.CurrentFolderFile("default", name); !ok || !cur.IsDeleted() {
+			t.Errorf("deletion of %s not recorded: %v", name, cur)
+		}
+	}
+}
+
 // Test that updating a file removes it's old blocks from the blockmap
 func TestCopierCleanup(t *testing.T) {
-	iterFn := func(folder, file string, index int32) bool {
+	iterFn := func(folder, file string, index int32, _ int) bool {
 		return true
 	}
 
@@ -331,7 +706,7 @@ func TestLastResortPulling(t *testing.T) {
 	// with a different name (causing to copy that particular block)
 	file.Name = "newfile"
 
-	iterFn := func(folder, file string, index int32) bool {
+	iterFn := func(folder, file string, index int32, _ int) bool {
 		return true
 	}
 
@@ -546,3 +921,274 @@ func TestDeregisterOnFailInPull(t *testing.T) {
 		t.Fatal("Didn't get anything to the finisher")
 	}
 }
+
+func TestMoveForConflictMaxCopies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conflicts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+
+	p := rwFolder{
+		folder:            "default",
+		dir:               dir,
+		model:             m,
+		maxConflictCopies: 2,
+		errors:            make(map[string]string),
+		errorsMut:         sync.NewMutex(),
+	}
+
+	old := []string{
+		"file.sync-conflict-20150101-000000.txt",
+		"file.sync-conflict-20150102-000000-AIR6LPZ.txt",
+		"file.sync-conflict-20150103-000000.txt",
+	}
+	for _, name := range append(old, "file.txt", "file.sync-conflict-notatime.txt") {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+	}
+
+	local := protocol.Vector{{ID: device1.Short(), Value: 1}}
+	remote := protocol.Vector{{ID: device2.Short(), Value: 1}}
+	if err := p.moveForConflict("file.txt", local, remote); err != nil {
+		t.Fatal(err)
+	}
+
+	copies, err := conflictCopies(dir, "file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(copies) != 2 || copies[0] != old[2] {
+		t.Fatalf("unexpected conflict copies %v", copies)
+	}
+
+	// The new copy is named after the device that made the losing change.
+	if !strings.HasSuffix(copies[1], "-"+device1.String()[:7]+".txt") {
+		t.Errorf("conflict copy %q should contain the short ID of the losing device", copies[1])
+	}
+	if bs, err := ioutil.ReadFile(filepath.Join(dir, copies[1])); err != nil || string(bs) != "file.txt" {
+		t.Errorf("unexpected conflict copy contents %q, %v", bs, err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "file.sync-conflict-notatime.txt")); err != nil {
+		t.Error("unrelated file should not have been removed")
+	}
+}
+
+func TestMoveForConflictNoCopies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conflicts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := rwFolder{
+		folder:         "default",
+		dir:            dir,
+		conflictPolicy: config.ConflictNoCopies,
+		errors:         make(map[string]string),
+		errorsMut:      sync.NewMutex(),
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644)
+	if err := p.moveForConflict("file", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	fd, _ := os.Open(dir)
+	names, _ := fd.Readdirnames(-1)
+	fd.Close()
+	if len(names) != 0 {
+		t.Errorf("expected the losing file to be removed without a copy, found %v", names)
+	}
+}
+
+func TestPullBlockRetriesOtherDevice(t *testing.T) {
+	// device1 sends garbage, device2 the real thing. Whichever is asked
+	// first, we should end up with the right data.
+	data := []byte("the block data")
+	hash := sha256.Sum256(data)
+	block := protocol.BlockInfo{Size: int32(len(data)), Hash: hash[:]}
+	file := protocol.FileInfo{Name: "pulled", Blocks: []protocol.BlockInfo{block}}
+
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.Devices = append(fcfg.Devices, config.FolderDeviceConfiguration{DeviceID: device2})
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}},
+	})
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.AddConnection(Connection{&net.TCPConn{}, FakeConnection{id: device1, requestData: []byte("something else")}, ConnectionTypeDirectAccept})
+	m.AddConnection(Connection{&net.TCPConn{}, FakeConnection{id: device2, requestData: data}, ConnectionTypeDirectAccept})
+	m.Index(device1, "default", []protocol.FileInfo{file}, 0, nil)
+	m.Index(device2, "default", []protocol.FileInfo{file}, 0, nil)
+
+	p := rwFolder{
+		folder:    "default",
+		dir:       "testdata",
+		model:     m,
+		errors:    make(map[string]string),
+		errorsMut: sync.NewMutex(),
+	}
+
+	for i := 0; i < 3; i++ {
+		buf, err := p.pullBlock(pullBlockState{block: block, sharedPullerState: &sharedPullerState{file: file}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, data) {
+			t.Fatalf("Pulled %q, not %q", buf, data)
+		}
+	}
+
+	// Either way, device2 looks better now.
+	if lb := activity.leastBusy([]protocol.DeviceID{device1, device2}); lb != device2 {
+		t.Errorf("Expected device2 to be preferred, not %v", lb)
+	}
+}
+
+func TestDirRenamePull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dirrename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "old", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{".stfolder", filepath.Join("old", "a"), filepath.Join("old", "sub", "b")} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.RawPath = dir
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: defaultConfig.Raw().Devices,
+	})
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(fcfg)
+	m.StartFolderRO("default")
+	m.ServeBackground()
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The other device renamed old to new.
+	var remote []protocol.FileInfo
+	for _, name := range []string{"old", filepath.Join("old", "a"), filepath.Join("old", "sub"), filepath.Join("old", "sub", "b")} {
+		f, ok := m.CurrentFolderFile("default", name)
+		if !ok {
+			t.Fatalf("%s should have been scanned", name)
+		}
+		moved := f
+		moved.Name = "new" + name[len("old"):]
+		moved.Version = protocol.Vector{{ID: 42, Value: 1}}
+		f.Flags |= protocol.FlagDeleted
+		f.Blocks = nil
+		f.Version = f.Version.Update(42)
+		remote = append(remote, f, moved)
+	}
+	m.Index(device1, "default", remote, 0, nil)
+	before, err := os.Stat(filepath.Join(dir, "old", "sub", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newRWFolder(m, 0, fcfg)
+	if changed := p.pullerIteration(nil); changed == 0 {
+		t.Fatal("the rename should have changed things")
+	}
+
+	if _, err := os.Lstat(filepath.Join(dir, "old")); !os.IsNotExist(err) {
+		t.Error("old directory should be gone")
+	}
+	if after, err := os.Stat(filepath.Join(dir, "new", "sub", "b")); err != nil || !os.SameFile(before, after) {
+		t.Errorf("file should have been moved along with the directory: %v", err)
+	}
+	for _, f := range remote {
+		cur, ok := m.CurrentFolderFile("default", f.Name)
+		if !ok || !cur.Version.Equal(f.Version) || cur.IsDeleted() != f.IsDeleted() {
+			t.Errorf("index not updated for %s: %v", f.Name, cur)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(defaultFolderConfig)
+
+	blocks := func(hash string, size int32) []protocol.BlockInfo {
+		return []protocol.BlockInfo{{Size: size, Hash: []byte(hash)}}
+	}
+	ours := protocol.Vector{{ID: 1, Value: 1}}
+	theirs := protocol.Vector{{ID: 1, Value: 1}, {ID: 42, Value: 1}}
+	m.updateLocals("default", []protocol.FileInfo{
+		{Name: "keep", Version: ours, Blocks: blocks("keep", 10)},
+		{Name: "moveme", Version: ours, Blocks: blocks("moveme", 20)},
+		{Name: "gone", Version: ours, Blocks: blocks("gone", 30)},
+		{Name: "conflicted", Version: protocol.Vector{{ID: 1, Value: 2}}, Blocks: blocks("ours", 40)},
+	})
+	m.Index(device1, "default", []protocol.FileInfo{
+		{Name: "keep", Version: ours, Blocks: blocks("keep", 10)},
+		{Name: "moveme", Version: theirs, Flags: protocol.FlagDeleted},
+		{Name: "moved", Version: theirs, Blocks: blocks("moveme", 20)},
+		{Name: "gone", Version: theirs, Flags: protocol.FlagDeleted},
+		{Name: "conflicted", Version: theirs, Modified: 10, Blocks: blocks("theirs", 50)},
+		{Name: "dir", Version: theirs, Flags: protocol.FlagDirectory},
+		{Name: "copied", Version: theirs, Blocks: append(blocks("keep", 10), blocks("new", 60)...)},
+	}, 0, nil)
+
+	actions, err := m.Plan("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]plannedAction{
+		"moved":      {Action: "rename", Name: "moved", Type: "file", From: "moveme"},
+		"gone":       {Action: "deleteFile", Name: "gone", Type: "file"},
+		"conflicted": {Action: "conflict", Name: "conflicted", Type: "file", FetchBytes: 50},
+		"dir":        {Action: "create", Name: "dir", Type: "dir"},
+		"copied":     {Action: "create", Name: "copied", Type: "file", CopyBytes: 10, FetchBytes: 60},
+	}
+	if len(actions) != len(expected) {
+		t.Errorf("unexpected actions %+v", actions)
+	}
+	for _, action := range actions {
+		if action != expected[action.Name] {
+			t.Errorf("planned %+v, expected %+v", action, expected[action.Name])
+		}
+	}
+
+	// Nothing was done.
+	if f, _ := m.CurrentFolderFile("default", "gone"); f.IsDeleted() {
+		t.Error("planning should not change the index")
+	}
+
+	// Without conflict copies, our version of the conflicted file would
+	// just be replaced.
+	m.fmut.Lock()
+	fcfg := m.folderCfgs["default"]
+	fcfg.ConflictPolicy = config.ConflictNoCopies
+	m.folderCfgs["default"] = fcfg
+	m.fmut.Unlock()
+
+	actions, err = m.Plan("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected["conflicted"] = plannedAction{Action: "update", Name: "conflicted", Type: "file", FetchBytes: 50, Discards: true}
+	for _, action := range actions {
+		if action != expected[action.Name] {
+			t.Errorf("planned %+v, expected %+v", action, expected[action.Name])
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"time"
+
+	"github.com/juju/ratelimit"
+	"github.com/syncthing/syncthing/lib/scanner"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// A scanLimiter limits how fast files are read for hashing. The rate can be
+// changed while scans are running.
+type scanLimiter struct {
+	kibs   int
+	bucket *ratelimit.Bucket // nil when there is no limit
+	mut    sync.Mutex
+}
+
+func newScanLimiter(kibs int) *scanLimiter {
+	s := &scanLimiter{mut: sync.NewMutex()}
+	s.setRate(kibs)
+	return s
+}
+
+// setRate sets the limit in KiB per second. Zero or less means no limit.
+func (s *scanLimiter) setRate(kibs int) {
+	if kibs < 0 {
+		kibs = 0
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if kibs == s.kibs {
+		return
+	}
+	s.kibs = kibs
+	s.bucket = nil
+	if kibs > 0 {
+		rate := kibs * 1024
+		s.bucket = ratelimit.NewBucketWithRate(float64(rate), int64(rate))
+	}
+}
+
+// take takes count bytes from the bucket, and returns how long to wait
+// before reading them.
+func (s *scanLimiter) take(count int64) time.Duration {
+	s.mut.Lock()
+	bucket := s.bucket
+	s.mut.Unlock()
+	if bucket == nil {
+		return 0
+	}
+	return bucket.Take(count)
+}
+
+// scanLimiters paces scanning a folder by both the global and the folder's
+// own limit.
+type scanLimiters []*scanLimiter
+
+func (ls scanLimiters) Wait(count int64) {
+	var wait time.Duration
+	for _, s := range ls {
+		if d := s.take(count); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// folderScanLimiter returns the limiter to use when scanning the folder.
+func (m *Model) folderScanLimiter(folder string) scanner.RateLimiter {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+	return scanLimiters{m.scanLimit, m.folderScanLimits[folder]}
+}
+
+// setFolderScanRate changes the scan rate limit of the folder, also for
+// the scan in progress.
+func (m *Model) setFolderScanRate(folder string, kibs int) {
+	m.fmut.Lock()
+	defer m.fmut.Unlock()
+	if cfg, ok := m.folderCfgs[folder]; ok {
+		cfg.MaxScanKiBs = kibs
+		m.folderCfgs[folder] = cfg
+	}
+	if s, ok := m.folderScanLimits[folder]; ok {
+		s.setRate(kibs)
+	}
+}
@@ -10,8 +10,10 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 
 	"github.com/syncthing/syncthing/lib/db"
+	"github.com/syncthing/syncthing/lib/osutil"
 	"github.com/syncthing/syncthing/lib/protocol"
 	"github.com/syncthing/syncthing/lib/sync"
 )
@@ -26,7 +28,8 @@ type sharedPullerState struct {
 	realName    string
 	reused      int // Number of blocks reused from temporary file
 	ignorePerms bool
-	version     protocol.Vector // The current (old) version
+	version     protocol.Vector     // The current (old) version
+	partials    *db.PartialFileRepo // Where to record progress, if anywhere
 
 	// Mutable, must be locked for access
 	err        error      // The first error we hit
@@ -37,9 +40,14 @@ type sharedPullerState struct {
 	copyNeeded int        // Number of copy actions still pending
 	pullNeeded int        // Number of block pulls still pending
 	closed     bool       // True if the file has been finalClosed.
+	completed  []int32    // Indexes of blocks written since progress was last recorded
 	mut        sync.Mutex // Protects the above
 }
 
+// The number of blocks written to the temp file between syncing it to disk
+// and recording the progress, so that the pull can be resumed.
+const partialFlushBlocks = 64
+
 // A momentary state representing the progress of the puller
 type pullerProgress struct {
 	Total               int   `json:"total"`
@@ -138,12 +146,45 @@ func (s *sharedPullerState) tempFile() (io.WriterAt, error) {
 		return nil, err
 	}
 
+	// Setting the size up front leaves every block we don't write as a
+	// hole, so that blocks of zeroes don't take up space in sparse files.
+	// It also cuts off whatever trailing data a reused temp file may have.
+	if err := fd.Truncate(s.file.Size()); err != nil {
+		fd.Close()
+		s.failLocked("dst truncate", err)
+		return nil, err
+	}
+
 	// Same fd will be used by all writers
 	s.fd = fd
 
 	return lockedWriterAt{&s.mut, s.fd}, nil
 }
 
+// zeroBlock makes sure the given block of the temp file reads as zeroes,
+// without writing them out if it can be avoided.
+func (s *sharedPullerState) zeroBlock(block protocol.BlockInfo) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+
+	if s.reused == 0 {
+		// The temp file is new, so the block is still a hole.
+		return nil
+	}
+
+	// The reused temp file may have other data here, from an earlier
+	// version of the file.
+	if err := osutil.PunchHole(s.fd, block.Offset, int64(block.Size)); err == nil {
+		return nil
+	}
+	_, err := s.fd.WriteAt(make([]byte, block.Size), block.Offset)
+	return err
+}
+
 // sourceFile opens the existing source file for reading
 func (s *sharedPullerState) sourceFile() (*os.File, error) {
 	s.mut.Lock()
@@ -190,9 +231,10 @@ func (s *sharedPullerState) failed() error {
 	return s.err
 }
 
-func (s *sharedPullerState) copyDone() {
+func (s *sharedPullerState) copyDone(block protocol.BlockInfo) {
 	s.mut.Lock()
 	s.copyNeeded--
+	s.blockDoneLocked(block)
 	if debug {
 		l.Debugln("sharedPullerState", s.folder, s.file.Name, "copyNeeded ->", s.copyNeeded)
 	}
@@ -217,15 +259,53 @@ func (s *sharedPullerState) pullStarted() {
 	s.mut.Unlock()
 }
 
-func (s *sharedPullerState) pullDone() {
+func (s *sharedPullerState) pullDone(block protocol.BlockInfo) {
 	s.mut.Lock()
 	s.pullNeeded--
+	s.blockDoneLocked(block)
 	if debug {
 		l.Debugln("sharedPullerState", s.folder, s.file.Name, "pullNeeded done ->", s.pullNeeded)
 	}
 	s.mut.Unlock()
 }
 
+// blockDoneLocked notes that the block has been written to the temp file, and
+// records the progress every so often.
+func (s *sharedPullerState) blockDoneLocked(block protocol.BlockInfo) {
+	if s.partials == nil {
+		return
+	}
+	s.completed = append(s.completed, blockIndex(s.file, block))
+	if len(s.completed) >= partialFlushBlocks {
+		s.recordProgressLocked()
+	}
+}
+
+// blockIndex returns the index of the block in the block list of the file.
+func blockIndex(file protocol.FileInfo, block protocol.BlockInfo) int32 {
+	return int32(sort.Search(len(file.Blocks), func(i int) bool {
+		return file.Blocks[i].Offset >= block.Offset
+	}))
+}
+
+// recordProgressLocked syncs the temp file to disk and records the blocks
+// written since the last time as complete.
+func (s *sharedPullerState) recordProgressLocked() {
+	if len(s.completed) == 0 || s.fd == nil {
+		return
+	}
+	if err := s.fd.Sync(); err != nil {
+		// The blocks may not have made it to disk, so we can't vouch for
+		// them. They will be verified again when resuming.
+		if debug {
+			l.Debugln("sharedPullerState", s.folder, s.file.Name, "sync:", err)
+		}
+	} else {
+		s.partials.Add(s.file.Name, s.file.Version, s.completed)
+	}
+	s.completed = s.completed[:0]
+}
+
 // finalClose atomically closes and returns closed status of a file. A true
 // first return value means the file was closed and should be finished, with
 // the error indicating the success or failure of the close. A false first
@@ -246,6 +326,10 @@ func (s *sharedPullerState) finalClose() (bool, error) {
 	}
 
 	if s.fd != nil {
+		if s.err != nil {
+			// Keep what we have so far for the next attempt.
+			s.recordProgressLocked()
+		}
 		if closeErr := s.fd.Close(); closeErr != nil && s.err == nil {
 			// This is our error if we weren't errored before. Otherwise we
 			// keep the earlier error.
@@ -272,7 +356,7 @@ func (s *sharedPullerState) Progress() *pullerProgress {
 		CopiedFromElsewhere: s.copyTotal - s.copyNeeded - s.copyOrigin,
 		Pulled:              s.pullTotal - s.pullNeeded,
 		Pulling:             s.pullNeeded,
-		BytesTotal:          db.BlocksToSize(total),
-		BytesDone:           db.BlocksToSize(done),
+		BytesTotal:          db.BlocksToSize(total, s.file.BlockSize()),
+		BytesDone:           db.BlocksToSize(done, s.file.BlockSize()),
 	}
 }
@@ -7,10 +7,15 @@
 package model
 
 import (
+	"errors"
 	"os"
 	"testing"
 
+	"github.com/syncthing/syncthing/lib/db"
+	"github.com/syncthing/syncthing/lib/protocol"
 	"github.com/syncthing/syncthing/lib/sync"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
 )
 
 func TestSourceFileOK(t *testing.T) {
@@ -85,3 +90,41 @@ func TestReadOnlyDir(t *testing.T) {
 	s.fail("Test done", nil)
 	s.finalClose()
 }
+
+func TestRecordProgressOnFailure(t *testing.T) {
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	repo := db.NewPartialFileRepo(ldb, "default")
+	version := protocol.Vector{{ID: 1, Value: 1}}
+
+	s := sharedPullerState{
+		file:       protocol.FileInfo{Name: "progress", Version: version, Blocks: blocks[1:4]},
+		tempName:   "testdata/.progress_temp",
+		partials:   repo,
+		copyNeeded: 3,
+		mut:        sync.NewMutex(),
+	}
+	defer os.Remove(s.tempName)
+
+	fd, err := s.tempFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, block := range s.file.Blocks[1:] {
+		if _, err := fd.WriteAt(make([]byte, block.Size), block.Offset); err != nil {
+			t.Fatal(err)
+		}
+		s.copyDone(block)
+	}
+
+	// Nothing is recorded until the file has been synced to disk.
+	if done := repo.Blocks("progress", version); done != nil {
+		t.Errorf("Unexpected recorded blocks %v", done)
+	}
+
+	s.fail("test", errors.New("interrupted"))
+	s.finalClose()
+
+	if done := repo.Blocks("progress", version); len(done) != 2 || done[0] != 1 || done[1] != 2 {
+		t.Errorf("Unexpected recorded blocks %v", done)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"sort"
+	"time"
+)
+
+// minUnstableDelay is the least time to wait before scanning files that
+// were still changing again.
+const minUnstableDelay = time.Second
+
+// unstableFiles collects the changed files a scan left alone, as they were
+// modified within the stability window. It's used for one scan.
+type unstableFiles struct {
+	window time.Duration
+	names  []string
+	due    time.Time // when the first of them should have settled
+}
+
+func (u *unstableFiles) Unstable(name string, modified time.Time) {
+	u.names = append(u.names, name)
+	if due := modified.Add(u.window); u.due.IsZero() || due.Before(u.due) {
+		u.due = due
+	}
+}
+
+// An unstableRescan is a scan of files that were still changing, scheduled
+// for when the first of them should have settled.
+type unstableRescan struct {
+	names map[string]struct{}
+	due   time.Time
+	timer *time.Timer
+}
+
+// rescanUnstable schedules a scan of the files left alone by a scan of the
+// folder, as they were still changing. Files that are still changing by
+// then are left alone and scheduled again.
+func (m *Model) rescanUnstable(folder string, u *unstableFiles) {
+	if len(u.names) == 0 {
+		return
+	}
+	delay := u.due.Sub(time.Now())
+	if delay < minUnstableDelay {
+		delay = minUnstableDelay
+	}
+	if debug {
+		l.Debugf("%v rescanning %d unstable files in folder %q in %v", m, len(u.names), folder, delay)
+	}
+
+	m.fmut.Lock()
+	defer m.fmut.Unlock()
+	r, ok := m.folderUnstable[folder]
+	if !ok {
+		r = &unstableRescan{
+			names: make(map[string]struct{}),
+			due:   u.due,
+			timer: time.AfterFunc(delay, func() {
+				m.scanUnstable(folder)
+			}),
+		}
+		m.folderUnstable[folder] = r
+	} else if u.due.Before(r.due) {
+		r.due = u.due
+		r.timer.Reset(delay)
+	}
+	for _, name := range u.names {
+		r.names[name] = struct{}{}
+	}
+}
+
+// scanUnstable scans the files scheduled by rescanUnstable.
+func (m *Model) scanUnstable(folder string) {
+	m.fmut.Lock()
+	r, ok := m.folderUnstable[folder]
+	delete(m.folderUnstable, folder)
+	m.fmut.Unlock()
+	if !ok {
+		return
+	}
+
+	names := make([]string, 0, len(r.names))
+	for name := range r.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if err := m.ScanFolderSubs(folder, names); err != nil {
+		l.Infof("Scanning changed files in folder %q: %v", folder, err)
+	}
+}
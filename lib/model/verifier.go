@@ -0,0 +1,396 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/juju/ratelimit"
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/db"
+	"github.com/syncthing/syncthing/lib/events"
+	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syncthing/syncthing/lib/scanner"
+)
+
+// defaultVerifyRate is how many bytes per second are read when verifying a
+// folder, unless configured otherwise.
+const defaultVerifyRate = 1024 * 1024
+
+var (
+	errVerifyStopped = errors.New("verification stopped")
+	errVerifyChanged = errors.New("file changed since last scan")
+)
+
+// A corruptFile is a file whose contents on disk no longer match the blocks
+// in the index, as found by verification.
+type corruptFile struct {
+	version protocol.Vector
+	blocks  []int // indexes of the blocks that don't match
+}
+
+// A folderVerifier periodically reads back all the files in the folder, at
+// a leisurely pace, to find those that got corrupted on disk. The scanner
+// doesn't notice, as size and modification time remain the same.
+type folderVerifier struct {
+	model  *Model
+	folder string
+	intv   time.Duration
+	stop   chan struct{}
+}
+
+func newFolderVerifier(model *Model, folder string, interval time.Duration) *folderVerifier {
+	return &folderVerifier{
+		model:  model,
+		folder: folder,
+		intv:   interval,
+		stop:   make(chan struct{}),
+	}
+}
+
+func (v *folderVerifier) Serve() {
+	if debug {
+		l.Debugln(v, "starting")
+		defer l.Debugln(v, "exiting")
+	}
+
+	timer := time.NewTimer(v.intv)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-v.stop:
+			return
+
+		case <-timer.C:
+			if err := v.model.CheckFolderHealth(v.folder); err != nil {
+				l.Infoln("Skipping folder", v.folder, "verification due to folder error:", err)
+			} else if err := v.model.verifyFolder(v.folder, v.stop); err == errVerifyStopped {
+				return
+			} else if err != nil {
+				l.Infof("Verifying folder %q: %v", v.folder, err)
+			}
+			timer.Reset(v.intv)
+		}
+	}
+}
+
+func (v *folderVerifier) Stop() {
+	close(v.stop)
+}
+
+func (v *folderVerifier) String() string {
+	return fmt.Sprintf("folderVerifier/%s@%p", v.folder, v)
+}
+
+// verifyFolder checks the contents of the files in the folder against the
+// blocks in the index, and records the corrupt ones as folder errors. If so
+// configured, the corrupt blocks are fetched again from other devices.
+func (m *Model) verifyFolder(folder string, stop <-chan struct{}) error {
+	m.fmut.RLock()
+	cfg, ok := m.folderCfgs[folder]
+	fs := m.folderFiles[folder]
+	ignores := m.folderIgnores[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return errors.New("no such folder")
+	}
+
+	var names []string
+	fs.WithHaveTruncated(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
+		f := fi.(db.FileInfoTruncated)
+		if f.IsDeleted() || f.IsInvalid() || f.IsDirectory() || f.IsSymlink() || ignores.Match(f.Name) {
+			return true
+		}
+		names = append(names, f.Name)
+		return true
+	})
+
+	bucket := verifyBucket(cfg)
+	mtimes := db.NewVirtualMtimeRepo(m.db, folder)
+
+	if debug {
+		l.Debugf("verifying %d files in folder %q", len(names), folder)
+	}
+	corrupt := 0
+	for _, name := range names {
+		select {
+		case <-stop:
+			return errVerifyStopped
+		default:
+		}
+
+		f, ok := fs.Get(protocol.LocalDeviceID, name)
+		if !ok || f.IsDeleted() || f.IsInvalid() {
+			continue
+		}
+		if m.verifyFile(cfg, f, mtimes, bucket) {
+			corrupt++
+		}
+	}
+
+	if corrupt > 0 {
+		l.Warnf("Folder %q: verification found %d corrupt files", folder, corrupt)
+	}
+	return nil
+}
+
+// verifyBucket returns the rate limit for verifying files in the folder.
+func verifyBucket(cfg config.FolderConfiguration) *ratelimit.Bucket {
+	rate := cfg.VerifyRateKiBs * 1024
+	if rate <= 0 {
+		rate = defaultVerifyRate
+	}
+	return ratelimit.NewBucketWithRate(float64(rate), int64(rate))
+}
+
+// rescanMismatch rescans the file in the background, after data read from
+// it didn't have the hash a device asked for. If the scan finds no change,
+// the file got corrupted on disk, so it's verified against the index.
+func (m *Model) rescanMismatch(folder, name string) {
+	key := folder + "/" + name
+	m.rvmut.Lock()
+	delete(m.reqValidationCache, key)
+	if _, ok := m.mismatchRescans[key]; ok {
+		m.rvmut.Unlock()
+		return
+	}
+	m.mismatchRescans[key] = struct{}{}
+	m.rvmut.Unlock()
+
+	go func() {
+		defer func() {
+			m.rvmut.Lock()
+			delete(m.mismatchRescans, key)
+			m.rvmut.Unlock()
+		}()
+
+		before, _ := m.CurrentFolderFile(folder, name)
+		if err := m.ScanFolderSubs(folder, []string{name}); err != nil {
+			l.Infof("Rescanning %q in folder %q: %v", name, folder, err)
+			return
+		}
+		f, ok := m.CurrentFolderFile(folder, name)
+		if !ok || !f.Version.Equal(before.Version) || f.IsDeleted() || f.IsInvalid() || f.IsDirectory() || f.IsSymlink() {
+			// The file changed, and the other device will hear about it.
+			return
+		}
+
+		m.fmut.RLock()
+		cfg := m.folderCfgs[folder]
+		m.fmut.RUnlock()
+		m.verifyFile(cfg, f, db.NewVirtualMtimeRepo(m.db, folder), verifyBucket(cfg))
+	}()
+}
+
+// verifyFile checks the file against the index, records the result and
+// repairs the file if so configured. It returns true if the file remains
+// corrupt.
+func (m *Model) verifyFile(cfg config.FolderConfiguration, f protocol.FileInfo, mtimes *db.VirtualMtimeRepo, bucket *ratelimit.Bucket) bool {
+	folder := cfg.ID
+	bad, err := corruptBlocks(cfg.FilePath(f.Name), f, mtimes, bucket)
+	if err != nil {
+		// The file is gone or changed, which the next scan takes care of.
+		if debug {
+			l.Debugln("verify:", folder, f.Name, err)
+		}
+		return false
+	}
+
+	if len(bad) == 0 {
+		m.clearCorrupt(folder, f.Name)
+		return false
+	}
+	m.setCorrupt(folder, f.Name, corruptFile{f.Version, bad})
+
+	l.Warnf("Folder %q: file %q has %d of %d blocks that don't match the index; the disk may be failing", folder, f.Name, len(bad), len(f.Blocks))
+	if !cfg.VerifyRepair {
+		return true
+	}
+	if err := m.repairFile(folder, cfg.FilePath(f.Name), f, bad); err != nil {
+		l.Infof("Folder %q: repairing %q: %v", folder, f.Name, err)
+		return true
+	}
+	l.Infof("Folder %q: repaired %q with data from other devices", folder, f.Name)
+	m.clearCorrupt(folder, f.Name)
+	return false
+}
+
+// setCorrupt records the file as corrupt.
+func (m *Model) setCorrupt(folder, name string, cf corruptFile) {
+	m.fmut.Lock()
+	old, ok := m.folderCorrupt[folder][name]
+	changed := !ok || !old.version.Equal(cf.version) || !reflect.DeepEqual(old.blocks, cf.blocks)
+	if m.folderCorrupt[folder] == nil {
+		m.folderCorrupt[folder] = make(map[string]corruptFile)
+	}
+	m.folderCorrupt[folder][name] = cf
+	m.fmut.Unlock()
+	if changed {
+		m.corruptChanged(folder)
+	}
+}
+
+// clearCorrupt records the file as no longer corrupt.
+func (m *Model) clearCorrupt(folder, name string) {
+	m.fmut.Lock()
+	_, ok := m.folderCorrupt[folder][name]
+	delete(m.folderCorrupt[folder], name)
+	m.fmut.Unlock()
+	if ok {
+		m.corruptChanged(folder)
+	}
+}
+
+// corruptChanged tells about the folder errors when the corrupt files
+// among them change, as no pull may happen to do so.
+func (m *Model) corruptChanged(folder string) {
+	errs, err := m.FolderErrors(folder)
+	if err != nil {
+		return
+	}
+	events.Default.Log(events.FolderErrors, map[string]interface{}{
+		"folder": folder,
+		"errors": errs,
+	})
+}
+
+// corruptBlocks reads the file from disk and returns the indexes of the
+// blocks that don't match the index. The file must not have changed since
+// the last scan.
+func corruptBlocks(path string, f protocol.FileInfo, mtimes *db.VirtualMtimeRepo, bucket *ratelimit.Bucket) ([]int, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	unchanged := func() error {
+		info, err := fd.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Size() != f.Size() || mtimes.GetMtime(f.Name, info.ModTime()).Unix() != f.Modified {
+			return errVerifyChanged
+		}
+		return nil
+	}
+	if err := unchanged(); err != nil {
+		return nil, err
+	}
+
+	var bad []int
+	r := ratelimit.Reader(fd, bucket)
+	buf := make([]byte, f.BlockSize())
+	for i, block := range f.Blocks {
+		if int(block.Size) > len(buf) {
+			buf = make([]byte, block.Size)
+		}
+		if _, err := io.ReadFull(r, buf[:block.Size]); err != nil {
+			return nil, err
+		}
+		if _, err := scanner.VerifyBuffer(buf[:block.Size], block); err != nil {
+			bad = append(bad, i)
+		}
+	}
+
+	// A write while we were reading would look like corruption.
+	if err := unchanged(); err != nil {
+		return nil, err
+	}
+	return bad, nil
+}
+
+// repairFile fetches the given blocks of the file from the devices that
+// have the same version of it, and writes them in place. The file keeps its
+// modification time, as its contents are what the index says they are.
+func (m *Model) repairFile(folder, path string, f protocol.FileInfo, bad []int) error {
+	if gf, ok := m.CurrentGlobalFile(folder, f.Name); !ok || !gf.Version.Equal(f.Version) {
+		return errors.New("no device has the same version")
+	}
+	devices := m.Availability(folder, f.Name)
+	if len(devices) == 0 {
+		return errNoDevice
+	}
+
+	offsets := make([]int64, len(f.Blocks))
+	for i := 1; i < len(f.Blocks); i++ {
+		offsets[i] = offsets[i-1] + int64(f.Blocks[i-1].Size)
+	}
+
+	bufs := make(map[int][]byte, len(bad))
+	var lastErr error
+	for _, i := range bad {
+		block := f.Blocks[i]
+		for _, device := range devices {
+			buf, err := m.requestGlobal(device, folder, f.Name, offsets[i], int(block.Size), block.Hash, 0, nil)
+			if err == nil {
+				_, err = scanner.VerifyBuffer(buf, block)
+			}
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			bufs[i] = buf
+			break
+		}
+	}
+	if len(bufs) == 0 {
+		return lastErr
+	}
+
+	fd, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	if info.Size() != f.Size() {
+		fd.Close()
+		return errVerifyChanged
+	}
+	for i, buf := range bufs {
+		if _, err := fd.WriteAt(buf, offsets[i]); err != nil {
+			fd.Close()
+			return err
+		}
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+
+	if len(bufs) < len(bad) {
+		return fmt.Errorf("%d blocks not repaired: %v", len(bad)-len(bufs), lastErr)
+	}
+	return nil
+}
+
+// corruptErrors returns the files in the folder found corrupt, that haven't
+// changed since.
+func (m *Model) corruptErrors(folder string) []fileError {
+	m.fmut.RLock()
+	fs := m.folderFiles[folder]
+	var errors []fileError
+	for name, cf := range m.folderCorrupt[folder] {
+		if f, ok := fs.Get(protocol.LocalDeviceID, name); ok && f.Version.Equal(cf.version) {
+			errors = append(errors, fileError{name, fmt.Sprintf("contents don't match the index in %d blocks", len(cf.blocks))})
+		}
+	}
+	m.fmut.RUnlock()
+	return errors
+}
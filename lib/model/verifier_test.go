@@ -0,0 +1,179 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/events"
+	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestVerifyFolder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 2*protocol.BlockSize+100)
+	rand.Read(data)
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(filepath.Join(dir, ".stfolder"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.RawPath = dir
+	fcfg.VerifyRepair = true
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: defaultConfig.Raw().Devices,
+	})
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.StartFolderRO("default")
+	m.ServeBackground()
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip some bits in the second block, behind the scanner's back.
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteAt([]byte("bitrot"), protocol.BlockSize+10)
+	fd.Close()
+	os.Chtimes(name, info.ModTime(), info.ModTime())
+
+	// Changes to the corrupt files are announced as folder errors.
+	sub := events.Default.Subscribe(events.FolderErrors)
+	defer events.Default.Unsubscribe(sub)
+	folderErrors := func() []fileError {
+		ev, err := sub.Poll(time.Second)
+		if err != nil {
+			t.Fatal("expected FolderErrors event:", err)
+		}
+		return ev.Data.(map[string]interface{})["errors"].([]fileError)
+	}
+
+	if err := m.verifyFolder("default", nil); err != nil {
+		t.Fatal(err)
+	}
+	errs, _ := m.FolderErrors("default")
+	if len(errs) != 1 || errs[0].Path != "file" {
+		t.Fatalf("expected the file to be reported corrupt, got %v", errs)
+	}
+	if errs := folderErrors(); len(errs) != 1 || errs[0].Path != "file" {
+		t.Errorf("expected an event for the corrupt file, got %v", errs)
+	}
+
+	// A device with the same version has the right data.
+	f, _ := m.CurrentFolderFile("default", "file")
+	m.AddConnection(Connection{&net.TCPConn{}, FakeConnection{id: device1, requestData: data[protocol.BlockSize : 2*protocol.BlockSize]}, ConnectionTypeDirectAccept})
+	m.Index(device1, "default", []protocol.FileInfo{f}, 0, nil)
+
+	if err := m.verifyFolder("default", nil); err != nil {
+		t.Fatal(err)
+	}
+	if errs, _ := m.FolderErrors("default"); len(errs) != 0 {
+		t.Errorf("expected the file to be repaired, got %v", errs)
+	}
+	if errs := folderErrors(); len(errs) != 0 {
+		t.Errorf("expected an event clearing the errors, got %v", errs)
+	}
+	if bs, _ := ioutil.ReadFile(name); !bytes.Equal(bs, data) {
+		t.Error("repaired file differs from the original")
+	}
+	if ninfo, _ := os.Stat(name); !ninfo.ModTime().Equal(info.ModTime()) {
+		t.Errorf("repair changed the modification time from %v to %v", info.ModTime(), ninfo.ModTime())
+	}
+}
+
+func TestRequestHashMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(filepath.Join(dir, ".stfolder"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte("the original data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.RawPath = dir
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: defaultConfig.Raw().Devices,
+	})
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.StartFolderRO("default")
+	m.ServeBackground()
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, _ := m.CurrentFolderFile("default", "file")
+	hash := f.Blocks[0].Hash
+	buf := make([]byte, f.Blocks[0].Size)
+	if err := m.Request(device1, "default", "file", 0, hash, 0, nil, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Same size and modification time, different contents.
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte("the corrupt! data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(name, info.ModTime(), info.ModTime())
+
+	if err := m.Request(device1, "default", "file", 0, hash, 0, nil, buf); err != protocol.ErrHashMismatch {
+		t.Fatalf("expected a hash mismatch, got %v", err)
+	}
+
+	// The rescan finds no change, so the file is verified and found
+	// corrupt.
+	for i := 0; i < 100; i++ {
+		if errs, _ := m.FolderErrors("default"); len(errs) == 1 && errs[0].Path == "file" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	errs, _ := m.FolderErrors("default")
+	t.Errorf("expected the file to be reported corrupt, got %v", errs)
+}
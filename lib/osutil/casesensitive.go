@@ -0,0 +1,40 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package osutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// IsCaseInsensitive probes whether the file system holding dir considers
+// names differing only in case to be the same, by creating a temporary file
+// in it and looking for it under another case.
+func IsCaseInsensitive(dir string) (bool, error) {
+	fd, err := ioutil.TempFile(dir, ".syncthing.casetest.")
+	if err != nil {
+		return false, err
+	}
+	name := fd.Name()
+	fd.Close()
+	defer os.Remove(name)
+
+	info, err := os.Lstat(name)
+	if err != nil {
+		return false, err
+	}
+	base := filepath.Base(name)
+	other, err := os.Lstat(filepath.Join(filepath.Dir(name), strings.ToUpper(base)))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return os.SameFile(info, other), nil
+}
@@ -0,0 +1,17 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package osutil
+
+import "os"
+
+// HardLinkID always returns false, as hard links are not detected on
+// Windows.
+func HardLinkID(info os.FileInfo) (FileID, bool) {
+	return FileID{}, false
+}
@@ -0,0 +1,54 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build linux
+
+package osutil
+
+import "syscall"
+
+const (
+	ioprioWhoProcess = 1  // IOPRIO_WHO_PROCESS
+	ioprioClassIdle  = 3  // IOPRIO_CLASS_IDLE
+	ioprioClassShift = 13 // IOPRIO_CLASS_SHIFT
+	niceLowest       = 19
+)
+
+// SetLowPriority makes the calling thread do its I/O only when the disk is
+// otherwise idle, and run at the lowest CPU priority. The caller should be
+// locked to its thread. The returned function restores the previous
+// priorities, which may not be allowed for unprivileged processes, in which
+// case the thread should not be used for anything else.
+func SetLowPriority() (func() error, error) {
+	tid := syscall.Gettid()
+	ioprio, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_GET, ioprioWhoProcess, uintptr(tid), 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	// The system call returns 20 - nice, to keep clear of negative values.
+	prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, tid)
+	if err != nil {
+		return nil, err
+	}
+
+	restore := func() error {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, 20-prio); err != nil {
+			return err
+		}
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprio); errno != 0 {
+			return errno
+		}
+		return nil
+	}
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprioClassIdle<<ioprioClassShift); errno != 0 {
+		return nil, errno
+	}
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, niceLowest); err != nil {
+		return restore, err
+	}
+	return restore, nil
+}
@@ -24,6 +24,20 @@ import (
 
 var ErrNoHome = errors.New("No home directory found - set $HOME (or the platform equivalent).")
 
+// ErrXattrsUnsupported is returned when the platform or file system does
+// not support extended attributes.
+var ErrXattrsUnsupported = errors.New("extended attributes not supported")
+
+// ErrHolesUnsupported is returned when the platform or file system cannot
+// deallocate parts of a file.
+var ErrHolesUnsupported = errors.New("punching holes not supported")
+
+// A FileID identifies a file on disk, regardless of the name it's found by.
+type FileID struct {
+	Dev uint64
+	Ino uint64
+}
+
 // Try to keep this entire operation atomic-like. We shouldn't be doing this
 // often enough that there is any contention on this lock.
 var renameLock = sync.NewMutex()
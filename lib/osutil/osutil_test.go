@@ -7,7 +7,9 @@
 package osutil_test
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
 	"testing"
 
@@ -179,3 +181,46 @@ func TestDiskUsage(t *testing.T) {
 		t.Error("Disk is full?", free)
 	}
 }
+
+func TestIsCaseInsensitive(t *testing.T) {
+	insensitive, err := osutil.IsCaseInsensitive(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Whatever the answer, the probe should have cleaned up after itself and
+	// agree with what a file created here shows.
+	if err := ioutil.WriteFile("casetest", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("casetest")
+	_, err = os.Lstat("CASETEST")
+	if insensitive != (err == nil) {
+		t.Errorf("IsCaseInsensitive returned %v, but lstat of other case returned %v", insensitive, err)
+	}
+}
+
+func TestSafeNames(t *testing.T) {
+	cases := []struct {
+		name, encoded string
+	}{
+		{"plain.txt", "plain.txt"},
+		{"a:b?c", "a\uf03ab\uf03fc"},
+		{"trailing. ", "trailing\uf02e\uf020"},
+		{"dots...", "dots\uf02e\uf02e\uf02e"},
+		{"in.side", "in.side"},
+		{"<\x01>", "\uf03c\uf001\uf03e"},
+		{filepath.Join("dir.", "x*"), filepath.Join("dir\uf02e", "x\uf02a")},
+		{filepath.Join("..", "."), filepath.Join("..", ".")},
+		{"räksmörgås", "räksmörgås"},
+	}
+
+	for _, tc := range cases {
+		if enc := osutil.EncodeFilename(tc.name); enc != tc.encoded {
+			t.Errorf("EncodeFilename(%q) = %q, expected %q", tc.name, enc, tc.encoded)
+		}
+		if dec := osutil.DecodeFilename(tc.encoded); dec != tc.name {
+			t.Errorf("DecodeFilename(%q) = %q, expected %q", tc.encoded, dec, tc.name)
+		}
+	}
+}
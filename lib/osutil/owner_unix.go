@@ -0,0 +1,68 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build !windows
+
+package osutil
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Owner returns the numeric user and group owning the file described by
+// info, as returned by Lstat or Stat.
+func Owner(info os.FileInfo) (uid, gid int, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+// CanChown returns true if we are privileged to give files away to other
+// users.
+func CanChown() bool {
+	return os.Geteuid() == 0
+}
+
+// UserName returns the name of the user with the given id, or the empty
+// string if it's not known.
+func UserName(uid int) string {
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return ""
+	}
+	return u.Username
+}
+
+// GroupName returns the name of the group with the given id, or the empty
+// string if it's not known.
+func GroupName(gid int) string {
+	g, err := user.LookupGroupId(strconv.Itoa(gid))
+	if err != nil {
+		return ""
+	}
+	return g.Name
+}
+
+// LookupOwner returns the local ids of the named user and group, falling
+// back to the given numeric ids for names that are empty or unknown here.
+func LookupOwner(userName, groupName string, uid, gid int) (int, int) {
+	if u, err := user.Lookup(userName); userName != "" && err == nil {
+		if id, err := strconv.Atoi(u.Uid); err == nil {
+			uid = id
+		}
+	}
+	if g, err := user.LookupGroup(groupName); groupName != "" && err == nil {
+		if id, err := strconv.Atoi(g.Gid); err == nil {
+			gid = id
+		}
+	}
+	return uid, gid
+}
@@ -0,0 +1,33 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package osutil
+
+import "os"
+
+// Files on Windows don't have a numeric owner and group.
+
+func Owner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+func CanChown() bool {
+	return false
+}
+
+func UserName(uid int) string {
+	return ""
+}
+
+func GroupName(gid int) string {
+	return ""
+}
+
+func LookupOwner(userName, groupName string, uid, gid int) (int, int) {
+	return uid, gid
+}
@@ -0,0 +1,29 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build linux
+
+package osutil
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	fallocKeepSize  = 0x01 // FALLOC_FL_KEEP_SIZE
+	fallocPunchHole = 0x02 // FALLOC_FL_PUNCH_HOLE
+)
+
+// PunchHole deallocates size bytes of the file at offset, leaving a hole
+// that reads as zeroes. The size of the file is not changed.
+func PunchHole(fd *os.File, offset, size int64) error {
+	err := syscall.Fallocate(int(fd.Fd()), fallocKeepSize|fallocPunchHole, offset, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return ErrHolesUnsupported
+	}
+	return err
+}
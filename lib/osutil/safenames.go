@@ -0,0 +1,86 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package osutil
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Characters not allowed in file names on Windows are stored as the
+// character at the same offset in this block of the Unicode private use
+// area, the same way as done by Cygwin and the Services for Macintosh.
+const safeNameOffset = 0xf000
+
+// unsafeNameChars are the characters that are always encoded. Spaces and
+// dots are only encoded at the end of a name.
+const unsafeNameChars = `<>:"|?*`
+
+func unsafeNameChar(r rune) bool {
+	return r > 0 && r < 0x20 || strings.ContainsRune(unsafeNameChars, r)
+}
+
+// EncodeFilename returns the path with each character that is not allowed
+// in a file name on Windows replaced by a private use character. The
+// replacement can be undone by DecodeFilename.
+func EncodeFilename(path string) string {
+	parts := strings.Split(path, string(filepath.Separator))
+	for i, part := range parts {
+		parts[i] = encodeName(part)
+	}
+	return strings.Join(parts, string(filepath.Separator))
+}
+
+func encodeName(name string) string {
+	// Trailing spaces and dots are dropped by Windows.
+	trail := len(name)
+	for trail > 0 && (name[trail-1] == ' ' || name[trail-1] == '.') {
+		trail--
+	}
+	if trail == 0 && (name == "." || name == "..") {
+		return name
+	}
+
+	var encoded []rune
+	for i, r := range name {
+		if unsafeNameChar(r) || i >= trail {
+			if encoded == nil {
+				encoded = []rune(name[:i])
+			}
+			r += safeNameOffset
+		}
+		if encoded != nil {
+			encoded = append(encoded, r)
+		}
+	}
+	if encoded == nil {
+		return name
+	}
+	return string(encoded)
+}
+
+// DecodeFilename returns the path with the characters replaced by
+// EncodeFilename restored.
+func DecodeFilename(path string) string {
+	if strings.IndexFunc(path, encodedNameChar) < 0 {
+		return path
+	}
+	return strings.Map(func(r rune) rune {
+		if encodedNameChar(r) {
+			return r - safeNameOffset
+		}
+		return r
+	}, path)
+}
+
+func encodedNameChar(r rune) bool {
+	if r <= safeNameOffset || r >= safeNameOffset+0x80 {
+		return false
+	}
+	plain := r - safeNameOffset
+	return unsafeNameChar(plain) || plain == ' ' || plain == '.'
+}
@@ -0,0 +1,110 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build linux
+
+package osutil
+
+import (
+	"strings"
+	"syscall"
+)
+
+const userXattrPrefix = "user."
+
+// UserXattrs returns the extended attributes in the user namespace of the
+// file, keyed by name without the namespace prefix.
+func UserXattrs(path string) (map[string][]byte, error) {
+	names, err := listXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make(map[string][]byte)
+	for _, name := range names {
+		if !strings.HasPrefix(name, userXattrPrefix) {
+			continue
+		}
+		value, err := getXattr(path, name)
+		if err != nil {
+			return nil, xattrError(err)
+		}
+		attrs[strings.TrimPrefix(name, userXattrPrefix)] = value
+	}
+	return attrs, nil
+}
+
+// SetUserXattrs makes the extended attributes in the user namespace of the
+// file be exactly the given ones.
+func SetUserXattrs(path string, attrs map[string][]byte) error {
+	names, err := listXattrs(path)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, userXattrPrefix) {
+			continue
+		}
+		if _, ok := attrs[strings.TrimPrefix(name, userXattrPrefix)]; !ok {
+			if err := syscall.Removexattr(path, name); err != nil {
+				return xattrError(err)
+			}
+		}
+	}
+	for name, value := range attrs {
+		if err := syscall.Setxattr(path, userXattrPrefix+name, value, 0); err != nil {
+			return xattrError(err)
+		}
+	}
+	return nil
+}
+
+func listXattrs(path string) ([]string, error) {
+	for {
+		size, err := syscall.Listxattr(path, nil)
+		if err != nil {
+			return nil, xattrError(err)
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		n, err := syscall.Listxattr(path, buf)
+		if err == syscall.ERANGE {
+			// The list grew in between; try again.
+			continue
+		}
+		if err != nil {
+			return nil, xattrError(err)
+		}
+		return strings.Split(strings.TrimRight(string(buf[:n]), "\x00"), "\x00"), nil
+	}
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	for {
+		size, err := syscall.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := syscall.Getxattr(path, name, buf)
+		if err == syscall.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+func xattrError(err error) error {
+	if err == syscall.ENOTSUP || err == syscall.EOPNOTSUPP {
+		return ErrXattrsUnsupported
+	}
+	return err
+}
@@ -0,0 +1,17 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build !linux
+
+package osutil
+
+func UserXattrs(path string) (map[string][]byte, error) {
+	return nil, ErrXattrsUnsupported
+}
+
+func SetUserXattrs(path string, attrs map[string][]byte) error {
+	return ErrXattrsUnsupported
+}
@@ -0,0 +1,93 @@
+// Copyright (C) 2015 The Protocol Authors.
+
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFileInfoWeakHashes(t *testing.T) {
+	hash := bytes.Repeat([]byte{0x42}, 32)
+	f := FileInfo{
+		Name:  "f",
+		Flags: 0644,
+		Blocks: []BlockInfo{
+			{Size: 1024, Hash: hash, WeakHash: 0x12345678},
+			{Size: 42, Hash: hash},
+		},
+	}
+
+	bs, err := f.MarshalXDR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dec FileInfo
+	if err := dec.UnmarshalXDR(bs); err != nil {
+		t.Fatal(err)
+	}
+	if dec.Flags != f.Flags {
+		t.Errorf("flags %o decoded as %o", f.Flags, dec.Flags)
+	}
+	for i := range f.Blocks {
+		if dec.Blocks[i].WeakHash != f.Blocks[i].WeakHash || !bytes.Equal(dec.Blocks[i].Hash, hash) {
+			t.Errorf("block %d: %v (weak %08x) decoded as %v (weak %08x)", i, f.Blocks[i], f.Blocks[i].WeakHash, dec.Blocks[i], dec.Blocks[i].WeakHash)
+		}
+	}
+
+	// The blocks themselves encode as they always have, and files without
+	// weak hashes don't carry the list at all.
+	if bs, _ := f.Blocks[0].MarshalXDR(); len(bs) != 4+4+32 {
+		t.Errorf("unexpected encoded block length %d", len(bs))
+	}
+	f.Blocks[0].WeakHash = 0
+	old, _ := f.MarshalXDR()
+	if len(old) != len(bs)-4-4*len(f.Blocks) {
+		t.Errorf("unexpected encoded length %d without weak hashes, %d with", len(old), len(bs))
+	}
+	if err := dec.UnmarshalXDR(old); err != nil {
+		t.Fatal(err)
+	}
+	if dec.Blocks[0].WeakHash != 0 {
+		t.Error("weak hash decoded from a file without weak hashes")
+	}
+}
+
+func TestBlockSizeFor(t *testing.T) {
+	cases := []struct {
+		fileSize  int64
+		blockSize int
+	}{
+		{0, BlockSize},
+		{1000, BlockSize},
+		{desiredPerFileBlocks * BlockSize, BlockSize},
+		{desiredPerFileBlocks*BlockSize + 1, 2 * BlockSize},
+		{desiredPerFileBlocks * 4 * BlockSize, 4 * BlockSize},
+		{1 << 40, MaxBlockSize},
+	}
+
+	for _, tc := range cases {
+		if bs := BlockSizeFor(tc.fileSize); bs != tc.blockSize {
+			t.Errorf("BlockSizeFor(%d) = %d, expected %d", tc.fileSize, bs, tc.blockSize)
+		}
+	}
+}
+
+func TestFileInfoBlockSize(t *testing.T) {
+	cases := []struct {
+		blocks    []BlockInfo
+		blockSize int
+	}{
+		{nil, BlockSize},
+		{[]BlockInfo{{Size: 42}}, BlockSize},
+		{[]BlockInfo{{Size: BlockSize}, {Size: 42}}, BlockSize},
+		{[]BlockInfo{{Size: 4 * BlockSize}, {Size: 42}}, 4 * BlockSize},
+	}
+
+	for i, tc := range cases {
+		f := FileInfo{Blocks: tc.blocks}
+		if bs := f.BlockSize(); bs != tc.blockSize {
+			t.Errorf("#%d: BlockSize() = %d, expected %d", i, bs, tc.blockSize)
+		}
+	}
+}
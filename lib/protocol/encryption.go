@@ -0,0 +1,147 @@
+// Copyright (C) 2015 The Protocol Authors.
+
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Folders shared with untrusted devices are sent to them encrypted. The
+// names, the contents and the metadata of files are encrypted with a key
+// derived from a password known only to the trusted devices. The encryption
+// is deterministic, so that all trusted devices produce the same encrypted
+// files and so that untrusted devices can deduplicate blocks; the price is
+// that an untrusted device can tell when two blocks or names are equal.
+
+const (
+	// EncryptionOverhead is the number of bytes an encrypted block is larger
+	// than the plain one.
+	EncryptionOverhead = nonceSize + tagSize
+
+	nonceSize = 12
+	tagSize   = 16
+
+	// The iteration count of the password based key derivation.
+	keyIterations = 100000
+
+	// Encrypted names are split into path components of at most this
+	// length, to stay within file system limits.
+	maxEncryptedNameComponent = 200
+)
+
+var (
+	ErrDecryption = errors.New("decryption failed")
+
+	nameEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// A FolderKey encrypts and decrypts the names and data of a folder. It is
+// safe for use from multiple goroutines.
+type FolderKey struct {
+	nameAEAD cipher.AEAD
+	dataAEAD cipher.AEAD
+	nameMAC  []byte
+	dataMAC  []byte
+}
+
+// KeyFromPassword derives the key for the given folder from the password.
+// The folder ID is used as salt, so the same password gives different keys
+// for different folders.
+func KeyFromPassword(folderID, password string) *FolderKey {
+	master := pbkdf2.Key([]byte(password), []byte("syncthing"+folderID), keyIterations, 32, sha256.New)
+	return &FolderKey{
+		nameAEAD: newAEAD(subKey(master, "name")),
+		dataAEAD: newAEAD(subKey(master, "data")),
+		nameMAC:  subKey(master, "name nonce"),
+		dataMAC:  subKey(master, "data nonce"),
+	}
+}
+
+// EncryptName returns the encrypted form of the slash separated name. The
+// result is slash separated as well, consisting of one or more path
+// components that are valid file names on all supported platforms.
+func (k *FolderKey) EncryptName(name string) string {
+	enc := nameEncoding.EncodeToString(seal(k.nameAEAD, k.nameMAC, []byte(name)))
+	var parts []string
+	for len(enc) > maxEncryptedNameComponent {
+		parts = append(parts, enc[:maxEncryptedNameComponent])
+		enc = enc[maxEncryptedNameComponent:]
+	}
+	return strings.Join(append(parts, enc), "/")
+}
+
+// DecryptName returns the plain name given the encrypted name, in which the
+// path components may be separated by slashes or backslashes.
+func (k *FolderKey) DecryptName(name string) (string, error) {
+	name = strings.Replace(strings.Replace(name, "/", "", -1), "\\", "", -1)
+	bs, err := nameEncoding.DecodeString(name)
+	if err != nil {
+		return "", ErrDecryption
+	}
+	plain, err := open(k.nameAEAD, bs)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// EncryptBlock returns the encrypted form of the data.
+func (k *FolderKey) EncryptBlock(data []byte) []byte {
+	return seal(k.dataAEAD, k.dataMAC, data)
+}
+
+// DecryptBlock returns the plain data of the encrypted block, or
+// ErrDecryption if it wasn't encrypted with this key or has been tampered
+// with.
+func (k *FolderKey) DecryptBlock(data []byte) ([]byte, error) {
+	return open(k.dataAEAD, data)
+}
+
+// seal encrypts the data with a nonce derived from the data itself, and
+// returns the nonce followed by the ciphertext.
+func seal(aead cipher.AEAD, macKey, data []byte) []byte {
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(data)
+	nonce := mac.Sum(nil)[:nonceSize]
+
+	out := make([]byte, nonceSize, nonceSize+len(data)+tagSize)
+	copy(out, nonce)
+	return aead.Seal(out, nonce, data, nil)
+}
+
+func open(aead cipher.AEAD, data []byte) ([]byte, error) {
+	if len(data) < EncryptionOverhead {
+		return nil, ErrDecryption
+	}
+	plain, err := aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return nil, ErrDecryption
+	}
+	return plain, nil
+}
+
+func newAEAD(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+func subKey(master []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
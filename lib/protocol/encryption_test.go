@@ -0,0 +1,76 @@
+// Copyright (C) 2015 The Protocol Authors.
+
+package protocol
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEncryptName(t *testing.T) {
+	key := KeyFromPassword("folder", "password")
+
+	names := []string{"foo", "foo/bar/baz.txt", strings.Repeat("long name/", 50)}
+	for _, name := range names {
+		enc := key.EncryptName(name)
+		if enc == name || strings.Contains(enc, "foo") {
+			t.Errorf("Name %q not encrypted: %q", name, enc)
+		}
+		if enc != key.EncryptName(name) {
+			t.Errorf("Encryption of %q is not deterministic", name)
+		}
+		for _, part := range strings.Split(enc, "/") {
+			if len(part) > maxEncryptedNameComponent {
+				t.Errorf("Too long path component %q", part)
+			}
+		}
+
+		dec, err := key.DecryptName(strings.Replace(enc, "/", "\\", -1))
+		if err != nil {
+			t.Error(err)
+		} else if dec != name {
+			t.Errorf("Decrypted name %q != %q", dec, name)
+		}
+	}
+
+	// Another folder or password gives another key.
+	if KeyFromPassword("other", "password").EncryptName("foo") == key.EncryptName("foo") {
+		t.Error("Same encryption for another folder")
+	}
+	if _, err := KeyFromPassword("folder", "wrong").DecryptName(key.EncryptName("foo")); err != ErrDecryption {
+		t.Errorf("Unexpected error %v decrypting with the wrong password", err)
+	}
+	if _, err := key.DecryptName("not encrypted"); err != ErrDecryption {
+		t.Errorf("Unexpected error %v decrypting plain name", err)
+	}
+}
+
+func TestEncryptBlock(t *testing.T) {
+	key := KeyFromPassword("folder", "password")
+	data := []byte("some data in a block")
+
+	enc := key.EncryptBlock(data)
+	if len(enc) != len(data)+EncryptionOverhead {
+		t.Errorf("Encrypted length %d != %d", len(enc), len(data)+EncryptionOverhead)
+	}
+	if bytes.Contains(enc, []byte("data")) {
+		t.Error("Block not encrypted")
+	}
+	if !bytes.Equal(enc, key.EncryptBlock(data)) {
+		t.Error("Encryption is not deterministic")
+	}
+
+	dec, err := key.DecryptBlock(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dec, data) {
+		t.Errorf("Decrypted %q != %q", dec, data)
+	}
+
+	enc[len(enc)-1]++
+	if _, err := key.DecryptBlock(enc); err != ErrDecryption {
+		t.Errorf("Unexpected error %v decrypting tampered block", err)
+	}
+}
@@ -11,27 +11,31 @@ const (
 	ecGeneric
 	ecNoSuchFile
 	ecInvalid
+	ecHashMismatch
 )
 
 var (
-	ErrNoError    error
-	ErrGeneric    = errors.New("generic error")
-	ErrNoSuchFile = errors.New("no such file")
-	ErrInvalid    = errors.New("file is invalid")
+	ErrNoError      error
+	ErrGeneric      = errors.New("generic error")
+	ErrNoSuchFile   = errors.New("no such file")
+	ErrInvalid      = errors.New("file is invalid")
+	ErrHashMismatch = errors.New("block hash mismatch")
 )
 
 var lookupError = map[int32]error{
-	ecNoError:    ErrNoError,
-	ecGeneric:    ErrGeneric,
-	ecNoSuchFile: ErrNoSuchFile,
-	ecInvalid:    ErrInvalid,
+	ecNoError:      ErrNoError,
+	ecGeneric:      ErrGeneric,
+	ecNoSuchFile:   ErrNoSuchFile,
+	ecInvalid:      ErrInvalid,
+	ecHashMismatch: ErrHashMismatch,
 }
 
 var lookupCode = map[error]int32{
-	ErrNoError:    ecNoError,
-	ErrGeneric:    ecGeneric,
-	ErrNoSuchFile: ecNoSuchFile,
-	ErrInvalid:    ecInvalid,
+	ErrNoError:      ecNoError,
+	ErrGeneric:      ecGeneric,
+	ErrNoSuchFile:   ecNoSuchFile,
+	ErrInvalid:      ecInvalid,
+	ErrHashMismatch: ecHashMismatch,
 }
 
 func codeToError(errcode int32) error {
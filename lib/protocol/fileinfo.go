@@ -0,0 +1,351 @@
+// Copyright (C) 2015 The Protocol Authors.
+
+package protocol
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/calmh/xdr"
+)
+
+type FileInfo struct {
+	Name         string
+	Flags        uint32
+	Modified     int64
+	Version      Vector
+	LocalVersion int64
+	CachedSize   int64 // cache only
+	Blocks       []BlockInfo
+	Posix        PosixMeta // only when FlagPosixMeta is set
+	HardLink     string    // only when FlagHardLink is set
+}
+
+// PosixMeta flags, telling which parts of the metadata are known
+const (
+	PosixMetaOwnership uint32 = 1 << iota
+	PosixMetaXattrs
+)
+
+// PosixMeta is the ownership and extended attributes of a file, exchanged
+// with devices that have announced support for them.
+type PosixMeta struct {
+	Flags  uint32
+	UID    uint32
+	GID    uint32
+	User   string
+	Group  string
+	Xattrs []Xattr // sorted by name
+}
+
+// An Xattr is an extended attribute in the user namespace, named without
+// the namespace prefix.
+type Xattr struct {
+	Name  string
+	Value []byte
+}
+
+/*
+
+FileInfo Structure:
+
+ 0                   1                   2                   3
+ 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                        Length of Name                         |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\                    Name (variable length)                     \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                             Flags                             |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                                                               |
++                      Modified (64 bits)                       +
+|                                                               |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\                       Vector Structure                        \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                                                               |
++                    Local Version (64 bits)                    +
+|                                                               |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                       Number of Blocks                        |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\               Zero or more BlockInfo Structures               \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\            PosixMeta Structure (if FlagPosixMeta)             \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|             Length of Hard Link (if FlagHardLink)             |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\          Hard Link (variable length, if FlagHardLink)         \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|           Number of Weak Hashes (if FlagWeakHashes)           |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|        Zero or more Weak Hashes (if FlagWeakHashes)           |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+
+struct FileInfo {
+	string Name<8192>;
+	unsigned int Flags;
+	hyper Modified;
+	Vector Version;
+	hyper LocalVersion;
+	BlockInfo Blocks<1000000>;
+	PosixMeta Posix; // only if Flags & FlagPosixMeta
+	string HardLink<8192>; // only if Flags & FlagHardLink
+	unsigned int WeakHashes<1000000>; // only if Flags & FlagWeakHashes
+}
+
+struct PosixMeta {
+	unsigned int Flags;
+	unsigned int UID;
+	unsigned int GID;
+	string User<256>;
+	string Group<256>;
+	Xattr Xattrs<1024>;
+}
+
+struct Xattr {
+	string Name<256>;
+	opaque Value<65536>;
+}
+
+The encoding is written by hand instead of by genxdr, as the PosixMeta
+structure and the HardLink name are optional. Devices that have not
+announced support for them must be sent files with the FlagPosixMeta and
+FlagHardLink flags cleared, in which case the encoding is what it has always
+been.
+
+HardLink is the name of the file, in the same folder, that this file is a
+hard link to.
+
+WeakHashes are the weak hashes of the blocks, in the same order. They are
+encoded, with FlagWeakHashes set, whenever any block has one, and moved back
+into the blocks when decoding, clearing the flag again. Devices that have
+not announced support for weak hashes must be sent blocks without them.
+
+*/
+
+func (o FileInfo) EncodeXDR(w io.Writer) (int, error) {
+	var xw = xdr.NewWriter(w)
+	return o.EncodeXDRInto(xw)
+}
+
+func (o FileInfo) MarshalXDR() ([]byte, error) {
+	return o.AppendXDR(make([]byte, 0, 128))
+}
+
+func (o FileInfo) MustMarshalXDR() []byte {
+	bs, err := o.MarshalXDR()
+	if err != nil {
+		panic(err)
+	}
+	return bs
+}
+
+func (o FileInfo) AppendXDR(bs []byte) ([]byte, error) {
+	var aw = xdr.AppendWriter(bs)
+	var xw = xdr.NewWriter(&aw)
+	_, err := o.EncodeXDRInto(xw)
+	return []byte(aw), err
+}
+
+func (o FileInfo) EncodeXDRInto(xw *xdr.Writer) (int, error) {
+	if l := len(o.Name); l > 8192 {
+		return xw.Tot(), xdr.ElementSizeExceeded("Name", l, 8192)
+	}
+	xw.WriteString(o.Name)
+	flags := o.Flags &^ FlagWeakHashes
+	if hasWeakHashes(o.Blocks) {
+		flags |= FlagWeakHashes
+	}
+	xw.WriteUint32(flags)
+	xw.WriteUint64(uint64(o.Modified))
+	_, err := o.Version.EncodeXDRInto(xw)
+	if err != nil {
+		return xw.Tot(), err
+	}
+	xw.WriteUint64(uint64(o.LocalVersion))
+	if l := len(o.Blocks); l > 1000000 {
+		return xw.Tot(), xdr.ElementSizeExceeded("Blocks", l, 1000000)
+	}
+	xw.WriteUint32(uint32(len(o.Blocks)))
+	for i := range o.Blocks {
+		_, err := o.Blocks[i].EncodeXDRInto(xw)
+		if err != nil {
+			return xw.Tot(), err
+		}
+	}
+	if o.Flags&FlagPosixMeta != 0 {
+		_, err := o.Posix.EncodeXDRInto(xw)
+		if err != nil {
+			return xw.Tot(), err
+		}
+	}
+	if o.Flags&FlagHardLink != 0 {
+		if l := len(o.HardLink); l > 8192 {
+			return xw.Tot(), xdr.ElementSizeExceeded("HardLink", l, 8192)
+		}
+		xw.WriteString(o.HardLink)
+	}
+	if flags&FlagWeakHashes != 0 {
+		xw.WriteUint32(uint32(len(o.Blocks)))
+		for i := range o.Blocks {
+			xw.WriteUint32(o.Blocks[i].WeakHash)
+		}
+	}
+	return xw.Tot(), xw.Error()
+}
+
+func (o *FileInfo) DecodeXDR(r io.Reader) error {
+	xr := xdr.NewReader(r)
+	return o.DecodeXDRFrom(xr)
+}
+
+func (o *FileInfo) UnmarshalXDR(bs []byte) error {
+	var br = bytes.NewReader(bs)
+	var xr = xdr.NewReader(br)
+	return o.DecodeXDRFrom(xr)
+}
+
+func (o *FileInfo) DecodeXDRFrom(xr *xdr.Reader) error {
+	o.Name = xr.ReadStringMax(8192)
+	o.Flags = xr.ReadUint32()
+	o.Modified = int64(xr.ReadUint64())
+	(&o.Version).DecodeXDRFrom(xr)
+	o.LocalVersion = int64(xr.ReadUint64())
+	_BlocksSize := int(xr.ReadUint32())
+	if _BlocksSize < 0 {
+		return xdr.ElementSizeExceeded("Blocks", _BlocksSize, 1000000)
+	}
+	if _BlocksSize > 1000000 {
+		return xdr.ElementSizeExceeded("Blocks", _BlocksSize, 1000000)
+	}
+	o.Blocks = make([]BlockInfo, _BlocksSize)
+	for i := range o.Blocks {
+		(&o.Blocks[i]).DecodeXDRFrom(xr)
+	}
+	o.Posix = PosixMeta{}
+	if o.Flags&FlagPosixMeta != 0 {
+		if err := (&o.Posix).DecodeXDRFrom(xr); err != nil {
+			return err
+		}
+	}
+	o.HardLink = ""
+	if o.Flags&FlagHardLink != 0 {
+		o.HardLink = xr.ReadStringMax(8192)
+	}
+	if o.Flags&FlagWeakHashes != 0 {
+		o.Flags &^= FlagWeakHashes
+		_WeakHashesSize := int(xr.ReadUint32())
+		if _WeakHashesSize != len(o.Blocks) {
+			return xdr.ElementSizeExceeded("WeakHashes", _WeakHashesSize, len(o.Blocks))
+		}
+		for i := range o.Blocks {
+			o.Blocks[i].WeakHash = xr.ReadUint32()
+		}
+	}
+	return xr.Error()
+}
+
+func hasWeakHashes(blocks []BlockInfo) bool {
+	for _, b := range blocks {
+		if b.WeakHash != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (o PosixMeta) EncodeXDRInto(xw *xdr.Writer) (int, error) {
+	xw.WriteUint32(o.Flags)
+	xw.WriteUint32(o.UID)
+	xw.WriteUint32(o.GID)
+	if l := len(o.User); l > 256 {
+		return xw.Tot(), xdr.ElementSizeExceeded("User", l, 256)
+	}
+	xw.WriteString(o.User)
+	if l := len(o.Group); l > 256 {
+		return xw.Tot(), xdr.ElementSizeExceeded("Group", l, 256)
+	}
+	xw.WriteString(o.Group)
+	if l := len(o.Xattrs); l > 1024 {
+		return xw.Tot(), xdr.ElementSizeExceeded("Xattrs", l, 1024)
+	}
+	xw.WriteUint32(uint32(len(o.Xattrs)))
+	for _, x := range o.Xattrs {
+		if l := len(x.Name); l > 256 {
+			return xw.Tot(), xdr.ElementSizeExceeded("Name", l, 256)
+		}
+		xw.WriteString(x.Name)
+		if l := len(x.Value); l > 65536 {
+			return xw.Tot(), xdr.ElementSizeExceeded("Value", l, 65536)
+		}
+		xw.WriteBytes(x.Value)
+	}
+	return xw.Tot(), xw.Error()
+}
+
+func (o *PosixMeta) DecodeXDRFrom(xr *xdr.Reader) error {
+	o.Flags = xr.ReadUint32()
+	o.UID = xr.ReadUint32()
+	o.GID = xr.ReadUint32()
+	o.User = xr.ReadStringMax(256)
+	o.Group = xr.ReadStringMax(256)
+	_XattrsSize := int(xr.ReadUint32())
+	if _XattrsSize < 0 || _XattrsSize > 1024 {
+		return xdr.ElementSizeExceeded("Xattrs", _XattrsSize, 1024)
+	}
+	o.Xattrs = nil
+	if _XattrsSize > 0 {
+		o.Xattrs = make([]Xattr, _XattrsSize)
+	}
+	for i := range o.Xattrs {
+		o.Xattrs[i].Name = xr.ReadStringMax(256)
+		o.Xattrs[i].Value = xr.ReadBytesMax(65536)
+	}
+	return xr.Error()
+}
+
+// OwnerEqual returns true if both have the same ownership. Users and groups
+// are compared by name when both sides know them, as the numeric ids may
+// differ between devices.
+func (o PosixMeta) OwnerEqual(other PosixMeta) bool {
+	if o.Flags&PosixMetaOwnership == 0 || other.Flags&PosixMetaOwnership == 0 {
+		return o.Flags&PosixMetaOwnership == other.Flags&PosixMetaOwnership
+	}
+	if o.User != "" && other.User != "" {
+		if o.User != other.User {
+			return false
+		}
+	} else if o.UID != other.UID {
+		return false
+	}
+	if o.Group != "" && other.Group != "" {
+		return o.Group == other.Group
+	}
+	return o.GID == other.GID
+}
+
+// XattrsEqual returns true if both have the same extended attributes.
+func (o PosixMeta) XattrsEqual(other PosixMeta) bool {
+	if o.Flags&PosixMetaXattrs != other.Flags&PosixMetaXattrs || len(o.Xattrs) != len(other.Xattrs) {
+		return false
+	}
+	for i := range o.Xattrs {
+		if o.Xattrs[i].Name != other.Xattrs[i].Name || !bytes.Equal(o.Xattrs[i].Value, other.Xattrs[i].Value) {
+			return false
+		}
+	}
+	return true
+}
@@ -14,16 +14,6 @@ type IndexMessage struct {
 	Options []Option // max:64
 }
 
-type FileInfo struct {
-	Name         string // max:8192
-	Flags        uint32
-	Modified     int64
-	Version      Vector
-	LocalVersion int64
-	CachedSize   int64       // noencode (cache only)
-	Blocks       []BlockInfo // max:1000000
-}
-
 func (f FileInfo) String() string {
 	return fmt.Sprintf("File{Name:%q, Flags:0%o, Modified:%d, Version:%v, Size:%d, Blocks:%v}",
 		f.Name, f.Flags, f.Modified, f.Version, f.Size(), f.Blocks)
@@ -39,6 +29,32 @@ func (f FileInfo) Size() (bytes int64) {
 	return
 }
 
+// BlockSize returns the size of the blocks the file was hashed with. All
+// blocks but the last one are of this size, so it's given by the first
+// block. Files consisting of a single block are considered to use at least
+// the standard block size.
+func (f FileInfo) BlockSize() int {
+	if len(f.Blocks) == 0 || int(f.Blocks[0].Size) < BlockSize {
+		return BlockSize
+	}
+	return int(f.Blocks[0].Size)
+}
+
+// desiredPerFileBlocks is the number of blocks we aim to not exceed when
+// choosing the block size for a large file.
+const desiredPerFileBlocks = 2000
+
+// BlockSizeFor returns the block size to use for a file of the given size;
+// the smallest power of two between BlockSize and MaxBlockSize that results
+// in no more than desiredPerFileBlocks blocks, when possible.
+func BlockSizeFor(fileSize int64) int {
+	bs := BlockSize
+	for bs < MaxBlockSize && fileSize > int64(bs)*desiredPerFileBlocks {
+		bs <<= 1
+	}
+	return bs
+}
+
 func (f FileInfo) IsDeleted() bool {
 	return f.Flags&FlagDeleted != 0
 }
@@ -85,9 +101,10 @@ func (f FileInfo) WinsConflict(other FileInfo) bool {
 }
 
 type BlockInfo struct {
-	Offset int64 // noencode (cache only)
-	Size   int32
-	Hash   []byte // max:64
+	Offset   int64 // noencode (cache only)
+	Size     int32
+	Hash     []byte // max:64
+	WeakHash uint32 // noencode (sent in the FileInfo, when both sides support it)
 }
 
 func (b BlockInfo) String() string {
@@ -18,6 +18,9 @@ const (
 	// BlockSize is the standard ata block size (128 KiB)
 	BlockSize = 128 << 10
 
+	// MaxBlockSize is the largest block size used for large files (16 MiB)
+	MaxBlockSize = 16 << 20
+
 	// MaxMessageLen is the largest message size allowed on the wire. (64 MiB)
 	MaxMessageLen = 64 << 20
 )
@@ -48,6 +51,26 @@ const (
 
 	FlagsAll = (1 << 18) - 1
 
+	// FlagLocalChanged is never sent on the wire. It marks files in a
+	// receive only folder that have been modified locally; such files are
+	// also flagged invalid so that they are not announced to the cluster.
+	FlagLocalChanged = 1 << 18
+
+	// FlagPosixMeta marks files carrying ownership and extended attributes.
+	// It is only sent to devices that have announced support for it, as the
+	// metadata changes the encoding of the file.
+	FlagPosixMeta = 1 << 19
+
+	// FlagHardLink marks files that are hard links to another file in the
+	// folder. Like FlagPosixMeta it is only sent to devices that have
+	// announced support for it.
+	FlagHardLink = 1 << 20
+
+	// FlagWeakHashes is only used on the wire and in the database, marking
+	// files followed by the weak hashes of their blocks. It is set and
+	// cleared when encoding and decoding files; see FileInfo.
+	FlagWeakHashes = 1 << 21
+
 	SymlinkTypeMask = FlagDirectory | FlagSymlinkMissingTarget
 )
 
@@ -518,6 +541,14 @@ func filterIndexMessageFiles(fs []FileInfo) []FileInfo {
 
 func (c *rawConnection) handleRequest(msgID int, req RequestMessage) {
 	size := int(req.Size)
+	if size < 0 || size > MaxBlockSize {
+		// No block is larger than this, so don't allocate the buffer for it.
+		c.send(msgID, messageTypeResponse, ResponseMessage{
+			Data: nil,
+			Code: errorToCode(ErrInvalid),
+		}, nil)
+		return
+	}
 	usePool := size <= BlockSize
 
 	var buf []byte
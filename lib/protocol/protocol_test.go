@@ -189,6 +189,23 @@ func TestMarshalIndexMessage(t *testing.T) {
 	f := func(m1 IndexMessage) bool {
 		for i, f := range m1.Files {
 			m1.Files[i].CachedSize = 0
+			// The flag only tells weak hashes follow on the wire.
+			m1.Files[i].Flags &^= FlagWeakHashes
+			if f.Flags&FlagPosixMeta == 0 {
+				m1.Files[i].Posix = PosixMeta{}
+			} else {
+				if len(f.Posix.Xattrs) == 0 {
+					m1.Files[i].Posix.Xattrs = nil
+				}
+				for j := range f.Posix.Xattrs {
+					if len(f.Posix.Xattrs[j].Value) == 0 {
+						f.Posix.Xattrs[j].Value = nil
+					}
+				}
+			}
+			if f.Flags&FlagHardLink == 0 {
+				m1.Files[i].HardLink = ""
+			}
 			for j := range f.Blocks {
 				f.Blocks[j].Offset = 0
 				if len(f.Blocks[j].Hash) == 0 {
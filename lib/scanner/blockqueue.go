@@ -7,9 +7,12 @@
 package scanner
 
 import (
+	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 
+	"github.com/syncthing/syncthing/lib/osutil"
 	"github.com/syncthing/syncthing/lib/protocol"
 	"github.com/syncthing/syncthing/lib/sync"
 )
@@ -17,15 +20,29 @@ import (
 // The parallell hasher reads FileInfo structures from the inbox, hashes the
 // file to populate the Blocks element and sends it to the outbox. A number of
 // workers are used in parallel. The outbox will become closed when the inbox
-// is closed and all items handled.
+// is closed and all items handled. Reading the files waits on the limiter,
+// if not nil, and with lowPriority the workers run on threads of their own
+// at the lowest priority the system allows.
 
-func newParallelHasher(dir string, blockSize, workers int, outbox, inbox chan protocol.FileInfo, counter *int64, done chan struct{}) {
+func newParallelHasher(dir string, blockSize, workers int, largeBlocks, safeNames bool, limiter RateLimiter, lowPriority bool, outbox, inbox chan protocol.FileInfo, counter *int64, done chan struct{}) {
 	wg := sync.NewWaitGroup()
 	wg.Add(workers)
 
 	for i := 0; i < workers; i++ {
 		go func() {
-			hashFiles(dir, blockSize, outbox, inbox, counter)
+			if lowPriority {
+				runtime.LockOSThread()
+				restore, err := osutil.SetLowPriority()
+				if err != nil && debug {
+					l.Debugln("set low priority:", err)
+				}
+				if restore != nil {
+					defer restoreThreadPriority(restore)
+				} else {
+					runtime.UnlockOSThread()
+				}
+			}
+			hashFiles(dir, blockSize, largeBlocks, safeNames, limiter, outbox, inbox, counter)
 			wg.Done()
 		}()
 	}
@@ -39,7 +56,26 @@ func newParallelHasher(dir string, blockSize, workers int, outbox, inbox chan pr
 	}()
 }
 
+// restoreThreadPriority restores the priority of the locked thread, and
+// unlocks it to run other routines again. A thread that can't be restored
+// is left locked; it then exits along with the routine on Go 1.10 and
+// later, while older versions keep it at the low priority.
+func restoreThreadPriority(restore func() error) {
+	if err := restore(); err != nil {
+		if debug {
+			l.Debugln("restore priority:", err)
+		}
+		return
+	}
+	runtime.UnlockOSThread()
+}
+
 func HashFile(path string, blockSize int, sizeHint int64, counter *int64) ([]protocol.BlockInfo, error) {
+	return hashFile(path, blockSize, sizeHint, nil, counter, nil)
+}
+
+// hashFile returns the blocks of the file, hashed by h if not nil.
+func hashFile(path string, blockSize int, sizeHint int64, limiter RateLimiter, counter *int64, h *blockHasher) ([]protocol.BlockInfo, error) {
 	fd, err := os.Open(path)
 	if err != nil {
 		if debug {
@@ -60,16 +96,35 @@ func HashFile(path string, blockSize int, sizeHint int64, counter *int64) ([]pro
 		sizeHint = fi.Size()
 	}
 
-	return Blocks(fd, blockSize, sizeHint, counter)
+	var r io.Reader = fd
+	if limiter != nil {
+		r = &limitedReader{r: fd, limiter: limiter}
+	}
+	if h == nil {
+		h = new(blockHasher)
+	}
+	return h.blocks(r, blockSize, sizeHint, counter)
 }
 
-func hashFiles(dir string, blockSize int, outbox, inbox chan protocol.FileInfo, counter *int64) {
+func hashFiles(dir string, blockSize int, largeBlocks, safeNames bool, limiter RateLimiter, outbox, inbox chan protocol.FileInfo, counter *int64) {
+	// The block sized buffer is reused for all files.
+	var h blockHasher
 	for f := range inbox {
 		if f.IsDirectory() || f.IsDeleted() {
 			panic("Bug. Asked to hash a directory or a deleted file.")
 		}
 
-		blocks, err := HashFile(filepath.Join(dir, f.Name), blockSize, f.CachedSize, counter)
+		fileBlockSize := blockSize
+		if largeBlocks {
+			fileBlockSize = protocol.BlockSizeFor(f.CachedSize)
+		}
+
+		name := f.Name
+		if safeNames {
+			name = osutil.EncodeFilename(name)
+		}
+
+		blocks, err := hashFile(filepath.Join(dir, name), fileBlockSize, f.CachedSize, limiter, counter, &h)
 		if err != nil {
 			if debug {
 				l.Debugln("hash error:", f.Name, err)
@@ -81,3 +136,27 @@ func hashFiles(dir string, blockSize int, outbox, inbox chan protocol.FileInfo,
 		outbox <- f
 	}
 }
+
+// A RateLimiter paces the reading of files for hashing.
+type RateLimiter interface {
+	// Wait returns when count more bytes may be read.
+	Wait(count int64)
+}
+
+// limitedReadSize is the most a limitedReader reads at once, so that reading
+// a large block is paced as well.
+const limitedReadSize = 128 << 10
+
+// A limitedReader waits on the limiter before reading data.
+type limitedReader struct {
+	r       io.Reader
+	limiter RateLimiter
+}
+
+func (r *limitedReader) Read(bs []byte) (int, error) {
+	if len(bs) > limitedReadSize {
+		bs = bs[:limitedReadSize]
+	}
+	r.limiter.Wait(int64(len(bs)))
+	return r.r.Read(bs)
+}
@@ -14,21 +14,41 @@ import (
 	"sync/atomic"
 
 	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syncthing/syncthing/lib/sync"
+	"github.com/syncthing/syncthing/lib/weakhash"
 )
 
 var SHA256OfNothing = []uint8{0xe3, 0xb0, 0xc4, 0x42, 0x98, 0xfc, 0x1c, 0x14, 0x9a, 0xfb, 0xf4, 0xc8, 0x99, 0x6f, 0xb9, 0x24, 0x27, 0xae, 0x41, 0xe4, 0x64, 0x9b, 0x93, 0x4c, 0xa4, 0x95, 0x99, 0x1b, 0x78, 0x52, 0xb8, 0x55}
 
-// Blocks returns the blockwise hash of the reader.
+// Blocks returns the blockwise hash of the reader. Each block carries both
+// the SHA-256 hash and the weak rolling checksum of its contents.
 func Blocks(r io.Reader, blocksize int, sizehint int64, counter *int64) ([]protocol.BlockInfo, error) {
+	var h blockHasher
+	return h.blocks(r, blocksize, sizehint, counter)
+}
+
+// A blockHasher hashes one file after another, reusing its read buffer.
+type blockHasher struct {
+	buf []byte
+}
+
+func (h *blockHasher) blocks(r io.Reader, blocksize int, sizehint int64, counter *int64) ([]protocol.BlockInfo, error) {
 	var blocks []protocol.BlockInfo
 	if sizehint > 0 {
 		blocks = make([]protocol.BlockInfo, 0, int(sizehint/int64(blocksize)))
 	}
 	var offset int64
 	hf := sha256.New()
+	wf := weakhash.New()
+	if cap(h.buf) < blocksize {
+		h.buf = make([]byte, blocksize)
+	}
+	buf := h.buf[:blocksize]
 	for {
-		lr := &io.LimitedReader{R: r, N: int64(blocksize)}
-		n, err := io.Copy(hf, lr)
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -41,15 +61,29 @@ func Blocks(r io.Reader, blocksize int, sizehint int64, counter *int64) ([]proto
 			atomic.AddInt64(counter, int64(n))
 		}
 
+		wf.Write(buf[:n])
 		b := protocol.BlockInfo{
-			Size:   int32(n),
-			Offset: offset,
-			Hash:   hf.Sum(nil),
+			Size:     int32(n),
+			Offset:   offset,
+			WeakHash: wf.Sum32(),
+		}
+		if zh, ok := zeroHash(n); ok && n == blocksize && isZero(buf) {
+			// Holes in sparse files are common enough that it's worth not
+			// hashing them over and over.
+			b.Hash = zh
+		} else {
+			hf.Write(buf[:n])
+			b.Hash = hf.Sum(nil)
 		}
 		blocks = append(blocks, b)
 		offset += int64(n)
 
 		hf.Reset()
+		wf.Reset()
+
+		if n < blocksize {
+			break
+		}
 	}
 
 	if len(blocks) == 0 {
@@ -64,6 +98,52 @@ func Blocks(r io.Reader, blocksize int, sizehint int64, counter *int64) ([]proto
 	return blocks, nil
 }
 
+var (
+	zeroHashes    = make(map[int][]byte)
+	zeroHashesMut = sync.NewMutex()
+)
+
+// zeroHash returns the SHA-256 hash of size zero bytes. Only full blocks,
+// of one of the power of two block sizes, are considered for being zero,
+// so there are few hashes to keep and the odd sized tail blocks of files
+// are not hashed again for it.
+func zeroHash(size int) ([]byte, bool) {
+	if size <= 0 || size&(size-1) != 0 {
+		return nil, false
+	}
+
+	zeroHashesMut.Lock()
+	h, ok := zeroHashes[size]
+	zeroHashesMut.Unlock()
+	if ok {
+		return h, true
+	}
+
+	// Hashed without holding the lock, as it may take a while for the
+	// largest blocks. Should several do it at once, they agree.
+	sum := sha256.Sum256(make([]byte, size))
+	zeroHashesMut.Lock()
+	zeroHashes[size] = sum[:]
+	zeroHashesMut.Unlock()
+	return sum[:], true
+}
+
+func isZero(bs []byte) bool {
+	for _, b := range bs {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// IsZeroBlock returns true if the block consists entirely of zero bytes,
+// meaning it can be left as a hole in a sparse file instead of being written.
+func IsZeroBlock(b protocol.BlockInfo) bool {
+	h, ok := zeroHash(int(b.Size))
+	return ok && bytes.Equal(b.Hash, h)
+}
+
 // PopulateOffsets sets the Offset field on each block
 func PopulateOffsets(blocks []protocol.BlockInfo) {
 	var offset int64
@@ -74,7 +154,8 @@ func PopulateOffsets(blocks []protocol.BlockInfo) {
 }
 
 // BlockDiff returns lists of common and missing (to transform src into tgt)
-// blocks. Both block lists must have been created with the same block size.
+// blocks. Block lists created with different block sizes have no blocks in
+// common.
 func BlockDiff(src, tgt []protocol.BlockInfo) (have, need []protocol.BlockInfo) {
 	if len(tgt) == 0 && len(src) != 0 {
 		return nil, nil
@@ -86,7 +167,7 @@ func BlockDiff(src, tgt []protocol.BlockInfo) (have, need []protocol.BlockInfo)
 	}
 
 	for i := range tgt {
-		if i >= len(src) || bytes.Compare(tgt[i].Hash, src[i].Hash) != 0 {
+		if i >= len(src) || tgt[i].Size != src[i].Size || bytes.Compare(tgt[i].Hash, src[i].Hash) != 0 {
 			// Copy differing block
 			need = append(need, tgt[i])
 		} else {
@@ -8,7 +8,9 @@ package scanner
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
+	"reflect"
 	"testing"
 
 	"github.com/syncthing/syncthing/lib/protocol"
@@ -83,6 +85,55 @@ func TestBlocks(t *testing.T) {
 	}
 }
 
+func TestZeroBlocks(t *testing.T) {
+	data := make([]byte, 2*1024+10)
+	data[1024] = 1
+	blocks, err := Blocks(bytes.NewReader(data), 1024, int64(len(data)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 3 {
+		t.Fatalf("Incorrect number of blocks %d != 3", len(blocks))
+	}
+
+	// Only full blocks are considered for being zero.
+	for i, zero := range []bool{true, false, false} {
+		if IsZeroBlock(blocks[i]) != zero {
+			t.Errorf("Block %d: IsZeroBlock != %v", i, zero)
+		}
+		bs := data[blocks[i].Offset : blocks[i].Offset+int64(blocks[i].Size)]
+		if h := sha256.Sum256(bs); !bytes.Equal(blocks[i].Hash, h[:]) {
+			t.Errorf("Block %d: incorrect hash %x != %x", i, blocks[i].Hash, h)
+		}
+	}
+}
+
+func TestZeroHashBlockSizes(t *testing.T) {
+	for _, size := range []int{1024, protocol.BlockSize, 1000, 1025} {
+		h, ok := zeroHash(size)
+		if isBlockSize := size&(size-1) == 0; ok != isBlockSize {
+			t.Errorf("zeroHash(%d) ok = %v, expected %v", size, ok, isBlockSize)
+		}
+		if sum := sha256.Sum256(make([]byte, size)); ok && !bytes.Equal(h, sum[:]) {
+			t.Errorf("incorrect zero hash for size %d", size)
+		}
+	}
+}
+
+func TestBlockHasherReusesBuffer(t *testing.T) {
+	var h blockHasher
+	for _, test := range blocksTestData {
+		blocks, err := h.blocks(bytes.NewReader(test.data), test.blocksize, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, _ := Blocks(bytes.NewReader(test.data), test.blocksize, 0, nil)
+		if !reflect.DeepEqual(blocks, expected) {
+			t.Errorf("blocks with reused buffer %v != %v", blocks, expected)
+		}
+	}
+}
+
 var diffTestData = []struct {
 	a string
 	b string
@@ -92,15 +143,15 @@ var diffTestData = []struct {
 	{"contents", "contents", 1024, []protocol.BlockInfo{}},
 	{"", "", 1024, []protocol.BlockInfo{}},
 	{"contents", "contents", 3, []protocol.BlockInfo{}},
-	{"contents", "cantents", 3, []protocol.BlockInfo{{0, 3, nil}}},
-	{"contents", "contants", 3, []protocol.BlockInfo{{3, 3, nil}}},
-	{"contents", "cantants", 3, []protocol.BlockInfo{{0, 3, nil}, {3, 3, nil}}},
-	{"contents", "", 3, []protocol.BlockInfo{{0, 0, nil}}},
-	{"", "contents", 3, []protocol.BlockInfo{{0, 3, nil}, {3, 3, nil}, {6, 2, nil}}},
-	{"con", "contents", 3, []protocol.BlockInfo{{3, 3, nil}, {6, 2, nil}}},
+	{"contents", "cantents", 3, []protocol.BlockInfo{{Offset: 0, Size: 3}}},
+	{"contents", "contants", 3, []protocol.BlockInfo{{Offset: 3, Size: 3}}},
+	{"contents", "cantants", 3, []protocol.BlockInfo{{Offset: 0, Size: 3}, {Offset: 3, Size: 3}}},
+	{"contents", "", 3, []protocol.BlockInfo{{Offset: 0, Size: 0}}},
+	{"", "contents", 3, []protocol.BlockInfo{{Offset: 0, Size: 3}, {Offset: 3, Size: 3}, {Offset: 6, Size: 2}}},
+	{"con", "contents", 3, []protocol.BlockInfo{{Offset: 3, Size: 3}, {Offset: 6, Size: 2}}},
 	{"contents", "con", 3, nil},
-	{"contents", "cont", 3, []protocol.BlockInfo{{3, 1, nil}}},
-	{"cont", "contents", 3, []protocol.BlockInfo{{3, 3, nil}, {6, 2, nil}}},
+	{"contents", "cont", 3, []protocol.BlockInfo{{Offset: 3, Size: 1}}},
+	{"cont", "contents", 3, []protocol.BlockInfo{{Offset: 3, Size: 3}, {Offset: 6, Size: 2}}},
 }
 
 func TestDiff(t *testing.T) {
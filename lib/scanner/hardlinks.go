@@ -0,0 +1,117 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package scanner
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/syncthing/syncthing/lib/osutil"
+	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syncthing/syncthing/lib/sync"
+)
+
+// hardLinks keeps track of the hard linked files seen during a walk. The
+// first name a file is found by is hashed as usual, and the others are held
+// back until then, to be given the same blocks.
+type hardLinks struct {
+	mut     sync.Mutex
+	names   map[osutil.FileID]string        // first name of each linked file
+	blocks  map[string][]protocol.BlockInfo // blocks of first names, once hashed
+	pending []protocol.FileInfo             // other names, waiting for blocks
+}
+
+func newHardLinks() *hardLinks {
+	return &hardLinks{
+		mut:    sync.NewMutex(),
+		names:  make(map[osutil.FileID]string),
+		blocks: make(map[string][]protocol.BlockInfo),
+	}
+}
+
+// target returns the name the file was first found by, or the empty string
+// if this is the first name or the file isn't hard linked.
+func (h *hardLinks) target(name string, info os.FileInfo) string {
+	id, ok := osutil.HardLinkID(info)
+	if !ok {
+		return ""
+	}
+
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if first, ok := h.names[id]; ok {
+		return first
+	}
+	h.names[id] = name
+	h.blocks[name] = nil
+	return ""
+}
+
+// hold keeps a file with FlagHardLink set until the file it links to has
+// been hashed.
+func (h *hardLinks) hold(f protocol.FileInfo) {
+	h.mut.Lock()
+	h.pending = append(h.pending, f)
+	h.mut.Unlock()
+}
+
+// hashed remembers the blocks of the file, if it's linked to by others.
+func (h *hardLinks) hashed(f protocol.FileInfo) {
+	h.mut.Lock()
+	if _, ok := h.blocks[f.Name]; ok {
+		h.blocks[f.Name] = f.Blocks
+	}
+	h.mut.Unlock()
+}
+
+// linkFiles passes on the hashed files from in to out, followed by the held
+// back links to them once all files have been hashed.
+func (w *Walker) linkFiles(links *hardLinks, in, out chan protocol.FileInfo) {
+	for f := range in {
+		links.hashed(f)
+		out <- f
+	}
+
+	for _, f := range links.pending {
+		blocks := links.blocks[f.HardLink]
+		if blocks == nil && w.CurrentFiler != nil {
+			// The file wasn't rehashed as it's unchanged since the last
+			// scan, so what we have in the index is still true.
+			if cf, ok := w.CurrentFiler.CurrentFile(f.HardLink); ok && !cf.IsDeleted() && !cf.IsDirectory() && !cf.IsSymlink() && cf.Size() == f.CachedSize {
+				blocks = cf.Blocks
+			}
+		}
+		if blocks == nil {
+			// Hashing the file we link to failed, or it isn't known to
+			// us, so we hash this one on its own and announce it as a
+			// file by itself.
+			if debug {
+				l.Debugln("hard link target not hashed:", f.Name, f.HardLink)
+			}
+			f.Flags &^= protocol.FlagHardLink
+			f.HardLink = ""
+
+			blockSize := w.BlockSize
+			if w.UseLargeBlocks {
+				blockSize = protocol.BlockSizeFor(f.CachedSize)
+			}
+			var err error
+			blocks, err = hashFile(filepath.Join(w.Dir, w.diskName(f.Name)), blockSize, f.CachedSize, w.Limiter, nil, nil)
+			if err != nil {
+				l.Infof(`Error hashing hard linked file "%s": %v`, f.Name, err)
+				continue
+			}
+		}
+
+		f.Blocks = blocks
+		if debug && f.HardLink != "" {
+			l.Debugln("hard link:", f.Name, f.HardLink)
+		}
+		out <- f
+	}
+	close(out)
+}
@@ -0,0 +1,173 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package scanner
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+
+	"github.com/syncthing/syncthing/lib/osutil"
+)
+
+// walkLookahead is the number of subdirectories of each directory on the
+// way down that are read before the walk gets to them.
+const walkLookahead = 16
+
+// parallelWalk walks the file tree rooted at root like filepath.Walk,
+// calling walkFn for each file in lexical order. Directories are read, and
+// the files in them lstat'ed, by a number of workers ahead of the walk, so
+// that walkFn rarely waits for the file system. Directories for which skip
+// returns true are not read ahead, as walkFn is likely to skip them.
+func parallelWalk(root string, workers int, skip func(path string) bool, walkFn filepath.WalkFunc) error {
+	w := &parallelWalker{
+		walkFn: walkFn,
+		skip:   skip,
+		sem:    make(chan struct{}, workers),
+	}
+
+	info, err := osutil.Lstat(root)
+	if err != nil {
+		err = walkFn(root, nil, err)
+	} else {
+		err = w.walk(root, info, nil)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+type parallelWalker struct {
+	walkFn filepath.WalkFunc
+	skip   func(path string) bool
+	sem    chan struct{} // limits the number of directories read at once
+}
+
+// A dirListing is the contents of a directory, possibly still being read.
+type dirListing struct {
+	entries  []dirEntry
+	err      error
+	done     chan struct{}
+	canceled int32
+}
+
+// A dirEntry is a file in a directory, as lstat'ed, or the error doing so.
+type dirEntry struct {
+	path string
+	info os.FileInfo
+	err  error
+}
+
+// cancel tells the workers the listing is not needed after all, if they
+// haven't got to reading it yet.
+func (ls *dirListing) cancel() {
+	atomic.StoreInt32(&ls.canceled, 1)
+}
+
+// readAhead starts reading the directory in the background.
+func (w *parallelWalker) readAhead(path string) *dirListing {
+	ls := &dirListing{done: make(chan struct{})}
+	go func() {
+		defer close(ls.done)
+		w.sem <- struct{}{}
+		defer func() { <-w.sem }()
+		if atomic.LoadInt32(&ls.canceled) != 0 {
+			return
+		}
+		ls.entries, ls.err = readDirEntries(path)
+	}()
+	return ls
+}
+
+// readDirEntries returns the sorted and lstat'ed files in the directory.
+func readDirEntries(path string) ([]dirEntry, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	names, err := fd.Readdirnames(-1)
+	fd.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	entries := make([]dirEntry, len(names))
+	for i, name := range names {
+		entries[i].path = filepath.Join(path, name)
+		entries[i].info, entries[i].err = osutil.Lstat(entries[i].path)
+	}
+	return entries, nil
+}
+
+// walk calls walkFn for the file and, if it is a directory, descends into
+// it. The listing of the directory may have been started already.
+func (w *parallelWalker) walk(path string, info os.FileInfo, ls *dirListing) error {
+	if err := w.walkFn(path, info, nil); err != nil {
+		if ls != nil {
+			ls.cancel()
+		}
+		if info.IsDir() && err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+	if !info.IsDir() {
+		return nil
+	}
+
+	if ls == nil {
+		ls = w.readAhead(path)
+	}
+	<-ls.done
+	if ls.err != nil {
+		return w.walkFn(path, info, ls.err)
+	}
+
+	// Subdirectories coming up are read while we're busy with the files
+	// before them.
+	entries := ls.entries
+	listings := make([]*dirListing, len(entries))
+	next, ahead := 0, 0
+	defer func() {
+		for _, ls := range listings {
+			if ls != nil {
+				ls.cancel()
+			}
+		}
+	}()
+
+	for i, e := range entries {
+		for ; next < len(entries) && ahead < walkLookahead; next++ {
+			if ne := entries[next]; ne.err == nil && ne.info.IsDir() && !w.skip(ne.path) {
+				listings[next] = w.readAhead(ne.path)
+				ahead++
+			}
+		}
+
+		if e.err != nil {
+			if err := w.walkFn(e.path, e.info, e.err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+
+		ls := listings[i]
+		if ls != nil {
+			listings[i] = nil
+			ahead--
+		}
+		if err := w.walk(e.path, e.info, ls); err != nil {
+			if !e.info.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
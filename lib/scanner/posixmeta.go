@@ -0,0 +1,84 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package scanner
+
+import (
+	"os"
+	"sort"
+
+	"github.com/syncthing/syncthing/lib/osutil"
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+// posixMeta returns the ownership and extended attributes of the file, as
+// far as the walker is set to record them and they can be read.
+func (w *Walker) posixMeta(path string, info os.FileInfo) protocol.PosixMeta {
+	var meta protocol.PosixMeta
+
+	if w.Ownership {
+		if uid, gid, ok := osutil.Owner(info); ok {
+			meta.Flags |= protocol.PosixMetaOwnership
+			meta.UID = uint32(uid)
+			meta.GID = uint32(gid)
+			meta.User = osutil.UserName(uid)
+			meta.Group = osutil.GroupName(gid)
+		}
+	}
+
+	if w.Xattrs {
+		attrs, err := osutil.UserXattrs(path)
+		if err == nil {
+			meta.Flags |= protocol.PosixMetaXattrs
+			for name, value := range attrs {
+				meta.Xattrs = append(meta.Xattrs, protocol.Xattr{Name: name, Value: value})
+			}
+			sort.Sort(xattrList(meta.Xattrs))
+		} else if debug {
+			l.Debugln("xattrs:", path, err)
+		}
+	}
+
+	return meta
+}
+
+// keepOwnership replaces the ownership read from disk with that recorded
+// for the file, if the walker is set to keep it.
+func (w *Walker) keepOwnership(meta *protocol.PosixMeta, cf protocol.FileInfo) {
+	if !w.KeepOwnership || meta.Flags&protocol.PosixMetaOwnership == 0 || cf.Posix.Flags&protocol.PosixMetaOwnership == 0 {
+		return
+	}
+	meta.UID, meta.GID = cf.Posix.UID, cf.Posix.GID
+	meta.User, meta.Group = cf.Posix.User, cf.Posix.Group
+}
+
+// posixMetaUnchanged returns true if the metadata recorded for the file
+// matches what was read from disk. Parts we couldn't read are considered
+// unchanged.
+func posixMetaUnchanged(cf protocol.FileInfo, meta protocol.PosixMeta) bool {
+	if meta.Flags&protocol.PosixMetaOwnership != 0 && !cf.Posix.OwnerEqual(meta) {
+		return false
+	}
+	if meta.Flags&protocol.PosixMetaXattrs != 0 && !cf.Posix.XattrsEqual(meta) {
+		return false
+	}
+	return true
+}
+
+// setPosixMeta attaches the metadata to the file, if there is any.
+func setPosixMeta(f *protocol.FileInfo, meta protocol.PosixMeta) {
+	if meta.Flags == 0 {
+		return
+	}
+	f.Flags |= protocol.FlagPosixMeta
+	f.Posix = meta
+}
+
+type xattrList []protocol.Xattr
+
+func (l xattrList) Len() int           { return len(l) }
+func (l xattrList) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
+func (l xattrList) Less(a, b int) bool { return l[a].Name < l[b].Name }
@@ -0,0 +1,70 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package scanner
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+type RenameFinder interface {
+	// RenamedFrom returns the name, as seen at last scan, of the directory
+	// that was renamed to the given new directory.
+	RenamedFrom(name string) (string, bool)
+}
+
+// dirRenames maps the renamed directories found during a walk to the names
+// they had before.
+type dirRenames map[string]string
+
+// oldName returns the name the file had before one of the directories it
+// is in was renamed.
+func (r dirRenames) oldName(name string) (string, bool) {
+	if len(r) == 0 {
+		return "", false
+	}
+	for dir := filepath.Dir(name); dir != "."; dir = filepath.Dir(dir) {
+		if old, ok := r[dir]; ok {
+			return filepath.Join(old, name[len(dir)+1:]), true
+		}
+	}
+	return "", false
+}
+
+// renamedDir finds out whether the new directory was renamed, unless that's
+// already known for one of its parents.
+func (w *Walker) renamedDir(renames dirRenames, name string) {
+	if _, ok := renames.oldName(name); ok {
+		return
+	}
+	if old, ok := w.Renames.RenamedFrom(name); ok {
+		if debug {
+			l.Debugln("renamed dir:", old, name)
+		}
+		renames[name] = old
+	}
+}
+
+// renamedBlocks returns the blocks the file had under its name before its
+// directory was renamed, if it's unchanged since.
+func (w *Walker) renamedBlocks(renames dirRenames, name string, mtime time.Time, size int64) ([]protocol.BlockInfo, bool) {
+	old, ok := renames.oldName(name)
+	if !ok {
+		return nil, false
+	}
+	of, ok := w.CurrentFiler.CurrentFile(old)
+	if !ok || of.IsDeleted() || of.IsDirectory() || of.IsSymlink() || !validOrLocalChange(of) ||
+		of.Modified != mtime.Unix() || of.Size() != size {
+		return nil, false
+	}
+	if debug {
+		l.Debugln("renamed file:", old, name)
+	}
+	return of.Blocks, true
+}
@@ -48,6 +48,9 @@ type Walker struct {
 	Subs []string
 	// BlockSize controls the size of the block used when hashing.
 	BlockSize int
+	// If UseLargeBlocks is true, large files are hashed using the larger
+	// block size given by protocol.BlockSizeFor instead of BlockSize.
+	UseLargeBlocks bool
 	// If Matcher is not nil, it is used to identify files to ignore which were specified by the user.
 	Matcher IgnoreMatcher
 	// If TempNamer is not nil, it is used to ignore temporary files when walking.
@@ -56,17 +59,53 @@ type Walker struct {
 	TempLifetime time.Duration
 	// If CurrentFiler is not nil, it is queried for the current file before rescanning.
 	CurrentFiler CurrentFiler
+	// If Renames is not nil along with CurrentFiler, it is asked where new
+	// directories were renamed from. Files in them that are unchanged since
+	// the last scan under their old names are not hashed again.
+	Renames RenameFinder
 	// If MtimeRepo is not nil, it is used to provide mtimes on systems that don't support setting arbirtary mtimes.
 	MtimeRepo *db.VirtualMtimeRepo
 	// If IgnorePerms is true, changes to permission bits will not be
 	// detected. Scanned files will get zero permission bits and the
 	// NoPermissionBits flag set.
 	IgnorePerms bool
+	// If Ownership is true, the owner and group of files and directories
+	// are recorded, and changes to them detected.
+	Ownership bool
+	// If KeepOwnership is true along with Ownership, files keep the owner
+	// and group last recorded for them, as we are unable to apply changes
+	// to them and differences are most likely due to that.
+	KeepOwnership bool
+	// If Xattrs is true, the extended attributes in the user namespace of
+	// files and directories are recorded, and changes to them detected.
+	Xattrs bool
+	// If HardLinks is true, files with several hard links within the
+	// folder are hashed once, and found by the other names they are
+	// recorded as links to the first one.
+	HardLinks bool
+	// If SafeNames is true, file names on disk are decoded by
+	// osutil.DecodeFilename, and the files are looked for by the encoded
+	// names.
+	SafeNames bool
 	// When AutoNormalize is set, file names that are in UTF8 but incorrect
 	// normalization form will be corrected.
 	AutoNormalize bool
+	// If StableWindow is not zero, changed files modified more recently
+	// than that are left alone until they stop changing, and passed to
+	// Unstable if it is not nil.
+	StableWindow time.Duration
+	Unstable     UnstableRecorder
 	// Number of routines to use for hashing
 	Hashers int
+	// If Limiter is not nil, reading files for hashing waits on it.
+	Limiter RateLimiter
+	// If LowPriority is true, the hashing routines do their I/O only when
+	// the disk is otherwise idle, and run at the lowest CPU priority, where
+	// the system supports it.
+	LowPriority bool
+	// Number of routines to use for reading directories. With less than
+	// two, the tree is walked by a single routine.
+	Walkers int
 	// Our vector clock id
 	ShortID uint64
 	// Optional progress tick interval which defines how often FolderScanProgress
@@ -86,6 +125,12 @@ type CurrentFiler interface {
 	CurrentFile(name string) (protocol.FileInfo, bool)
 }
 
+type UnstableRecorder interface {
+	// Unstable records a changed file that was not scanned, as it was
+	// modified within the stability window.
+	Unstable(name string, modified time.Time)
+}
+
 type IgnoreMatcher interface {
 	// Match returns true if the file should be ignored.
 	Match(filename string) bool
@@ -105,16 +150,33 @@ func (w *Walker) Walk() (chan protocol.FileInfo, error) {
 
 	toHashChan := make(chan protocol.FileInfo)
 	finishedChan := make(chan protocol.FileInfo)
+	hashedChan := finishedChan
+
+	// Hard links are held back by the walker, and added to the output once
+	// everything else has been hashed.
+	var links *hardLinks
+	if w.HardLinks {
+		links = newHardLinks()
+		hashedChan = make(chan protocol.FileInfo)
+		go w.linkFiles(links, hashedChan, finishedChan)
+	}
 
 	// A routine which walks the filesystem tree, and sends files which have
 	// been modified to the counter routine.
 	go func() {
-		hashFiles := w.walkAndHashFiles(toHashChan, finishedChan)
+		hashFiles := w.walkAndHashFiles(toHashChan, hashedChan, links)
+		walk := filepath.Walk
+		if w.Walkers > 1 {
+			// Either way the files are seen in the same order.
+			walk = func(root string, walkFn filepath.WalkFunc) error {
+				return parallelWalk(root, w.Walkers, w.skipsDir, walkFn)
+			}
+		}
 		if len(w.Subs) == 0 {
-			filepath.Walk(w.Dir, hashFiles)
+			walk(w.Dir, hashFiles)
 		} else {
 			for _, sub := range w.Subs {
-				filepath.Walk(filepath.Join(w.Dir, sub), hashFiles)
+				walk(filepath.Join(w.Dir, w.diskName(sub)), hashFiles)
 			}
 		}
 		close(toHashChan)
@@ -123,7 +185,7 @@ func (w *Walker) Walk() (chan protocol.FileInfo, error) {
 	// We're not required to emit scan progress events, just kick off hashers,
 	// and feed inputs directly from the walker.
 	if w.ProgressTickIntervalS < 0 {
-		newParallelHasher(w.Dir, w.BlockSize, w.Hashers, finishedChan, toHashChan, nil, nil)
+		newParallelHasher(w.Dir, w.BlockSize, w.Hashers, w.UseLargeBlocks, w.SafeNames, w.Limiter, w.LowPriority, hashedChan, toHashChan, nil, nil)
 		return finishedChan, nil
 	}
 
@@ -151,7 +213,7 @@ func (w *Walker) Walk() (chan protocol.FileInfo, error) {
 
 		realToHashChan := make(chan protocol.FileInfo)
 		done := make(chan struct{})
-		newParallelHasher(w.Dir, w.BlockSize, w.Hashers, finishedChan, realToHashChan, &progress, done)
+		newParallelHasher(w.Dir, w.BlockSize, w.Hashers, w.UseLargeBlocks, w.SafeNames, w.Limiter, w.LowPriority, hashedChan, realToHashChan, &progress, done)
 
 		// A routine which actually emits the FolderScanProgress events
 		// every w.ProgressTicker ticks, until the hasher routines terminate.
@@ -190,8 +252,9 @@ func (w *Walker) Walk() (chan protocol.FileInfo, error) {
 	return finishedChan, nil
 }
 
-func (w *Walker) walkAndHashFiles(fchan, dchan chan protocol.FileInfo) filepath.WalkFunc {
+func (w *Walker) walkAndHashFiles(fchan, dchan chan protocol.FileInfo, links *hardLinks) filepath.WalkFunc {
 	now := time.Now()
+	renames := make(dirRenames)
 	return func(p string, info os.FileInfo, err error) error {
 		// Return value used when we are returning early and don't want to
 		// process the item. For directories, this means do-not-descend.
@@ -220,6 +283,12 @@ func (w *Walker) walkAndHashFiles(fchan, dchan chan protocol.FileInfo) filepath.
 			return nil
 		}
 
+		if w.SafeNames {
+			// From here on we're dealing with the name as it is in the
+			// index.
+			rn = osutil.DecodeFilename(rn)
+		}
+
 		mtime := info.ModTime()
 		if w.MtimeRepo != nil {
 			mtime = w.MtimeRepo.GetMtime(rn, mtime)
@@ -239,8 +308,7 @@ func (w *Walker) walkAndHashFiles(fchan, dchan chan protocol.FileInfo) filepath.
 			return nil
 		}
 
-		if sn := filepath.Base(rn); sn == ".stignore" || sn == ".stfolder" ||
-			strings.HasPrefix(rn, ".stversions") || (w.Matcher != nil && w.Matcher.Match(rn)) {
+		if w.ignored(rn) {
 			// An ignored file
 			if debug {
 				l.Debugln("ignored:", rn)
@@ -275,7 +343,7 @@ func (w *Walker) walkAndHashFiles(fchan, dchan chan protocol.FileInfo) filepath.
 			}
 
 			// We will attempt to normalize it.
-			normalizedPath := filepath.Join(w.Dir, normalizedRn)
+			normalizedPath := filepath.Join(w.Dir, w.diskName(normalizedRn))
 			if _, err := osutil.Lstat(normalizedPath); os.IsNotExist(err) {
 				// Nothing exists with the normalized filename. Good.
 				if err = os.Rename(p, normalizedPath); err != nil {
@@ -332,11 +400,11 @@ func (w *Walker) walkAndHashFiles(fchan, dchan chan protocol.FileInfo) filepath.
 				//  - it exists
 				//  - it wasn't deleted (because it isn't now)
 				//  - it was a symlink
-				//  - it wasn't invalid
+				//  - it wasn't invalid, other than being a local change
 				//  - the symlink type (file/dir) was the same
 				//  - the block list (i.e. hash of target) was the same
 				cf, ok = w.CurrentFiler.CurrentFile(rn)
-				if ok && !cf.IsDeleted() && cf.IsSymlink() && !cf.IsInvalid() && SymlinkTypeEqual(targetType, cf) && BlocksEqual(cf.Blocks, blocks) {
+				if ok && !cf.IsDeleted() && cf.IsSymlink() && validOrLocalChange(cf) && SymlinkTypeEqual(targetType, cf) && BlocksEqual(cf.Blocks, blocks) {
 					return skip
 				}
 			}
@@ -358,6 +426,11 @@ func (w *Walker) walkAndHashFiles(fchan, dchan chan protocol.FileInfo) filepath.
 			return skip
 		}
 
+		var meta protocol.PosixMeta
+		if w.Ownership || w.Xattrs {
+			meta = w.posixMeta(p, info)
+		}
+
 		if info.Mode().IsDir() {
 			if w.CurrentFiler != nil {
 				// A directory is "unchanged", if it
@@ -366,14 +439,21 @@ func (w *Walker) walkAndHashFiles(fchan, dchan chan protocol.FileInfo) filepath.
 				//  - was not marked deleted (since it apparently exists now)
 				//  - was a directory previously (not a file or something else)
 				//  - was not a symlink (since it's a directory now)
-				//  - was not invalid (since it looks valid now)
+				//  - was not invalid (since it looks valid now), other than being a local change
+				//  - has the same ownership and extended attributes, as far as we record them
 				cf, ok = w.CurrentFiler.CurrentFile(rn)
+				w.keepOwnership(&meta, cf)
 				permUnchanged := w.IgnorePerms || !cf.HasPermissionBits() || PermsEqual(cf.Flags, uint32(info.Mode()))
-				if ok && permUnchanged && !cf.IsDeleted() && cf.IsDirectory() && !cf.IsSymlink() && !cf.IsInvalid() {
+				if ok && permUnchanged && !cf.IsDeleted() && cf.IsDirectory() && !cf.IsSymlink() && validOrLocalChange(cf) &&
+					posixMetaUnchanged(cf, meta) {
 					return nil
 				}
 			}
 
+			if w.Renames != nil && w.CurrentFiler != nil && (!ok || cf.IsDeleted() || !cf.IsDirectory()) {
+				w.renamedDir(renames, rn)
+			}
+
 			flags := uint32(protocol.FlagDirectory)
 			if w.IgnorePerms {
 				flags |= protocol.FlagNoPermBits | 0777
@@ -386,6 +466,7 @@ func (w *Walker) walkAndHashFiles(fchan, dchan chan protocol.FileInfo) filepath.
 				Flags:    flags,
 				Modified: mtime.Unix(),
 			}
+			setPosixMeta(&f, meta)
 			if debug {
 				l.Debugln("dir:", p, f)
 			}
@@ -399,6 +480,11 @@ func (w *Walker) walkAndHashFiles(fchan, dchan chan protocol.FileInfo) filepath.
 				curMode |= 0111
 			}
 
+			var linkTarget string
+			if links != nil {
+				linkTarget = links.target(rn, info)
+			}
+
 			if w.CurrentFiler != nil {
 				// A file is "unchanged", if it
 				//  - exists
@@ -407,12 +493,16 @@ func (w *Walker) walkAndHashFiles(fchan, dchan chan protocol.FileInfo) filepath.
 				//  - had the same modification time as it has now
 				//  - was not a directory previously (since it's a file now)
 				//  - was not a symlink (since it's a file now)
-				//  - was not invalid (since it looks valid now)
+				//  - was not invalid (since it looks valid now), other than being a local change
 				//  - has the same size as previously
+				//  - has the same ownership and extended attributes, as far as we record them
+				// Whether or not it's a hard link doesn't count, as devices
+				// unable to create the link would otherwise keep changing it.
 				cf, ok = w.CurrentFiler.CurrentFile(rn)
+				w.keepOwnership(&meta, cf)
 				permUnchanged := w.IgnorePerms || !cf.HasPermissionBits() || PermsEqual(cf.Flags, curMode)
 				if ok && permUnchanged && !cf.IsDeleted() && cf.Modified == mtime.Unix() && !cf.IsDirectory() &&
-					!cf.IsSymlink() && !cf.IsInvalid() && cf.Size() == info.Size() {
+					!cf.IsSymlink() && validOrLocalChange(cf) && cf.Size() == info.Size() && posixMetaUnchanged(cf, meta) {
 					return nil
 				}
 
@@ -421,6 +511,10 @@ func (w *Walker) walkAndHashFiles(fchan, dchan chan protocol.FileInfo) filepath.
 				}
 			}
 
+			if w.unstable(rn, info.ModTime()) {
+				return nil
+			}
+
 			var flags = curMode & uint32(maskModePerm)
 			if w.IgnorePerms {
 				flags = protocol.FlagNoPermBits | 0666
@@ -433,6 +527,22 @@ func (w *Walker) walkAndHashFiles(fchan, dchan chan protocol.FileInfo) filepath.
 				Modified:   mtime.Unix(),
 				CachedSize: info.Size(),
 			}
+			setPosixMeta(&f, meta)
+			if linkTarget != "" {
+				f.Flags |= protocol.FlagHardLink
+				f.HardLink = linkTarget
+				links.hold(f)
+				return nil
+			}
+			if !ok || cf.IsDeleted() {
+				// A new file may have been moved here along with its
+				// directory, in which case we know its blocks already.
+				if blocks, renamed := w.renamedBlocks(renames, rn, mtime, info.Size()); renamed {
+					f.Blocks = blocks
+					dchan <- f
+					return nil
+				}
+			}
 			if debug {
 				l.Debugln("to hash:", p, f)
 			}
@@ -443,6 +553,56 @@ func (w *Walker) walkAndHashFiles(fchan, dchan chan protocol.FileInfo) filepath.
 	}
 }
 
+// unstable returns true if the file was modified within the stability
+// window, and may well still be being written to.
+func (w *Walker) unstable(name string, modified time.Time) bool {
+	if w.StableWindow <= 0 {
+		return false
+	}
+	// A modification time in the future says nothing about when the file
+	// was last written to.
+	if age := time.Since(modified); age < 0 || age >= w.StableWindow {
+		return false
+	}
+	if debug {
+		l.Debugln("unstable:", name, modified)
+	}
+	if w.Unstable != nil {
+		w.Unstable.Unstable(name, modified)
+	}
+	return true
+}
+
+// ignored returns true if the file, given by its name in the index, should
+// not be scanned.
+func (w *Walker) ignored(rn string) bool {
+	sn := filepath.Base(rn)
+	return sn == ".stignore" || sn == ".stfolder" || strings.HasPrefix(rn, ".stversions") ||
+		w.Matcher != nil && w.Matcher.Match(rn)
+}
+
+// skipsDir returns true if the directory at the given path is ignored or
+// temporary, so that it's not worth reading ahead of the walk.
+func (w *Walker) skipsDir(path string) bool {
+	rn, err := filepath.Rel(w.Dir, path)
+	if err != nil {
+		return false
+	}
+	if w.SafeNames {
+		rn = osutil.DecodeFilename(rn)
+	}
+	return w.TempNamer != nil && w.TempNamer.IsTemporary(rn) || w.ignored(rn)
+}
+
+// diskName returns the name of the file on disk, relative to the
+// directory.
+func (w *Walker) diskName(name string) string {
+	if w.SafeNames {
+		return osutil.EncodeFilename(name)
+	}
+	return name
+}
+
 func checkDir(dir string) error {
 	if info, err := osutil.Lstat(dir); err != nil {
 		return err
@@ -454,6 +614,13 @@ func checkDir(dir string) error {
 	return nil
 }
 
+// validOrLocalChange returns true if the file is not invalid, or is invalid
+// only because it is a local change in a receive only folder. The latter
+// should not be rehashed on every scan as long as it stays unchanged.
+func validOrLocalChange(f protocol.FileInfo) bool {
+	return !f.IsInvalid() || f.Flags&protocol.FlagLocalChanged != 0
+}
+
 func PermsEqual(a, b uint32) bool {
 	switch runtime.GOOS {
 	case "windows":
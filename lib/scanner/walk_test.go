@@ -9,13 +9,18 @@ package scanner
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
 	rdebug "runtime/debug"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/syncthing/syncthing/lib/ignore"
 	"github.com/syncthing/syncthing/lib/osutil"
@@ -280,7 +285,7 @@ func TestNormalization(t *testing.T) {
 func TestIssue1507(t *testing.T) {
 	w := Walker{}
 	c := make(chan protocol.FileInfo, 100)
-	fn := w.walkAndHashFiles(c, c)
+	fn := w.walkAndHashFiles(c, c, nil)
 
 	fn("", nil, protocol.ErrClosed)
 }
@@ -372,3 +377,527 @@ func TestSymlinkTypeEqual(t *testing.T) {
 		}
 	}
 }
+
+type fakeCurrentFiler map[string]protocol.FileInfo
+
+func (f fakeCurrentFiler) CurrentFile(name string) (protocol.FileInfo, bool) {
+	fi, ok := f[name]
+	return fi, ok
+}
+
+func TestWalkPosixMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	xattrs := true
+	if err := osutil.SetUserXattrs(path, map[string][]byte{"test": []byte("value")}); err == osutil.ErrXattrsUnsupported {
+		xattrs = false
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	cf := make(fakeCurrentFiler)
+	w := Walker{
+		Dir:          dir,
+		BlockSize:    128 * 1024,
+		Hashers:      2,
+		CurrentFiler: cf,
+		Ownership:    true,
+		Xattrs:       true,
+	}
+	walk := func() []protocol.FileInfo {
+		fchan, err := w.Walk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []protocol.FileInfo
+		for f := range fchan {
+			files = append(files, f)
+			cf[f.Name] = f
+		}
+		return files
+	}
+
+	files := walk()
+	if len(files) != 1 {
+		t.Fatalf("unexpected files %v", files)
+	}
+	f := files[0]
+	if f.Flags&protocol.FlagPosixMeta == 0 {
+		t.Fatal("file should carry posix metadata")
+	}
+	if uid, _, ok := osutil.Owner(mustLstat(t, path)); ok && (f.Posix.Flags&protocol.PosixMetaOwnership == 0 || f.Posix.UID != uint32(uid)) {
+		t.Errorf("incorrect ownership %+v, uid %d", f.Posix, uid)
+	}
+	if xattrs {
+		expected := []protocol.Xattr{{Name: "test", Value: []byte("value")}}
+		if !reflect.DeepEqual(f.Posix.Xattrs, expected) {
+			t.Errorf("incorrect xattrs %v != %v", f.Posix.Xattrs, expected)
+		}
+	}
+
+	if files := walk(); len(files) != 0 {
+		t.Errorf("unchanged file rescanned: %v", files)
+	}
+
+	if !xattrs {
+		t.Skip("extended attributes not supported")
+	}
+	if err := osutil.SetUserXattrs(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	if files := walk(); len(files) != 1 || len(files[0].Posix.Xattrs) != 0 {
+		t.Errorf("removed xattr not detected: %v", files)
+	}
+}
+
+func TestWalkHardLinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hard links are not detected on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "c"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cf := make(fakeCurrentFiler)
+	w := Walker{
+		Dir:          dir,
+		BlockSize:    128 * 1024,
+		Hashers:      2,
+		CurrentFiler: cf,
+		HardLinks:    true,
+	}
+	walk := func() map[string]protocol.FileInfo {
+		fchan, err := w.Walk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := make(map[string]protocol.FileInfo)
+		for f := range fchan {
+			files[f.Name] = f
+		}
+		return files
+	}
+
+	files := walk()
+	if len(files) != 3 {
+		t.Fatalf("unexpected files %v", files)
+	}
+	if f := files["a"]; f.Flags&protocol.FlagHardLink != 0 {
+		t.Errorf("first name should not be a link: %v", f)
+	}
+	if f := files["c"]; f.Flags&protocol.FlagHardLink != 0 {
+		t.Errorf("separate file should not be a link: %v", f)
+	}
+	if f := files["b"]; f.Flags&protocol.FlagHardLink == 0 || f.HardLink != "a" || !BlocksEqual(f.Blocks, files["a"].Blocks) {
+		t.Errorf("incorrect link %v", f)
+	}
+
+	// A new link to a file that is unchanged since the last scan gets the
+	// blocks from the index.
+	cf["a"] = files["a"]
+	cf["b"] = files["b"]
+	cf["c"] = files["c"]
+	if err := os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "d")); err != nil {
+		t.Fatal(err)
+	}
+	files = walk()
+	if len(files) != 1 {
+		t.Fatalf("unexpected files %v", files)
+	}
+	if f := files["d"]; f.HardLink != "a" || !BlocksEqual(f.Blocks, cf["a"].Blocks) {
+		t.Errorf("incorrect link %v", f)
+	}
+}
+
+func TestWalkSafeNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := "what?"
+	ignored := "ignored:"
+	for _, n := range []string{name, ignored} {
+		if err := ioutil.WriteFile(filepath.Join(dir, osutil.EncodeFilename(n)), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Ignore patterns are for the names as they are in the index.
+	ignores := ignore.New(false)
+	if err := ignores.Parse(strings.NewReader(ignored+"\n"), ".stignore"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := Walker{
+		Dir:       dir,
+		Subs:      []string{name, ignored},
+		BlockSize: 128 * 1024,
+		Matcher:   ignores,
+		Hashers:   2,
+		SafeNames: true,
+	}
+	fchan, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []protocol.FileInfo
+	for f := range fchan {
+		files = append(files, f)
+	}
+
+	if len(files) != 1 || files[0].Name != name || files[0].Size() != 4 {
+		t.Errorf("unexpected files %v", files)
+	}
+}
+
+type fakeRenameFinder map[string]string
+
+func (f fakeRenameFinder) RenamedFrom(name string) (string, bool) {
+	old, ok := f[name]
+	return old, ok
+}
+
+func TestWalkRenamedDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "old", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", filepath.Join("sub", "b"), filepath.Join("sub", "c")} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "old", name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cf := make(fakeCurrentFiler)
+	w := Walker{
+		Dir:          dir,
+		BlockSize:    128 * 1024,
+		Hashers:      2,
+		CurrentFiler: cf,
+		Renames:      fakeRenameFinder{"new": "old"},
+	}
+	walk := func() map[string]protocol.FileInfo {
+		fchan, err := w.Walk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := make(map[string]protocol.FileInfo)
+		for f := range fchan {
+			files[f.Name] = f
+		}
+		return files
+	}
+
+	// Blocks that can't be the result of hashing tell us that the files
+	// weren't hashed again.
+	marker := []byte("marker")
+	for name, f := range walk() {
+		if !f.IsDirectory() {
+			f.Blocks = []protocol.BlockInfo{{Size: int32(f.Size()), Hash: marker}}
+		}
+		cf[name] = f
+	}
+
+	if err := os.Rename(filepath.Join(dir, "old"), filepath.Join(dir, "new")); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "new", "sub", "c"), later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	files := walk()
+	if len(files) != 5 {
+		t.Fatalf("unexpected files %v", files)
+	}
+	for _, name := range []string{"a", filepath.Join("sub", "b")} {
+		if f := files[filepath.Join("new", name)]; len(f.Blocks) != 1 || !bytes.Equal(f.Blocks[0].Hash, marker) {
+			t.Errorf("renamed file %s should keep its blocks, got %v", name, f.Blocks)
+		}
+	}
+	if f := files[filepath.Join("new", "sub", "c")]; len(f.Blocks) != 1 || bytes.Equal(f.Blocks[0].Hash, marker) {
+		t.Errorf("changed file should be hashed again, got %v", f.Blocks)
+	}
+}
+
+func mustLstat(t *testing.T, path string) os.FileInfo {
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestParallelWalk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parallelwalk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// More subdirectories than are read ahead, some skipped, at a few
+	// levels.
+	for i := 0; i < 2*walkLookahead; i++ {
+		for _, sub := range []string{"a", "skip", filepath.Join("b", "c")} {
+			path := filepath.Join(dir, fmt.Sprintf("dir%02d", i), sub)
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"file1", "file2"} {
+				if err := ioutil.WriteFile(filepath.Join(path, name), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	walked := func(walk func(string, filepath.WalkFunc) error) []string {
+		var paths []string
+		err := walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			paths = append(paths, path)
+			if filepath.Base(path) == "skip" {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return paths
+	}
+
+	// The directories skipped by walkFn are not read ahead, which makes no
+	// difference to the walk.
+	var mut sync.Mutex
+	asked := make(map[string]bool)
+	skip := func(path string) bool {
+		mut.Lock()
+		asked[path] = true
+		mut.Unlock()
+		return filepath.Base(path) == "skip"
+	}
+
+	expected := walked(filepath.Walk)
+	for _, workers := range []int{1, 2, 8} {
+		paths := walked(func(root string, walkFn filepath.WalkFunc) error {
+			return parallelWalk(root, workers, skip, walkFn)
+		})
+		if !reflect.DeepEqual(paths, expected) {
+			t.Errorf("walk with %d workers differs from filepath.Walk:\n%v\n%v", workers, paths, expected)
+		}
+	}
+	for i := 0; i < 2*walkLookahead; i++ {
+		if path := filepath.Join(dir, fmt.Sprintf("dir%02d", i), "skip"); !asked[path] {
+			t.Errorf("%s not checked before reading ahead", path)
+		}
+	}
+}
+
+func TestWalkParallel(t *testing.T) {
+	walk := func(walkers int) []protocol.FileInfo {
+		ignores := ignore.New(false)
+		if err := ignores.Load("testdata/.stignore"); err != nil {
+			t.Fatal(err)
+		}
+		w := Walker{
+			Dir:       "testdata",
+			BlockSize: 128 * 1024,
+			Matcher:   ignores,
+			Hashers:   1,
+			Walkers:   walkers,
+		}
+		fchan, err := w.Walk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []protocol.FileInfo
+		for f := range fchan {
+			files = append(files, f)
+		}
+		// Hashed files come out in no particular order.
+		sort.Sort(fileList(files))
+		return files
+	}
+
+	if files, expected := walk(4), walk(1); !reflect.DeepEqual(files, expected) {
+		t.Errorf("parallel walk differs:\n%v\n%v", files, expected)
+	}
+}
+
+type unstableList []string
+
+func (u *unstableList) Unstable(name string, modified time.Time) {
+	*u = append(*u, name)
+}
+
+func TestWalkUnstable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"settled", "changing"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "settled"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	var unstable unstableList
+	w := Walker{
+		Dir:          dir,
+		BlockSize:    128 * 1024,
+		StableWindow: time.Minute,
+		Unstable:     &unstable,
+		Hashers:      2,
+	}
+	fchan, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for f := range fchan {
+		files = append(files, f.Name)
+	}
+
+	if !reflect.DeepEqual(files, []string{"settled"}) {
+		t.Errorf("expected only the settled file to be scanned, got %v", files)
+	}
+	if !reflect.DeepEqual([]string(unstable), []string{"changing"}) {
+		t.Errorf("expected the changing file to be recorded, got %v", unstable)
+	}
+}
+
+type countingLimiter int64
+
+func (c *countingLimiter) Wait(count int64) {
+	atomic.AddInt64((*int64)(c), count)
+}
+
+func TestWalkLimiter(t *testing.T) {
+	var limiter countingLimiter
+	w := Walker{
+		Dir:         "testdata",
+		BlockSize:   128 * 1024,
+		Hashers:     2,
+		Limiter:     &limiter,
+		LowPriority: true,
+	}
+	fchan, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var size int64
+	for f := range fchan {
+		if !f.IsDirectory() && !f.IsSymlink() {
+			size += f.Size()
+		}
+	}
+	if size == 0 {
+		t.Fatal("no data hashed")
+	}
+	if read := atomic.LoadInt64((*int64)(&limiter)); read < size {
+		t.Errorf("limiter waited on %d bytes, expected at least %d", read, size)
+	}
+}
+
+// A waitCheckingReader fails reads not waited for by the limiter.
+type waitCheckingReader struct {
+	limiter *countingLimiter
+	read    int64
+}
+
+func (r *waitCheckingReader) Read(bs []byte) (int, error) {
+	r.read += int64(len(bs))
+	if waited := atomic.LoadInt64((*int64)(r.limiter)); waited < r.read {
+		return 0, fmt.Errorf("read %d bytes, waited for %d", r.read, waited)
+	}
+	return len(bs), nil
+}
+
+func TestLimitedReaderWaitsFirst(t *testing.T) {
+	var limiter countingLimiter
+	r := &limitedReader{r: &waitCheckingReader{limiter: &limiter}, limiter: &limiter}
+
+	// A large block is read in pieces, each waited for before reading.
+	buf := make([]byte, 16<<20)
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != limitedReadSize {
+		t.Errorf("read %d bytes at once, expected at most %d", n, limitedReadSize)
+	}
+}
+
+func TestLinkFilesTargetNotHashed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "b"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The target "a" was found but never hashed, as if hashing it failed.
+	links := newHardLinks()
+	links.blocks["a"] = nil
+	links.hold(protocol.FileInfo{Name: "b", Flags: protocol.FlagHardLink, HardLink: "a", CachedSize: 4})
+	links.hold(protocol.FileInfo{Name: "c", Flags: protocol.FlagHardLink, HardLink: "a", CachedSize: 4})
+
+	w := Walker{Dir: dir, BlockSize: 128 * 1024}
+	in := make(chan protocol.FileInfo)
+	out := make(chan protocol.FileInfo, 2)
+	close(in)
+	w.linkFiles(links, in, out)
+
+	var files []protocol.FileInfo
+	for f := range out {
+		files = append(files, f)
+	}
+	// "c" doesn't exist and can't be hashed either.
+	if len(files) != 1 {
+		t.Fatalf("unexpected files %v", files)
+	}
+	if f := files[0]; f.Name != "b" || f.Flags&protocol.FlagHardLink != 0 || f.HardLink != "" || len(f.Blocks) != 1 {
+		t.Errorf("link should be hashed as a file by itself: %v", f)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/syncthing/syncthing/lib/osutil"
 )
@@ -87,3 +88,14 @@ func (v External) Archive(filePath string) error {
 	}
 	return errors.New("Versioner: file was not removed by external script")
 }
+
+// List is not supported, as the archive is managed by the external command.
+func (v External) List(filePath string) (map[string][]FileVersion, error) {
+	return nil, ErrNotSupported
+}
+
+// Restore is not supported, as the archive is managed by the external
+// command.
+func (v External) Restore(filePath string, versionTime time.Time) error {
+	return ErrNotSupported
+}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"time"
 
 	"github.com/syncthing/syncthing/lib/osutil"
 )
@@ -126,3 +127,35 @@ func (v Simple) Archive(filePath string) error {
 
 	return nil
 }
+
+// List returns the archived versions of the file, or of all files below it
+// if it is a directory.
+func (v Simple) List(filePath string) (map[string][]FileVersion, error) {
+	name, err := filepath.Rel(v.folderPath, filePath)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := taggedVersions(filepath.Join(v.folderPath, ".stversions"), cleanName(name))
+	if err != nil {
+		return nil, err
+	}
+	return publicVersions(versions), nil
+}
+
+// Restore archives the current file and moves the version archived at
+// versionTime back in its place.
+func (v Simple) Restore(filePath string, versionTime time.Time) error {
+	name, err := filepath.Rel(v.folderPath, filePath)
+	if err != nil {
+		return err
+	}
+	versions, err := taggedVersions(filepath.Join(v.folderPath, ".stversions"), name)
+	if err != nil {
+		return err
+	}
+	versionPath, err := findVersion(versions, name, versionTime)
+	if err != nil {
+		return err
+	}
+	return restoreVersion(versionPath, filePath, v.Archive)
+}
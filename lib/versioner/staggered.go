@@ -311,3 +311,41 @@ func (v Staggered) Archive(filePath string) error {
 
 	return nil
 }
+
+// List returns the archived versions of the file, or of all files below it
+// if it is a directory.
+func (v Staggered) List(filePath string) (map[string][]FileVersion, error) {
+	name, err := filepath.Rel(v.folderPath, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	v.mutex.Lock()
+	versions, err := taggedVersions(v.versionsPath, cleanName(name))
+	v.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return publicVersions(versions), nil
+}
+
+// Restore archives the current file and moves the version archived at
+// versionTime back in its place.
+func (v Staggered) Restore(filePath string, versionTime time.Time) error {
+	name, err := filepath.Rel(v.folderPath, filePath)
+	if err != nil {
+		return err
+	}
+
+	v.mutex.Lock()
+	versions, err := taggedVersions(v.versionsPath, name)
+	v.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	versionPath, err := findVersion(versions, name, versionTime)
+	if err != nil {
+		return err
+	}
+	return restoreVersion(versionPath, filePath, v.Archive)
+}
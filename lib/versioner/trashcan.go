@@ -185,3 +185,36 @@ func (t *Trashcan) cleanoutArchive() error {
 	}
 	return nil
 }
+
+// List returns the file kept in the trash can, or all files below it if it
+// is a directory. There is at most one version of each file, timestamped
+// with the time it was archived.
+func (t *Trashcan) List(filePath string) (map[string][]FileVersion, error) {
+	name, err := filepath.Rel(t.folderPath, filePath)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := plainVersions(filepath.Join(t.folderPath, ".stversions"), cleanName(name))
+	if err != nil {
+		return nil, err
+	}
+	return publicVersions(versions), nil
+}
+
+// Restore moves the file back out of the trash can, after archiving the
+// current file in its place.
+func (t *Trashcan) Restore(filePath string, versionTime time.Time) error {
+	name, err := filepath.Rel(t.folderPath, filePath)
+	if err != nil {
+		return err
+	}
+	versions, err := plainVersions(filepath.Join(t.folderPath, ".stversions"), name)
+	if err != nil {
+		return err
+	}
+	versionPath, err := findVersion(versions, name, versionTime)
+	if err != nil {
+		return err
+	}
+	return restoreVersion(versionPath, filePath, t.Archive)
+}
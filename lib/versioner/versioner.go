@@ -8,12 +8,30 @@
 // simple default versioning scheme.
 package versioner
 
+import (
+	"errors"
+	"time"
+)
+
 type Versioner interface {
+	// Archive moves the file away to the version archive.
 	Archive(filePath string) error
+	// List returns the archived versions of the file at filePath, or of all
+	// files below it if it is a directory. The versions are keyed by file
+	// name relative to the folder and sorted oldest first.
+	List(filePath string) (map[string][]FileVersion, error)
+	// Restore archives the current file at filePath and puts the version
+	// archived at versionTime in its place.
+	Restore(filePath string, versionTime time.Time) error
 }
 
 var Factories = map[string]func(folderID string, folderDir string, params map[string]string) Versioner{}
 
+var (
+	ErrNoSuchVersion = errors.New("no such version")
+	ErrNotSupported  = errors.New("versions cannot be listed or restored with this versioning type")
+)
+
 const (
 	TimeFormat = "20060102-150405"
 	TimeGlob   = "[0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9]-[0-9][0-9][0-9][0-9][0-9][0-9]" // glob pattern matching TimeFormat
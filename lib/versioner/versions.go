@@ -0,0 +1,218 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package versioner
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/osutil"
+)
+
+// A FileVersion describes an archived version of a file.
+type FileVersion struct {
+	VersionTime time.Time `json:"versionTime"`
+	ModTime     time.Time `json:"modTime"`
+	Size        int64     `json:"size"`
+}
+
+type archivedVersion struct {
+	FileVersion
+	path string
+}
+
+type versionList []archivedVersion
+
+func (l versionList) Len() int {
+	return len(l)
+}
+func (l versionList) Swap(a, b int) {
+	l[a], l[b] = l[b], l[a]
+}
+func (l versionList) Less(a, b int) bool {
+	return l[a].VersionTime.Before(l[b].VersionTime)
+}
+
+// untaggedFilename returns the name of the file that the version at path
+// was archived from, and its tag. Both the file~tag.ext and the older
+// file.ext~tag patterns are understood. The name is empty if path does not
+// look like a version.
+func untaggedFilename(path string) (string, string) {
+	tag := filenameTag(path)
+	if tag == "" {
+		return "", ""
+	}
+	if strings.HasSuffix(path, "~"+tag) {
+		return path[:len(path)-len(tag)-1], tag
+	}
+	ext := filepath.Ext(path)
+	withoutExt := path[:len(path)-len(ext)]
+	if !strings.HasSuffix(withoutExt, "~"+tag) {
+		return "", ""
+	}
+	return withoutExt[:len(withoutExt)-len(tag)-1] + ext, tag
+}
+
+// cleanName returns the name relative to the folder as used for listing,
+// where the folder itself is the empty string.
+func cleanName(name string) string {
+	if name == "." {
+		return ""
+	}
+	return name
+}
+
+// isBelow returns true if name is the same as, or inside, the directory
+// prefix. An empty prefix matches everything.
+func isBelow(name, prefix string) bool {
+	return prefix == "" || name == prefix || strings.HasPrefix(name, prefix+string(filepath.Separator))
+}
+
+// walkVersions calls fn for each file in versionsDir that may be a version
+// of a file at or below name, with the path relative to versionsDir.
+func walkVersions(versionsDir, name string, fn func(path, rel string, info os.FileInfo)) error {
+	root := versionsDir
+	recurse := true
+	if name != "" {
+		root = filepath.Join(versionsDir, name)
+		if info, err := osutil.Lstat(root); err != nil || !info.IsDir() {
+			// Versions of a file live in the parent directory.
+			root = filepath.Dir(root)
+			recurse = false
+		}
+	}
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != root && !recurse {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(versionsDir, path)
+		if err != nil {
+			return err
+		}
+		fn(path, rel, info)
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// taggedVersions returns the versions archived with a time tag in
+// versionsDir for the files at or below name, keyed by file name, sorted
+// oldest first.
+func taggedVersions(versionsDir, name string) (map[string]versionList, error) {
+	versions := make(map[string]versionList)
+	err := walkVersions(versionsDir, name, func(path, rel string, info os.FileInfo) {
+		file, tag := untaggedFilename(rel)
+		if file == "" || !isBelow(file, name) {
+			return
+		}
+		versionTime, err := time.ParseInLocation(TimeFormat, tag, time.Local)
+		if err != nil {
+			return
+		}
+		versions[file] = append(versions[file], archivedVersion{
+			FileVersion: FileVersion{
+				VersionTime: versionTime,
+				ModTime:     info.ModTime(),
+				Size:        info.Size(),
+			},
+			path: path,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, list := range versions {
+		sort.Sort(list)
+	}
+	return versions, nil
+}
+
+// plainVersions returns the files kept without a tag in versionsDir, at or
+// below name. Their modification time is the time they were archived.
+func plainVersions(versionsDir, name string) (map[string]versionList, error) {
+	versions := make(map[string]versionList)
+	err := walkVersions(versionsDir, name, func(path, rel string, info os.FileInfo) {
+		if !isBelow(rel, name) {
+			return
+		}
+		versions[rel] = versionList{{
+			FileVersion: FileVersion{
+				VersionTime: info.ModTime(),
+				ModTime:     info.ModTime(),
+				Size:        info.Size(),
+			},
+			path: path,
+		}}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// publicVersions strips the internal details from the version lists.
+func publicVersions(versions map[string]versionList) map[string][]FileVersion {
+	res := make(map[string][]FileVersion, len(versions))
+	for file, list := range versions {
+		fvs := make([]FileVersion, len(list))
+		for i, v := range list {
+			fvs[i] = v.FileVersion
+		}
+		res[file] = fvs
+	}
+	return res
+}
+
+// findVersion returns the path of the version of the file archived at
+// versionTime, to a precision of one second.
+func findVersion(versions map[string]versionList, name string, versionTime time.Time) (string, error) {
+	versionTime = versionTime.Truncate(time.Second)
+	for _, v := range versions[name] {
+		if v.VersionTime.Truncate(time.Second).Equal(versionTime) {
+			return v.path, nil
+		}
+	}
+	return "", ErrNoSuchVersion
+}
+
+// restoreVersion moves the version at versionPath back to filePath. Any
+// file currently at filePath is archived first.
+func restoreVersion(versionPath, filePath string, archive func(string) error) error {
+	// Move the version aside while archiving the current file, as that could
+	// otherwise replace or expire it.
+	tmp := versionPath + ".restoring"
+	if err := osutil.Rename(versionPath, tmp); err != nil {
+		return err
+	}
+	if err := archive(filePath); err != nil {
+		osutil.Rename(tmp, versionPath)
+		return err
+	}
+
+	if debug {
+		l.Debugln("restoring", versionPath, "to", filePath)
+	}
+	if err := osutil.MkdirAll(filepath.Dir(filePath), 0755); err != nil && !os.IsExist(err) {
+		osutil.Rename(tmp, versionPath)
+		return err
+	}
+	return osutil.Rename(tmp, filePath)
+}
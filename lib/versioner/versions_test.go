@@ -0,0 +1,138 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package versioner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUntaggedFilename(t *testing.T) {
+	cases := [][3]string{
+		{filepath.Join("foo", "bar~20140612-200554.baz"), filepath.Join("foo", "bar.baz"), "20140612-200554"},
+		{"bar~20140612-200554", "bar", "20140612-200554"},
+		{"bar.baz~20140612-200554", "bar.baz", "20140612-200554"},
+		{"alle~4~20141106-094415.mgz", "alle~4.mgz", "20141106-094415"},
+		{"bar.baz", "", ""},
+	}
+
+	for _, tc := range cases {
+		name, tag := untaggedFilename(tc[0])
+		if name != tc[1] || tag != tc[2] {
+			t.Errorf("untaggedFilename(%q) = %q, %q; expected %q, %q", tc[0], name, tag, tc[1], tc[2])
+		}
+	}
+}
+
+func writeVersionedFile(t *testing.T, path, data string, modTime time.Time) {
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSimpleListRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "versioner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v := NewSimple("", dir, map[string]string{"keep": "5"})
+	path := filepath.Join(dir, "file.txt")
+
+	t0 := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	t1 := t0.Add(time.Hour)
+	writeVersionedFile(t, path, "version 0", t0)
+	if err := v.Archive(path); err != nil {
+		t.Fatal(err)
+	}
+	writeVersionedFile(t, path, "version 1", t1)
+	if err := v.Archive(path); err != nil {
+		t.Fatal(err)
+	}
+	writeVersionedFile(t, path, "current", time.Now())
+
+	versions, err := v.List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || len(versions["file.txt"]) != 2 {
+		t.Fatalf("unexpected versions %v", versions)
+	}
+	if vt := versions["file.txt"][0].VersionTime; !vt.Equal(t0) {
+		t.Errorf("oldest version time %v != %v", vt, t0)
+	}
+
+	if err := v.Restore(path, t0); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "version 0" {
+		t.Errorf("restored file contains %q, %v", data, err)
+	}
+
+	// The current file should have been archived while the restored version
+	// is no longer in the archive.
+	versions, err = v.List(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions["file.txt"]) != 2 {
+		t.Fatalf("unexpected versions %v", versions)
+	}
+	for _, fv := range versions["file.txt"] {
+		if fv.VersionTime.Equal(t0) {
+			t.Error("restored version still in archive")
+		}
+	}
+
+	if err := v.Restore(path, t0); err != ErrNoSuchVersion {
+		t.Errorf("unexpected error %v restoring nonexistent version", err)
+	}
+}
+
+func TestTrashcanListRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "versioner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v := NewTrashcan("", dir, nil)
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "sub", "file")
+	writeVersionedFile(t, path, "deleted", time.Now())
+	if err := v.Archive(path); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := v.List(filepath.Join(dir, "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join("sub", "file")
+	if len(versions) != 1 || len(versions[name]) != 1 {
+		t.Fatalf("unexpected versions %v", versions)
+	}
+
+	if err := v.Restore(path, versions[name][0].VersionTime); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "deleted" {
+		t.Errorf("restored file contains %q, %v", data, err)
+	}
+	if versions, err := v.List(dir); err != nil || len(versions) != 0 {
+		t.Errorf("unexpected versions %v, %v after restore", versions, err)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package watcher delivers file system change notifications for a directory
+// tree.
+package watcher
+
+import "errors"
+
+// eventBufferSize is the number of changed paths that may be queued before
+// the consumer reads them. Beyond that, further changes are reported as an
+// overflow.
+const eventBufferSize = 4096
+
+var ErrUnsupported = errors.New("file system notifications are not supported on this platform")
+
+// A Watcher reports changes to files and directories below a root
+// directory.
+type Watcher struct {
+	dir      string
+	events   chan string
+	overflow chan struct{}
+	stop     chan struct{}
+	impl     watcherImpl
+}
+
+type watcherImpl interface {
+	close() error
+}
+
+// Events returns the channel on which the names of changed files and
+// directories are delivered, relative to the watched directory.
+func (w *Watcher) Events() <-chan string {
+	return w.events
+}
+
+// Overflow returns a channel that receives a value when changes may have
+// been lost, because the operating system or the consumer could not keep up.
+// The whole tree should then be considered changed.
+func (w *Watcher) Overflow() <-chan struct{} {
+	return w.overflow
+}
+
+// Close stops watching and releases the resources held by the watcher.
+func (w *Watcher) Close() error {
+	close(w.stop)
+	return w.impl.close()
+}
+
+func newWatcher(dir string) *Watcher {
+	return &Watcher{
+		dir:      dir,
+		events:   make(chan string, eventBufferSize),
+		overflow: make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+}
+
+// changed queues the name for delivery, signalling an overflow instead if
+// the consumer is not keeping up.
+func (w *Watcher) changed(name string) {
+	if debug {
+		l.Debugln("watcher: changed", name)
+	}
+	select {
+	case w.events <- name:
+	default:
+		w.overflowed()
+	}
+}
+
+func (w *Watcher) overflowed() {
+	if debug {
+		l.Debugln("watcher: overflow in", w.dir)
+	}
+	select {
+	case w.overflow <- struct{}{}:
+	default:
+		// An overflow is already pending.
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+	syscall.IN_ATTRIB | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF | syscall.IN_ONLYDIR
+
+type inotifyWatcher struct {
+	*Watcher
+	file *os.File
+	fd   int
+
+	mut     sync.Mutex
+	watches map[int]string // watch descriptor -> directory relative to root
+}
+
+// New starts watching the directory tree at dir. An error is returned if
+// the tree cannot be watched in its entirety, typically because the limit of
+// inotify watches has been reached.
+func New(dir string) (*Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &inotifyWatcher{
+		Watcher: newWatcher(dir),
+		// A non blocking descriptor is handled by the runtime poller, so that
+		// closing the file interrupts a pending read.
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		fd:      fd,
+		watches: make(map[int]string),
+	}
+	w.impl = w
+
+	if err := w.addTree(""); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+
+	go w.readEvents()
+	return w.Watcher, nil
+}
+
+func (w *inotifyWatcher) close() error {
+	return w.file.Close()
+}
+
+// addTree adds watches for the directory rel and all directories below it.
+func (w *inotifyWatcher) addTree(rel string) error {
+	root := filepath.Join(w.dir, rel)
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed while we were walking; that change is reported
+				// by the watch on the parent.
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+
+		name, err := filepath.Rel(w.dir, path)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			name = ""
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, path, watchMask)
+		if err == syscall.ENOENT || err == syscall.ENOTDIR {
+			return nil
+		} else if err != nil {
+			return &os.PathError{Op: "inotify_add_watch", Path: path, Err: err}
+		}
+
+		w.mut.Lock()
+		w.watches[wd] = name
+		w.mut.Unlock()
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) readEvents() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			select {
+			case <-w.stop:
+			default:
+				l.Infof("Stopped watching %s for changes: %v", w.dir, err)
+				w.overflowed()
+			}
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(ev.Len)]
+			offset += syscall.SizeofInotifyEvent + int(ev.Len)
+
+			// The name is padded with NUL bytes to an alignment boundary.
+			for i, c := range nameBytes {
+				if c == 0 {
+					nameBytes = nameBytes[:i]
+					break
+				}
+			}
+			w.handleEvent(int(ev.Wd), ev.Mask, string(nameBytes))
+		}
+	}
+}
+
+func (w *inotifyWatcher) handleEvent(wd int, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		w.overflowed()
+		return
+	}
+
+	w.mut.Lock()
+	dir, ok := w.watches[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.watches, wd)
+	}
+	w.mut.Unlock()
+
+	if !ok || mask&syscall.IN_IGNORED != 0 {
+		return
+	}
+
+	if mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0 {
+		// The removal or move is also reported, with a name, on the parent.
+		// The root itself has no watched parent and is reported here.
+		if dir == "" {
+			w.changed("")
+		}
+		return
+	}
+
+	rel := filepath.Join(dir, name)
+	if mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		// Files may have been created in the new directory before the watch
+		// was in place. They are picked up when the directory itself is
+		// scanned.
+		if err := w.addTree(rel); err != nil {
+			l.Infof("Cannot watch %s for changes: %v", filepath.Join(w.dir, rel), err)
+			w.overflowed()
+		}
+	}
+
+	w.changed(rel)
+}
@@ -0,0 +1,69 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func expectChange(t *testing.T, w *Watcher, name string) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-w.Events():
+			if ev == name {
+				return
+			}
+		case <-w.Overflow():
+			t.Fatal("unexpected overflow")
+		case <-timeout:
+			t.Fatalf("timeout waiting for change to %q", name)
+		}
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "existing"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "existing", "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectChange(t, w, filepath.Join("existing", "file"))
+
+	// A newly created directory should be watched as well.
+	if err := os.Mkdir(filepath.Join(dir, "new"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	expectChange(t, w, "new")
+	if err := ioutil.WriteFile(filepath.Join(dir, "new", "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectChange(t, w, filepath.Join("new", "file"))
+
+	if err := os.Remove(filepath.Join(dir, "existing", "file")); err != nil {
+		t.Fatal(err)
+	}
+	expectChange(t, w, filepath.Join("existing", "file"))
+}
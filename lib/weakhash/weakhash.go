@@ -0,0 +1,171 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package weakhash implements an rsync style rolling checksum, used to find
+// blocks of data at arbitrary offsets in existing files.
+package weakhash
+
+import (
+	"bufio"
+	"hash"
+	"io"
+	"os"
+)
+
+// Size is the size of the checksum in bytes.
+const Size = 4
+
+// maxOffsets is the maximum number of offsets remembered per hash. Files
+// with lots of identical blocks (zeroes, typically) would otherwise make the
+// finder use a lot of memory for no gain.
+const maxOffsets = 16
+
+type digest struct {
+	a, b uint16
+	n    uint16
+}
+
+// New returns a new hash.Hash32 computing the rolling checksum.
+func New() hash.Hash32 {
+	return &digest{}
+}
+
+func (d *digest) Write(data []byte) (int, error) {
+	for _, c := range data {
+		d.a += uint16(c)
+		d.b += d.a
+		d.n++
+	}
+	return len(data), nil
+}
+
+func (d *digest) Sum(b []byte) []byte {
+	s := d.Sum32()
+	return append(b, byte(s>>24), byte(s>>16), byte(s>>8), byte(s))
+}
+
+func (d *digest) Sum32() uint32 {
+	return uint32(d.a) | uint32(d.b)<<16
+}
+
+func (d *digest) Reset() {
+	*d = digest{}
+}
+
+func (d *digest) Size() int {
+	return Size
+}
+
+func (d *digest) BlockSize() int {
+	return 1
+}
+
+// roll updates the checksum for a window moved one byte forward, where out
+// is the byte leaving the window and in the byte entering it.
+func (d *digest) roll(out, in byte) {
+	d.a += uint16(in) - uint16(out)
+	d.b += d.a - d.n*uint16(out)
+}
+
+// Find returns the offsets in the reader where a block of the given size
+// starts that has one of the given checksums.
+func Find(r io.Reader, hashesToFind []uint32, size int) (map[uint32][]int64, error) {
+	if r == nil || len(hashesToFind) == 0 || size <= 0 {
+		return nil, nil
+	}
+
+	offsets := make(map[uint32][]int64)
+	for _, h := range hashesToFind {
+		offsets[h] = nil
+	}
+
+	br := bufio.NewReader(r)
+	window := make([]byte, size)
+	if _, err := io.ReadFull(br, window); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return offsets, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	d := &digest{}
+	d.Write(window)
+
+	var offset int64
+	i := 0
+	for {
+		if list, ok := offsets[d.Sum32()]; ok && len(list) < maxOffsets {
+			offsets[d.Sum32()] = append(list, offset)
+		}
+
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		d.roll(window[i], c)
+		window[i] = c
+		i = (i + 1) % size
+		offset++
+	}
+
+	return offsets, nil
+}
+
+// A Finder looks up blocks by their rolling checksum in a given file.
+type Finder struct {
+	file    *os.File
+	size    int
+	offsets map[uint32][]int64
+}
+
+// NewFinder reads the file at path and remembers where blocks of the given
+// size having any of the given checksums are located.
+func NewFinder(path string, size int, hashesToFind []uint32) (*Finder, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets, err := Find(file, hashesToFind, size)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &Finder{
+		file:    file,
+		size:    size,
+		offsets: offsets,
+	}, nil
+}
+
+// Iterate reads the data at each offset matching the given checksum into
+// buf and calls iterFn with the offset, until it returns true. Returns
+// whether iterFn returned true for any offset.
+func (h *Finder) Iterate(hash uint32, buf []byte, iterFn func(int64) bool) (bool, error) {
+	if h == nil || len(buf) != h.size {
+		return false, nil
+	}
+
+	for _, offset := range h.offsets[hash] {
+		if _, err := h.file.ReadAt(buf, offset); err != nil {
+			return false, err
+		}
+		if iterFn(offset) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Close releases the file held open by the finder.
+func (h *Finder) Close() {
+	if h != nil && h.file != nil {
+		h.file.Close()
+	}
+}
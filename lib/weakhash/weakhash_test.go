@@ -0,0 +1,99 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package weakhash
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func checksum(data []byte) uint32 {
+	h := New()
+	h.Write(data)
+	return h.Sum32()
+}
+
+func TestRoll(t *testing.T) {
+	data := make([]byte, 1024)
+	rand.Read(data)
+
+	const size = 64
+	d := &digest{}
+	d.Write(data[:size])
+	for i := 1; i+size <= len(data); i++ {
+		d.roll(data[i-1], data[i+size-1])
+		if exp := checksum(data[i : i+size]); d.Sum32() != exp {
+			t.Fatalf("offset %d: rolled checksum %08x != %08x", i, d.Sum32(), exp)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	data := make([]byte, 4096)
+	rand.Read(data)
+
+	const size = 128
+	block := data[1000 : 1000+size]
+	offsets, err := Find(bytes.NewReader(data), []uint32{checksum(block), 42}, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, offset := range offsets[checksum(block)] {
+		if offset == 1000 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("block at offset 1000 not found in %v", offsets)
+	}
+}
+
+func TestFinderShifted(t *testing.T) {
+	const size = 256
+	orig := make([]byte, 4*size)
+	rand.Read(orig)
+
+	// The file on disk has a byte inserted near the start, shifting all the
+	// original blocks.
+	shifted := append([]byte{0x42}, orig...)
+	fd, err := ioutil.TempFile("", "weakhash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	fd.Write(shifted)
+	fd.Close()
+
+	var hashes []uint32
+	for i := 0; i < len(orig); i += size {
+		hashes = append(hashes, checksum(orig[i:i+size]))
+	}
+
+	finder, err := NewFinder(fd.Name(), size, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer finder.Close()
+
+	buf := make([]byte, size)
+	for i, hash := range hashes {
+		ok, err := finder.Iterate(hash, buf, func(offset int64) bool {
+			return bytes.Equal(buf, orig[i*size:(i+1)*size])
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Errorf("block %d not found", i)
+		}
+	}
+}